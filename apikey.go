@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefixLength -- number of leading characters of a key stored in the
+// clear, used to find the key and to tell keys apart when listing them
+const apiKeyPrefixLength = 8
+
+// maxScopedBodySize -- largest request body read to check a key's domain scope
+const maxScopedBodySize = 1 << 20
+
+// ErrAmbiguousScopeTarget -- the body names more than one domain/FQDN, so which
+// one the view acts on can't be checked against the key's domains
+var ErrAmbiguousScopeTarget = errors.New("request names more than one domain")
+
+// domainScopedEndpoints -- the only paths keys scoped to domains can use, each
+// with the body field holding the FQDN of the record its view acts on. Other
+// views act on users, teams, roles or several records, which a domain can't
+// be checked against.
+var domainScopedEndpoints = map[string]string{
+	"/record/create":      "Name",
+	"/record/update":      "Name",
+	"/record/delete":      "Name",
+	"/cache/record/purge": "FQDN",
+}
+
+// APIKey -- struct for storing information regarding a named api key. Only
+// the prefix and a hash of the key are stored, Key is only ever populated
+// right after the key has been created.
+//
+// Keys can be scoped: ReadOnly keys can only make GET requests, Domains limits
+// the key to requests for those domains/FQDNs and Endpoints to those paths.
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Key        string     `json:"key,omitempty"`
+	Prefix     string     `json:"prefix"`
+	ReadOnly   bool       `json:"read_only"`
+	Domains    []string   `json:"domains"`
+	Endpoints  []string   `json:"endpoints"`
+	CreatedOn  time.Time  `json:"created_on"`
+	LastUsedOn *time.Time `json:"last_used_on"`
+	Legacy     bool       `json:"legacy"` // a copy of the user's key in django's authtoken_token
+	UserID     int        `json:"-"`
+}
+
+func splitScope(scope string) []string {
+	values := []string{}
+	for _, value := range strings.Split(scope, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// IsScoped -- whether the key has less power than its user
+func (k *APIKey) IsScoped() bool {
+	return k.ReadOnly || len(k.Domains) > 0 || len(k.Endpoints) > 0
+}
+
+// Allows -- whether the key's scopes permit the request, the error is set when
+// the request is malformed and should be refused with a 400
+func (k *APIKey) Allows(r *http.Request) (bool, error) {
+	if !k.IsScoped() {
+		return true, nil
+	}
+
+	// scoped keys could otherwise hand themselves an unscoped key
+	if strings.HasPrefix(r.URL.Path, "/user/apikey/") {
+		return false, nil
+	}
+
+	if k.ReadOnly && r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+		return false, nil
+	}
+
+	if len(k.Endpoints) > 0 {
+		allowed := false
+		for _, endpoint := range k.Endpoints {
+			if r.URL.Path == endpoint {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false, nil
+		}
+	}
+
+	if len(k.Domains) > 0 {
+		field, ok := domainScopedEndpoints[r.URL.Path]
+		if !ok {
+			return false, nil
+		}
+
+		target, err := requestTargetFQDN(r, field)
+		if err != nil {
+			return false, err
+		}
+
+		// requests that don't name an FQDN can't be checked, so are refused
+		target = normaliseFQDN(target)
+		if target == "" {
+			return false, nil
+		}
+
+		// check the domain the view looks the record up in, not just the name
+		_, domainName := splitFQDN(target)
+		for _, domain := range k.Domains {
+			domain = normaliseFQDN(domain)
+			if target == domain || domainName == domain || strings.HasSuffix(domainName, "."+domain) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func normaliseFQDN(fqdn string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(fqdn), "."))
+}
+
+// requestTargetFQDN -- the FQDN in field of the request body, the body is left
+// intact for the view to read
+func requestTargetFQDN(r *http.Request, field string) (string, error) {
+	if r.Body == nil {
+		return "", nil
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxScopedBodySize))
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return "", nil
+	}
+
+	// struct fields match keys case insensitively, with several candidates the
+	// view could act on a different one than was checked
+	var target json.RawMessage
+	candidates := 0
+	for name, value := range fields {
+		if strings.EqualFold(name, field) {
+			target = value
+			candidates++
+		}
+	}
+	if candidates > 1 {
+		return "", ErrAmbiguousScopeTarget
+	}
+
+	var fqdn string
+	if err := json.Unmarshal(target, &fqdn); err != nil {
+		return "", nil
+	}
+	return fqdn, nil
+}
+
+// generateAPIKey -- returns a new random api key, same length as django's authtoken keys
+func generateAPIKey() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func apiKeyPrefix(key string) string {
+	if len(key) < apiKeyPrefixLength {
+		return key
+	}
+	return key[:apiKeyPrefixLength]
+}
+
+// Save -- generates a new key and stores it for the user
+func (k *APIKey) Save(dbConn *sql.DB) error {
+	key, err := generateAPIKey()
+	if err != nil {
+		return err
+	}
+
+	k.Key = key
+	return k.saveKey(dbConn, time.Now())
+}
+
+// saveKey -- stores the prefix and hash of an already generated Key
+func (k *APIKey) saveKey(dbConn *sql.DB, createdOn time.Time) error {
+	query := "INSERT INTO api_key (user_id, name, prefix, key_hash, read_only, domains, endpoints, created_on) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer dq.Close()
+
+	prefix := apiKeyPrefix(k.Key)
+	res, err := dq.Exec(k.UserID, k.Name, prefix, hashAPIKey(k.Key), k.ReadOnly, strings.Join(k.Domains, ","), strings.Join(k.Endpoints, ","), createdOn)
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	k.ID = int(id)
+	k.Prefix = prefix
+	k.CreatedOn = createdOn
+	return nil
+}
+
+// Delete -- revokes the key, only if it belongs to UserID
+func (k *APIKey) Delete(dbConn *sql.DB) (bool, error) {
+	query := "DELETE FROM api_key WHERE id = ? AND user_id = ?"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return false, err
+	}
+
+	defer dq.Close()
+
+	res, err := dq.Exec(k.ID, k.UserID)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, nil
+}
+
+// Touch -- records the key as just used
+func (k *APIKey) Touch(dbConn *sql.DB) error {
+	query := "UPDATE api_key SET last_used_on = ? WHERE id = ?"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer dq.Close()
+
+	_, err = dq.Exec(time.Now(), k.ID)
+	return err
+}
+
+// LookupFromKey -- finds the api key matching key, ID is left at 0 when there is none
+func (k *APIKey) LookupFromKey(key string) error {
+	query := "SELECT id, user_id, name, prefix, key_hash, read_only, domains, endpoints, created_on, last_used_on, legacy FROM api_key WHERE prefix = ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer dq.Close()
+
+	rows, err := dq.Query(apiKeyPrefix(key))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	hash := []byte(hashAPIKey(key))
+	for rows.Next() {
+		candidate := APIKey{}
+		var keyHash, domains, endpoints string
+		var lastUsedOn sql.NullTime
+		if err := rows.Scan(&candidate.ID, &candidate.UserID, &candidate.Name, &candidate.Prefix, &keyHash, &candidate.ReadOnly, &domains, &endpoints, &candidate.CreatedOn, &lastUsedOn, &candidate.Legacy); err != nil {
+			return err
+		}
+
+		if subtle.ConstantTimeCompare(hash, []byte(keyHash)) == 1 {
+			candidate.Domains = splitScope(domains)
+			candidate.Endpoints = splitScope(endpoints)
+			if lastUsedOn.Valid {
+				candidate.LastUsedOn = &lastUsedOn.Time
+			}
+			*k = candidate
+			return nil
+		}
+	}
+
+	return rows.Err()
+}
+
+func (u *User) GetAPIKeys(dbConn *sql.DB) []APIKey {
+	keys := []APIKey{}
+	query := "SELECT id, name, prefix, read_only, domains, endpoints, created_on, last_used_on, legacy FROM api_key WHERE user_id = ? ORDER BY id"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer dq.Close()
+
+	rows, err := dq.Query(u.ID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key := APIKey{UserID: u.ID}
+		var domains, endpoints string
+		var lastUsedOn sql.NullTime
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &key.ReadOnly, &domains, &endpoints, &key.CreatedOn, &lastUsedOn, &key.Legacy); err != nil {
+			log.Fatal(err)
+		}
+		key.Domains = splitScope(domains)
+		key.Endpoints = splitScope(endpoints)
+		if lastUsedOn.Valid {
+			key.LastUsedOn = &lastUsedOn.Time
+		}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAPIKeyAllows(t *testing.T) {
+	routerKey := APIKey{
+		Domains:   []string{"home.example.com"},
+		Endpoints: []string{"/record/update"},
+	}
+	readOnlyKey := APIKey{ReadOnly: true}
+	zoneKey := APIKey{Domains: []string{"example.com."}}
+
+	tests := []struct {
+		name    string
+		key     APIKey
+		method  string
+		path    string
+		body    string
+		allowed bool
+	}{
+		{"unscoped", APIKey{}, "DELETE", "/domain/delete", `{"Name":"example.com"}`, true},
+		{"router update", routerKey, "POST", "/record/update", `{"Name":"home.example.com","IPAddress":"1.1.1.1"}`, true},
+		{"router other record", routerKey, "POST", "/record/update", `{"Name":"work.example.com"}`, false},
+		{"router other endpoint", routerKey, "DELETE", "/record/delete", `{"Name":"home.example.com"}`, false},
+		{"read only list", readOnlyKey, "GET", "/record/list", "", true},
+		{"read only create", readOnlyKey, "POST", "/record/create", `{"Name":"a.example.com"}`, false},
+		{"zone record", zoneKey, "POST", "/record/create", `{"name":"A.Example.com"}`, true},
+		{"zone purge", zoneKey, "POST", "/cache/record/purge", `{"FQDN":"a.example.com"}`, true},
+		{"zone lookalike", zoneKey, "POST", "/record/create", `{"Name":"a.badexample.com"}`, false},
+		{"zone without target", zoneKey, "GET", "/record/list", "", false},
+		{"scoped key management", zoneKey, "POST", "/user/apikey/create", `{"Name":"example.com"}`, false},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, "http://127.0.0.1:8080"+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if allowed, err := test.key.Allows(req); err != nil || allowed != test.allowed {
+			t.Errorf("%s: got %v (%v) wanted %v", test.name, allowed, err, test.allowed)
+		}
+
+		// the view still needs to be able to read the body
+		body, _ := ioutil.ReadAll(req.Body)
+		if string(body) != test.body {
+			t.Errorf("%s: request body not preserved, got %q", test.name, body)
+		}
+	}
+}
+
+func TestAPIKeyAllows_AmbiguousTarget(t *testing.T) {
+	key := APIKey{Domains: []string{"allowed.com"}}
+
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/record/update", `{"name":"x.allowed.com","NAME":"y.victim.com"}`},
+		{"/cache/record/purge", `{"fqdn":"a.allowed.com","FQDN":"b.victim.com"}`},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "http://127.0.0.1:8080"+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if allowed, err := key.Allows(req); allowed || err != ErrAmbiguousScopeTarget {
+			t.Errorf("%s: got %v and %v, wanted the body to be refused", test.body, allowed, err)
+		}
+	}
+}
+
+func TestAPIKeyAllows_TargetFieldOfView(t *testing.T) {
+	key := APIKey{Domains: []string{"allowed.com"}}
+
+	// cache purges act on the FQDN, a Name is ignored by the view
+	req, err := http.NewRequest("POST", "http://127.0.0.1:8080/cache/record/purge", strings.NewReader(`{"FQDN":"b.victim.com","IPAddress":"a.allowed.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed, _ := key.Allows(req); allowed {
+		t.Error("allowed a purge of a record outside the key's domains")
+	}
+}
+
+func TestAPIKeyAllows_BodyTooLarge(t *testing.T) {
+	key := APIKey{Domains: []string{"allowed.com"}}
+
+	body := `{"Name":"a.allowed.com","IPAddress":"` + strings.Repeat("1", maxScopedBodySize) + `"}`
+	req, err := http.NewRequest("POST", "http://127.0.0.1:8080/record/update", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed, err := key.Allows(req); allowed || err == nil {
+		t.Errorf("got %v and %v, wanted the body to be refused", allowed, err)
+	}
+}
+
+func TestRequestMiddleware_DomainScopedKey(t *testing.T) {
+	mock, done := mockDB(t)
+	defer done()
+
+	key := "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/record/transfer", `{"Name":"a.allowed.com","Domain":"victim.com","All":true,"ToUserID":3}`},
+		{"/role/assign", `{"Name":"a.allowed.com","UserID":1,"Role":"admin"}`},
+		{"/org/create", `{"Name":"a.allowed.com"}`},
+		{"/record/update", `{"Name":"a.victim.com","IPAddress":"1.1.1.1"}`},
+	}
+
+	for _, test := range tests {
+		mock.ExpectPrepare("FROM api_key WHERE prefix = ?").ExpectQuery().WithArgs(apiKeyPrefix(key)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "key_hash", "read_only", "domains", "endpoints", "created_on", "last_used_on", "legacy"}).
+				AddRow(4, 1, "zone", apiKeyPrefix(key), hashAPIKey(key), false, "allowed.com", "", time.Now(), nil, false))
+		mock.ExpectPrepare("UPDATE api_key SET last_used_on").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+		expectUser(mock, 1, 0, 0, true)
+
+		reached := false
+		handler := requestMiddleware(func(w http.ResponseWriter, r *http.Request) { reached = true })
+
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+		req.Header.Set("X-Api-Key", key)
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		if w.Code != http.StatusForbidden || reached {
+			t.Errorf("%s: got status %d (view reached %v) wanted %d", test.path, w.Code, reached, http.StatusForbidden)
+		}
+	}
+}
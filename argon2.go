@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Hasher implements django's Argon2PasswordHasher, encoded as
+// "argon2$<variant>$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>" with
+// the salt and hash base64 encoded without padding.
+type Argon2Hasher struct {
+	// Defines the variant used to encode the password, argon2id or argon2i.
+	Variant string
+	// Defines the number of passes over the memory.
+	Time uint32
+	// Defines the memory used in KiB.
+	Memory uint32
+	// Defines the number of threads.
+	Threads uint8
+	// Defines the length of the hash in bytes.
+	Size uint32
+}
+
+// Verify if a plain-text password matches the encoded digest.
+func (h *Argon2Hasher) Verify(password string, encoded string) (bool, error) {
+	s := strings.Split(encoded, "$")
+
+	// hashes made by argon2-cffi before 16.0 have no version, meaning 0x10
+	if len(s) == 5 {
+		return false, ErrUnsupportedPasswordHasher
+	}
+	if len(s) != 6 {
+		return false, ErrHashComponentMismatch
+	}
+
+	if s[0] != "argon2" {
+		return false, ErrAlgorithmMismatch
+	}
+
+	if s[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false, ErrUnsupportedPasswordHasher
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(s[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, ErrHashComponentUnreadable
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(s[4])
+	if err != nil {
+		return false, ErrHashComponentUnreadable
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(s[5])
+	if err != nil {
+		return false, ErrHashComponentUnreadable
+	}
+
+	var hash []byte
+	switch s[1] {
+	case "argon2id":
+		hash = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	case "argon2i":
+		hash = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	default:
+		// argon2d isn't provided by x/crypto, django never defaulted to it
+		return false, ErrUnsupportedPasswordHasher
+	}
+
+	return subtle.ConstantTimeCompare(hash, expected) == 1, nil
+}
+
+// Hash encodes a plain-text password with a fresh salt.
+func (h *Argon2Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	var hash []byte
+	switch h.Variant {
+	case "argon2id":
+		hash = argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.Size)
+	case "argon2i":
+		hash = argon2.Key([]byte(password), salt, h.Time, h.Memory, h.Threads, h.Size)
+	default:
+		return "", ErrUnsupportedPasswordHasher
+	}
+
+	return fmt.Sprintf("argon2$%s$v=%d$%s$%s$%s", h.Variant, argon2.Version, h.params(),
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+func (h *Argon2Hasher) params() string {
+	return fmt.Sprintf("m=%d,t=%d,p=%d", h.Memory, h.Time, h.Threads)
+}
+
+// MustUpdate if encoded was made by another algorithm, variant or version, or
+// with different costs.
+func (h *Argon2Hasher) MustUpdate(encoded string) bool {
+	s := strings.Split(encoded, "$")
+	if len(s) != 6 || s[0] != "argon2" {
+		return true
+	}
+	return s[1] != h.Variant || s[2] != fmt.Sprintf("v=%d", argon2.Version) || s[3] != h.params()
+}
+
+// NewArgon2Hasher secures password hashing using argon2id with django's
+// default parameters.
+func NewArgon2Hasher() *Argon2Hasher {
+	return &Argon2Hasher{
+		Variant: "argon2id",
+		Time:    2,
+		Memory:  102400,
+		Threads: 8,
+		Size:    32,
+	}
+}
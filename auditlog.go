@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// AuditEntry -- a sensitive action, who took it and what it was taken on
+type AuditEntry struct {
+	ID             int64           `json:"id"`
+	CreatedOn      time.Time       `json:"created_on"`
+	ActorID        int             `json:"actor_id"`
+	ImpersonatorID int             `json:"impersonator_id,omitempty"` // staff member acting as ActorID
+	Action         string          `json:"action"`
+	ObjectType     string          `json:"object_type"`
+	ObjectID       int             `json:"object_id,omitempty"`
+	Detail         json.RawMessage `json:"detail,omitempty"`
+}
+
+// execer -- a *sql.DB or, to audit an action in the same transaction, a *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// audit -- records that actor took action on the object, detail is stored as
+// JSON. Actions taken while impersonating record the impersonator as well.
+func audit(db execer, actor User, action string, objectType string, objectID int, detail interface{}) error {
+	var detailJSON []byte
+	if detail != nil {
+		var err error
+		if detailJSON, err = json.Marshal(detail); err != nil {
+			return err
+		}
+	}
+
+	query := "INSERT INTO api_audit_log (created_on, actor_id, impersonator_id, action, object_type, object_id, detail) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err := db.Exec(query, time.Now(), nullID(actor.ID), nullID(actor.ImpersonatorID), action, objectType, nullID(objectID), detailJSON)
+	return err
+}
+
+// AuditFilter -- narrows down listAuditEntries, zero values match everything
+type AuditFilter struct {
+	ActorID        int
+	ImpersonatorID int
+	Action         string
+	ObjectType     string
+	ObjectID       int
+}
+
+// listAuditEntries -- the entries matching filter, newest first
+func listAuditEntries(filter AuditFilter, offset int, limit int, dbConn *sql.DB) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+
+	query := "SELECT id, created_on, actor_id, impersonator_id, action, object_type, object_id, detail FROM api_audit_log WHERE 1 = 1"
+	var args []interface{}
+	if filter.ActorID != 0 {
+		query += " AND actor_id = ?"
+		args = append(args, filter.ActorID)
+	}
+	if filter.ImpersonatorID != 0 {
+		query += " AND impersonator_id = ?"
+		args = append(args, filter.ImpersonatorID)
+	}
+	if filter.Action != "" {
+		query += " AND action = ?"
+		args = append(args, filter.Action)
+	}
+	if filter.ObjectType != "" {
+		query += " AND object_type = ?"
+		args = append(args, filter.ObjectType)
+	}
+	if filter.ObjectID != 0 {
+		query += " AND object_id = ?"
+		args = append(args, filter.ObjectID)
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := AuditEntry{}
+		var actorID, impersonatorID, objectID sql.NullInt64
+		var detail []byte
+		if err := rows.Scan(&entry.ID, &entry.CreatedOn, &actorID, &impersonatorID, &entry.Action, &entry.ObjectType, &objectID, &detail); err != nil {
+			return nil, err
+		}
+		entry.ActorID = int(actorID.Int64)
+		entry.ImpersonatorID = int(impersonatorID.Int64)
+		entry.ObjectID = int(objectID.Int64)
+		if len(detail) > 0 {
+			entry.Detail = detail
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
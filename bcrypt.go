@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BCryptHasher implements django's BCryptPasswordHasher and
+// BCryptSHA256PasswordHasher, encoded as "<algorithm>$<bcrypt hash>".
+type BCryptHasher struct {
+	Algorithm string
+	// Defines the log2 number of rounds used to encode the password.
+	Cost int
+	// Pre-hash passwords with SHA256 so they aren't truncated at 72 bytes.
+	PreHash bool
+}
+
+func (h *BCryptHasher) password(password string) []byte {
+	if !h.PreHash {
+		return []byte(password)
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// Verify if a plain-text password matches the encoded digest.
+func (h *BCryptHasher) Verify(password string, encoded string) (bool, error) {
+	s := strings.SplitN(encoded, "$", 2)
+	if len(s) != 2 {
+		return false, ErrHashComponentMismatch
+	}
+
+	if s[0] != h.Algorithm {
+		return false, ErrAlgorithmMismatch
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(s[1]), h.password(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	} else if err != nil {
+		return false, ErrHashComponentUnreadable
+	}
+	return true, nil
+}
+
+// Hash encodes a plain-text password with a fresh salt.
+func (h *BCryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(h.password(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return h.Algorithm + "$" + string(hash), nil
+}
+
+// MustUpdate if encoded was made by another algorithm or with a different cost.
+func (h *BCryptHasher) MustUpdate(encoded string) bool {
+	s := strings.SplitN(encoded, "$", 2)
+	if len(s) != 2 || s[0] != h.Algorithm {
+		return true
+	}
+
+	cost, err := bcrypt.Cost([]byte(s[1]))
+	return err != nil || cost != h.Cost
+}
+
+// NewBCryptSHA256Hasher secures password hashing using bcrypt on the
+// hex encoded SHA256 of the password.
+func NewBCryptSHA256Hasher() *BCryptHasher {
+	return &BCryptHasher{
+		Algorithm: "bcrypt_sha256",
+		Cost:      12,
+		PreHash:   true,
+	}
+}
+
+// NewBCryptHasher secures password hashing using plain bcrypt, only the first
+// 72 bytes of the password count.
+func NewBCryptHasher() *BCryptHasher {
+	return &BCryptHasher{
+		Algorithm: "bcrypt",
+		Cost:      12,
+	}
+}
@@ -2,22 +2,126 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	log "github.com/sirupsen/logrus"
-
-	"github.com/go-redis/redis"
+	"time"
 )
 
-func manageCacheChannel(channel <-chan CacheControlMessage, redisClient *redis.Client, redisChannel string) {
+// manageCacheChannel -- publishes messages received on channel. When window is
+// non-zero, messages arriving within window of the first one (up to maxBatch
+// of them) are coalesced and published together as a single batch envelope.
+func manageCacheChannel(channel <-chan CacheControlMessage, publisher CachePublisher, window time.Duration, maxBatch int) {
 	for {
 		select {
 		case msg := <-channel:
-			msgJSON, err := json.Marshal(msg)
-			if err != nil {
-				log.Fatal(err)
+			batch := []CacheControlMessage{msg}
+			if window > 0 {
+				timer := time.NewTimer(window)
+			collect:
+				for maxBatch <= 0 || len(batch) < maxBatch {
+					select {
+					case msg := <-channel:
+						batch = append(batch, msg)
+					case <-timer.C:
+						break collect
+					}
+				}
+				timer.Stop()
 			}
-			if !redisPublish(redisClient, redisChannel, string(msgJSON)) {
-				log.Fatalf("Could not publish message to Redis")
+
+			publishCacheMessages(publisher, coalesceCacheMessages(batch))
+		}
+	}
+}
+
+// publishCacheMessages -- publishes a single message as-is so consumers that
+// don't understand batches keep working, anything more goes out as one batch
+func publishCacheMessages(publisher CachePublisher, msgs []CacheControlMessage) {
+	msg := msgs[0]
+	if len(msgs) > 1 {
+		msg = CacheControlMessage{
+			Action: "batch",
+			Batch:  msgs,
+		}
+	}
+
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := publisher.Publish(msgJSON); err != nil {
+		log.Errorf("Could not publish cache control message: %s", err)
+	}
+}
+
+// cacheObjectKey -- identifies the object a message refers to so repeated
+// changes to the same domain/record can be merged
+func cacheObjectKey(msg CacheControlMessage) string {
+	var object struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal([]byte(msg.Object), &object); err != nil {
+		// not something we know how to identify, never merge it
+		return ""
+	}
+
+	if object.ID != 0 {
+		return fmt.Sprintf("%s:id:%d", msg.Type, object.ID)
+	}
+	return fmt.Sprintf("%s:name:%s", msg.Type, object.Name)
+}
+
+// mergeCacheMessages -- combines two changes to the same object into one
+func mergeCacheMessages(earlier CacheControlMessage, later CacheControlMessage) CacheControlMessage {
+	switch {
+	case later.Action == "update" && earlier.Action == "create":
+		// the consumer never saw the created state, just create the final one
+		later.Action = "create"
+		later.Previous = ""
+	case later.Action == "update" && earlier.Action == "update":
+		// keep the state the consumer actually has cached
+		later.Previous = earlier.Previous
+	case later.Action == "purge" && earlier.Action == "update":
+		// the updated state never reached the consumer, purge what it has
+		later.Object = earlier.Previous
+	case later.Action == "create" && earlier.Action == "purge":
+		// the consumer still has the purged state, which may be under another
+		// name or address, so replace it rather than only creating the new one
+		later.Action = "update"
+		later.Previous = earlier.Object
+	}
+
+	return later
+}
+
+// coalesceCacheMessages -- merges repeated changes to the same object, the
+// merged message takes the position of the latest change to that object
+func coalesceCacheMessages(msgs []CacheControlMessage) []CacheControlMessage {
+	merged := make(map[string]CacheControlMessage)
+	latest := make(map[string]int)
+	for i, msg := range msgs {
+		key := cacheObjectKey(msg)
+		if key == "" {
+			continue
+		}
+		if earlier, ok := merged[key]; ok {
+			msg = mergeCacheMessages(earlier, msg)
+		}
+		merged[key] = msg
+		latest[key] = i
+	}
+
+	var coalesced []CacheControlMessage
+	for i, msg := range msgs {
+		if key := cacheObjectKey(msg); key != "" {
+			if latest[key] != i {
+				continue
 			}
+			msg = merged[key]
 		}
+		coalesced = append(coalesced, msg)
 	}
+
+	return coalesced
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.com/lsoftop/api-server/cachecontrol"
+)
+
+func waitForMessages(t *testing.T, publisher *MemoryCachePublisher, count int) [][]byte {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if msgs := publisher.Published(); len(msgs) >= count {
+			return msgs
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d published messages", count)
+	return nil
+}
+
+func TestManageCacheChannel_MemoryPublisher(t *testing.T) {
+	publisher := &MemoryCachePublisher{}
+	channel := make(chan CacheControlMessage)
+	go manageCacheChannel(channel, publisher, 0, 0)
+
+	record := testRecord
+	if err := record.Purge(channel); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := waitForMessages(t, publisher, 1)
+
+	var msg CacheControlMessage
+	if err := json.Unmarshal(msgs[0], &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Action != "purge" || msg.Type != "record" {
+		t.Errorf("unexpected message published: %+v", msg)
+	}
+}
+
+func TestWebhookCachePublisher(t *testing.T) {
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	publisher, err := newCachePublisher("webhook", nil, "", "", "", []string{server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := publisher.Publish([]byte(`{"Action":"purge"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(received) != `{"Action":"purge"}` {
+		t.Errorf("webhook received unexpected body: %s", received)
+	}
+}
+
+func TestRedisCachePublisher_Error(t *testing.T) {
+	server, reset := mockRedis(t)
+	defer reset()
+
+	publisher := &RedisCachePublisher{Client: redisClient, Channel: "cache_purge"}
+	if err := publisher.Publish([]byte(`{"Action":"purge"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unreachable redis is reported to the caller instead of exiting
+	server.Close()
+	if err := publisher.Publish([]byte(`{"Action":"purge"}`)); err == nil {
+		t.Error("expected an error once redis is down")
+	}
+}
+
+func TestNewCachePublisher_Unknown(t *testing.T) {
+	if _, err := newCachePublisher("carrier-pigeon", nil, "", "", "", nil); err == nil {
+		t.Error("expected an error for an unknown publisher type")
+	}
+}
+
+func TestManageCacheChannel_Batch(t *testing.T) {
+	publisher := &MemoryCachePublisher{}
+	channel := make(chan CacheControlMessage)
+	go manageCacheChannel(channel, publisher, 50*time.Millisecond, 0)
+
+	record := testRecord
+	other := testRecord
+	other.ID = 2
+	other.Name = "other"
+
+	domain := Domain{ID: 1, Name: "example.com"}
+
+	record.Purge(channel)
+	record.Cache(channel, domain)
+	other.Cache(channel, domain)
+
+	msgs := waitForMessages(t, publisher, 1)
+	if len(msgs) != 1 {
+		t.Fatalf("expected a single batch to be published, got %d messages", len(msgs))
+	}
+
+	var msg CacheControlMessage
+	if err := json.Unmarshal(msgs[0], &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Action != "batch" {
+		t.Fatalf("expected a batch envelope, got action %s", msg.Action)
+	}
+
+	// purge+create of the same record (into an update replacing the purged
+	// state) and the two negative purges of the shared parent domain should
+	// each have been merged
+	var got []string
+	for _, m := range msg.Batch {
+		got = append(got, m.Action+" "+cacheObjectKey(m))
+	}
+
+	expected := []string{
+		"purge negative:name:test.example.com",
+		"update record:id:1",
+		"purge negative:name:other.example.com",
+		"purge negative:name:example.com",
+		"create record:id:2",
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("got batch %v wanted %v", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("batch message %d: got %s wanted %s", i, got[i], expected[i])
+		}
+	}
+}
+
+func TestCoalesceCacheMessages(t *testing.T) {
+	msgs := []CacheControlMessage{
+		{Action: "create", Type: "record", Object: `{"id":1,"name":"a"}`},
+		{Action: "create", Type: "domain", Object: `{"id":1,"name":"example.com"}`},
+		{Action: "purge", Type: "record", Object: `{"id":1,"name":"a"}`},
+		{Action: "create", Type: "record", Object: `{"id":2,"name":"b"}`},
+	}
+
+	coalesced := coalesceCacheMessages(msgs)
+
+	expected := []string{"domain:create", "record:purge", "record:create"}
+	if len(coalesced) != len(expected) {
+		t.Fatalf("got %d messages, wanted %d", len(coalesced), len(expected))
+	}
+	for i, msg := range coalesced {
+		if msg.Type+":"+msg.Action != expected[i] {
+			t.Errorf("message %d: got %s:%s wanted %s", i, msg.Type, msg.Action, expected[i])
+		}
+	}
+}
+
+func TestSigningCachePublisher(t *testing.T) {
+	signer, err := newCacheSigner("hmac", "1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memory := &MemoryCachePublisher{}
+	publisher := &SigningCachePublisher{Publisher: memory, Signer: signer, MaxAge: time.Minute}
+	if err := publisher.Publish([]byte(`{"Action":"purge"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := cachecontrol.NewVerifier()
+	verifier.AddHMACKey("1", []byte("secret"))
+
+	payload, err := verifier.Verify(memory.Published()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != `{"Action":"purge"}` {
+		t.Errorf("unexpected payload: %s", payload)
+	}
+
+	var msg cachecontrol.SignedMessage
+	if err := json.Unmarshal(memory.Published()[0], &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.MaxAge != 60 || msg.ID == "" {
+		t.Errorf("max_age not signed into the message: %+v", msg)
+	}
+}
+
+func TestCoalesceCacheMessages_Update(t *testing.T) {
+	msgs := []CacheControlMessage{
+		{Action: "update", Type: "record", Object: `{"id":1,"ip":"2.2.2.2"}`, Previous: `{"id":1,"ip":"1.1.1.1"}`},
+		{Action: "update", Type: "record", Object: `{"id":1,"ip":"3.3.3.3"}`, Previous: `{"id":1,"ip":"2.2.2.2"}`},
+		{Action: "create", Type: "record", Object: `{"id":2,"ip":"1.1.1.1"}`},
+		{Action: "update", Type: "record", Object: `{"id":2,"ip":"2.2.2.2"}`, Previous: `{"id":2,"ip":"1.1.1.1"}`},
+	}
+
+	coalesced := coalesceCacheMessages(msgs)
+	if len(coalesced) != 2 {
+		t.Fatalf("got %d messages, wanted 2", len(coalesced))
+	}
+
+	if coalesced[0].Action != "update" || coalesced[0].Previous != `{"id":1,"ip":"1.1.1.1"}` || coalesced[0].Object != `{"id":1,"ip":"3.3.3.3"}` {
+		t.Errorf("consecutive updates not merged: %+v", coalesced[0])
+	}
+
+	if coalesced[1].Action != "create" || coalesced[1].Previous != "" || coalesced[1].Object != `{"id":2,"ip":"2.2.2.2"}` {
+		t.Errorf("create followed by update not merged: %+v", coalesced[1])
+	}
+}
+
+func TestCoalesceCacheMessages_PurgeThenCreate(t *testing.T) {
+	msgs := []CacheControlMessage{
+		{Action: "purge", Type: "record", Object: `{"id":1,"name":"old","ip":"1.1.1.1"}`},
+		{Action: "create", Type: "record", Object: `{"id":1,"name":"new","ip":"2.2.2.2"}`},
+		{Action: "purge", Type: "record", Object: `{"id":2,"name":"gone","ip":"1.1.1.1"}`},
+		{Action: "create", Type: "record", Object: `{"id":2,"name":"back","ip":"2.2.2.2"}`},
+		{Action: "purge", Type: "record", Object: `{"id":2,"name":"back","ip":"2.2.2.2"}`},
+	}
+
+	coalesced := coalesceCacheMessages(msgs)
+	if len(coalesced) != 2 {
+		t.Fatalf("got %d messages, wanted 2", len(coalesced))
+	}
+
+	// the old name is still cached, so it has to go along with caching the new one
+	if coalesced[0].Action != "update" || coalesced[0].Previous != `{"id":1,"name":"old","ip":"1.1.1.1"}` || coalesced[0].Object != `{"id":1,"name":"new","ip":"2.2.2.2"}` {
+		t.Errorf("purge followed by create not merged: %+v", coalesced[0])
+	}
+
+	if coalesced[1].Action != "purge" || coalesced[1].Object != `{"id":2,"name":"gone","ip":"1.1.1.1"}` {
+		t.Errorf("purge, create and purge should purge the cached state: %+v", coalesced[1])
+	}
+}
+
+func TestNewCacheSigner_RejectsExampleKey(t *testing.T) {
+	if _, err := newCacheSigner("hmac", "1", exampleCacheSigningKey); err == nil {
+		t.Error("the example signing key from config.ini was accepted")
+	}
+	if _, err := newCacheSigner("hmac", "1", ""); err == nil {
+		t.Error("an empty signing key was accepted")
+	}
+}
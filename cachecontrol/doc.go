@@ -0,0 +1,36 @@
+// Package cachecontrol signs and verifies the cache control messages the api
+// server publishes to the dns servers. DNS consumers should import it and run
+// every message received through a Verifier before acting on it.
+//
+// The payload returned by Verifier.Verify is a JSON encoded cache control message:
+//
+//	{"Action": "...", "Type": "...", "Object": "...", "Previous": "...", "Batch": [...]}
+//
+// Type is "domain", "record" or "negative". For domains and records Object is
+// the JSON encoded domain or record (id, name, ip, ttl, domain_id, ...), for
+// "negative" it is {"name": "<fqdn>"}. Action is one of:
+//
+//	create  cache Object
+//	purge   remove Object from the cache
+//	update  Previous holds the JSON encoded state being replaced by Object.
+//	        Consumers must apply it atomically: remove Previous and insert
+//	        Object under a single lock, so the old answer is served until the
+//	        new one is, even when the name or type of the record changed.
+//	batch   Batch holds several of the above, apply them in order
+//
+// A purge with a Type of "negative" asks consumers to drop any negative answers
+// (NXDOMAIN/NODATA) they have cached for the name. These are sent ahead of every
+// record create, for the record's FQDN and for its parent domain, so a newly
+// created record resolves straight away.
+//
+// Consumers should ignore actions and types they don't recognise.
+//
+// Replays: every SignedMessage has a random ID and is only accepted until
+// SignedAt plus the shorter of its own MaxAge and the Verifier's. Within that
+// window the Verifier remembers the IDs it has verified and rejects a message
+// seen before with ErrMessageReplayed, after it the message is rejected with
+// ErrMessageExpired, so a captured message can't be acted on twice. The IDs are
+// only kept in memory: use a single Verifier per consumer process, and keep the
+// clocks of the api server and dns servers in sync. With both max ages at 0
+// neither check applies.
+package cachecontrol
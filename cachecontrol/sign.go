@@ -0,0 +1,256 @@
+package cachecontrol
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Algorithms supported for signing messages
+const (
+	AlgorithmHMAC    = "HS256"
+	AlgorithmEd25519 = "EdDSA"
+)
+
+// Errors returned by Verifier.
+var (
+	ErrMalformedMessage = errors.New("cachecontrol: malformed signed message")
+	ErrUnknownKey       = errors.New("cachecontrol: message signed with unknown key id")
+	ErrAlgorithmInvalid = errors.New("cachecontrol: algorithm does not match key")
+	ErrBadSignature     = errors.New("cachecontrol: signature verification failed")
+	ErrMessageExpired   = errors.New("cachecontrol: message is older than the allowed age")
+	ErrMessageReplayed  = errors.New("cachecontrol: message has already been verified")
+)
+
+// DefaultMaxAge -- how old a message NewVerifier accepts, long enough for slow
+// transports while keeping captured messages from being replayed later on
+const DefaultMaxAge = 5 * time.Minute
+
+// SignedMessage -- envelope every cache control message is wrapped in.
+// Payload holds the original JSON encoded message and Signature is the base64
+// signature of KeyID, Algorithm, ID, SignedAt, MaxAge and Payload joined with ".".
+// ID is unique to the message and MaxAge, in seconds, is how long after
+// SignedAt the signer wants it accepted for, 0 leaves it to the verifier.
+type SignedMessage struct {
+	KeyID     string
+	Algorithm string
+	ID        string
+	SignedAt  int64
+	MaxAge    int64
+	Payload   string
+	Signature string
+}
+
+func (m *SignedMessage) signingInput() []byte {
+	return []byte(fmt.Sprintf("%s.%s.%s.%d.%d.%s", m.KeyID, m.Algorithm, m.ID, m.SignedAt, m.MaxAge, m.Payload))
+}
+
+func newMessageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Signer -- signs message payloads with a single key
+type Signer interface {
+	KeyID() string
+	Algorithm() string
+	Sign(input []byte) ([]byte, error)
+}
+
+// HMACSigner -- signs with HMAC-SHA256 using a shared secret
+type HMACSigner struct {
+	ID  string
+	Key []byte
+}
+
+func (s *HMACSigner) KeyID() string     { return s.ID }
+func (s *HMACSigner) Algorithm() string { return AlgorithmHMAC }
+
+func (s *HMACSigner) Sign(input []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write(input)
+	return mac.Sum(nil), nil
+}
+
+// Ed25519Signer -- signs with an Ed25519 private key, consumers only need the public key
+type Ed25519Signer struct {
+	ID  string
+	Key ed25519.PrivateKey
+}
+
+func (s *Ed25519Signer) KeyID() string     { return s.ID }
+func (s *Ed25519Signer) Algorithm() string { return AlgorithmEd25519 }
+
+func (s *Ed25519Signer) Sign(input []byte) ([]byte, error) {
+	return ed25519.Sign(s.Key, input), nil
+}
+
+// Sign -- wraps payload in a SignedMessage and returns it JSON encoded, how
+// long it's accepted for is left to the verifier
+func Sign(signer Signer, payload []byte) ([]byte, error) {
+	return SignWithMaxAge(signer, payload, 0)
+}
+
+// SignWithMaxAge -- Sign, but verifiers also reject the message once it's
+// older than maxAge (rounded up to whole seconds), zero leaves it to them
+func SignWithMaxAge(signer Signer, payload []byte, maxAge time.Duration) ([]byte, error) {
+	id, err := newMessageID()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := SignedMessage{
+		KeyID:     signer.KeyID(),
+		Algorithm: signer.Algorithm(),
+		ID:        id,
+		SignedAt:  time.Now().Unix(),
+		MaxAge:    int64((maxAge + time.Second - 1) / time.Second),
+		Payload:   string(payload),
+	}
+
+	sig, err := signer.Sign(msg.signingInput())
+	if err != nil {
+		return nil, err
+	}
+	msg.Signature = base64.StdEncoding.EncodeToString(sig)
+
+	return json.Marshal(msg)
+}
+
+type verificationKey struct {
+	algorithm string
+	hmacKey   []byte
+	publicKey ed25519.PublicKey
+}
+
+// Verifier -- verifies signed messages against a set of keys indexed by key id.
+// Keep the old and new key configured while rotating. It's safe for
+// concurrent use once its keys have been added.
+type Verifier struct {
+	// MaxAge rejects messages signed longer ago than this, or than the MaxAge
+	// of the message when that is shorter. DefaultMaxAge unless changed, zero
+	// disables the check (and replay detection) unless the message has one.
+	MaxAge time.Duration
+
+	keys map[string]verificationKey
+
+	mu sync.Mutex
+	// ids of verified messages, kept until they'd be rejected as expired
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewVerifier -- returns a Verifier with no keys and a MaxAge of DefaultMaxAge
+func NewVerifier() *Verifier {
+	return &Verifier{
+		MaxAge: DefaultMaxAge,
+		keys:   make(map[string]verificationKey),
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// AddHMACKey -- trust messages signed with the shared secret key under id
+func (v *Verifier) AddHMACKey(id string, key []byte) {
+	v.keys[id] = verificationKey{algorithm: AlgorithmHMAC, hmacKey: key}
+}
+
+// AddEd25519Key -- trust messages signed by the private half of key under id
+func (v *Verifier) AddEd25519Key(id string, key ed25519.PublicKey) {
+	v.keys[id] = verificationKey{algorithm: AlgorithmEd25519, publicKey: key}
+}
+
+// Verify -- checks the signature of a JSON encoded SignedMessage and returns
+// the payload, which is only safe to use when err is nil
+func (v *Verifier) Verify(data []byte) ([]byte, error) {
+	var msg SignedMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, ErrMalformedMessage
+	}
+
+	key, ok := v.keys[msg.KeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	// never let the message pick how it gets verified
+	if msg.Algorithm != key.algorithm {
+		return nil, ErrAlgorithmInvalid
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil || msg.ID == "" || msg.MaxAge < 0 {
+		return nil, ErrMalformedMessage
+	}
+
+	input := msg.signingInput()
+
+	switch key.algorithm {
+	case AlgorithmHMAC:
+		mac := hmac.New(sha256.New, key.hmacKey)
+		mac.Write(input)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return nil, ErrBadSignature
+		}
+	case AlgorithmEd25519:
+		if !ed25519.Verify(key.publicKey, input, sig) {
+			return nil, ErrBadSignature
+		}
+	default:
+		return nil, ErrAlgorithmInvalid
+	}
+
+	maxAge := v.MaxAge
+	if signerMaxAge := time.Duration(msg.MaxAge) * time.Second; signerMaxAge > 0 && (maxAge <= 0 || signerMaxAge < maxAge) {
+		maxAge = signerMaxAge
+	}
+	if maxAge <= 0 {
+		return []byte(msg.Payload), nil
+	}
+
+	expiresAt := time.Unix(msg.SignedAt, 0).Add(maxAge)
+	if time.Now().After(expiresAt) {
+		return nil, ErrMessageExpired
+	}
+
+	if !v.firstSeen(msg.KeyID+"."+msg.ID, expiresAt) {
+		return nil, ErrMessageReplayed
+	}
+
+	return []byte(msg.Payload), nil
+}
+
+// firstSeen -- records id until expiresAt, returns false when it already was
+func (v *Verifier) firstSeen(id string, expiresAt time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	if v.seen == nil {
+		v.seen = make(map[string]time.Time)
+	}
+	if now.Sub(v.lastPrune) > time.Second {
+		for seenID, seenExpiresAt := range v.seen {
+			if now.After(seenExpiresAt) {
+				delete(v.seen, seenID)
+			}
+		}
+		v.lastPrune = now
+	}
+
+	if seenExpiresAt, ok := v.seen[id]; ok && !now.After(seenExpiresAt) {
+		return false
+	}
+	v.seen[id] = expiresAt
+	return true
+}
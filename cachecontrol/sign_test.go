@@ -0,0 +1,214 @@
+package cachecontrol
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestVerify_HMAC(t *testing.T) {
+	signer := &HMACSigner{ID: "k1", Key: []byte("secret")}
+	signed, err := Sign(signer, []byte(`{"Action":"purge"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewVerifier()
+	verifier.AddHMACKey("k1", []byte("secret"))
+
+	payload, err := verifier.Verify(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != `{"Action":"purge"}` {
+		t.Errorf("unexpected payload: %s", payload)
+	}
+}
+
+func TestVerify_Ed25519(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := Sign(&Ed25519Signer{ID: "k2", Key: private}, []byte(`{"Action":"create"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewVerifier()
+	verifier.AddEd25519Key("k2", public)
+
+	if _, err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify_Rejects(t *testing.T) {
+	signed, err := Sign(&HMACSigner{ID: "k1", Key: []byte("secret")}, []byte(`{"Action":"purge"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg SignedMessage
+	if err := json.Unmarshal(signed, &msg); err != nil {
+		t.Fatal(err)
+	}
+	msg.Payload = `{"Action":"create"}`
+	tampered, _ := json.Marshal(msg)
+
+	verifier := NewVerifier()
+	verifier.AddHMACKey("k1", []byte("secret"))
+
+	if _, err := verifier.Verify(tampered); err != ErrBadSignature {
+		t.Errorf("tampered payload: got %v wanted %v", err, ErrBadSignature)
+	}
+
+	other := NewVerifier()
+	other.AddHMACKey("k2", []byte("secret"))
+	if _, err := other.Verify(signed); err != ErrUnknownKey {
+		t.Errorf("unknown key: got %v wanted %v", err, ErrUnknownKey)
+	}
+
+	public, _, _ := ed25519.GenerateKey(rand.Reader)
+	confused := NewVerifier()
+	confused.AddEd25519Key("k1", public)
+	if _, err := confused.Verify(signed); err != ErrAlgorithmInvalid {
+		t.Errorf("algorithm mismatch: got %v wanted %v", err, ErrAlgorithmInvalid)
+	}
+
+	msg.Payload = `{"Action":"purge"}`
+	msg.SignedAt = time.Now().Add(-time.Hour).Unix()
+	old, _ := json.Marshal(msg)
+	verifier.MaxAge = time.Minute
+	if _, err := verifier.Verify(old); err != ErrBadSignature {
+		// SignedAt is covered by the signature, so altering it must fail too
+		t.Errorf("altered timestamp: got %v wanted %v", err, ErrBadSignature)
+	}
+}
+
+// signAt -- signs payload as SignWithMaxAge does, but as if it happened at signedAt
+func signAt(t *testing.T, signer Signer, payload string, signedAt time.Time, maxAge time.Duration) []byte {
+	id, err := newMessageID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := SignedMessage{
+		KeyID:     signer.KeyID(),
+		Algorithm: signer.Algorithm(),
+		ID:        id,
+		SignedAt:  signedAt.Unix(),
+		MaxAge:    int64(maxAge / time.Second),
+		Payload:   payload,
+	}
+	sig, err := signer.Sign(msg.signingInput())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Signature = base64.StdEncoding.EncodeToString(sig)
+
+	signed, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerify_MaxAge(t *testing.T) {
+	signer := &HMACSigner{ID: "k1", Key: []byte("secret")}
+	verifier := NewVerifier()
+	verifier.AddHMACKey("k1", []byte("secret"))
+
+	if verifier.MaxAge != DefaultMaxAge {
+		t.Errorf("got MaxAge %v wanted %v", verifier.MaxAge, DefaultMaxAge)
+	}
+
+	recent := signAt(t, signer, `{"Action":"create"}`, time.Now().Add(-DefaultMaxAge/2), 0)
+	if _, err := verifier.Verify(recent); err != nil {
+		t.Errorf("recent message: %v", err)
+	}
+
+	old := signAt(t, signer, `{"Action":"create"}`, time.Now().Add(-DefaultMaxAge-time.Minute), 0)
+	if payload, err := verifier.Verify(old); err != ErrMessageExpired || payload != nil {
+		t.Errorf("old message: got %q, %v wanted %v", payload, err, ErrMessageExpired)
+	}
+
+	verifier.MaxAge = 0
+	if _, err := verifier.Verify(old); err != nil {
+		t.Errorf("old message without MaxAge: %v", err)
+	}
+}
+
+func TestVerify_SignedMaxAge(t *testing.T) {
+	signer := &HMACSigner{ID: "k1", Key: []byte("secret")}
+	verifier := NewVerifier()
+	verifier.AddHMACKey("k1", []byte("secret"))
+
+	// the shorter of the verifier's and the message's max age applies
+	short := signAt(t, signer, `{"Action":"create"}`, time.Now().Add(-2*time.Minute), time.Minute)
+	if _, err := verifier.Verify(short); err != ErrMessageExpired {
+		t.Errorf("message past its own max age: got %v wanted %v", err, ErrMessageExpired)
+	}
+
+	verifier.MaxAge = 0
+	if _, err := verifier.Verify(short); err != ErrMessageExpired {
+		t.Errorf("message past its own max age without verifier MaxAge: got %v wanted %v", err, ErrMessageExpired)
+	}
+
+	verifier.MaxAge = DefaultMaxAge
+	long := signAt(t, signer, `{"Action":"create"}`, time.Now().Add(-DefaultMaxAge-time.Minute), time.Hour)
+	if _, err := verifier.Verify(long); err != ErrMessageExpired {
+		t.Errorf("message past the verifier MaxAge: got %v wanted %v", err, ErrMessageExpired)
+	}
+
+	signed, err := SignWithMaxAge(signer, []byte(`{"Action":"create"}`), 1500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg SignedMessage
+	if err := json.Unmarshal(signed, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.MaxAge != 2 {
+		t.Errorf("got MaxAge %d wanted 2", msg.MaxAge)
+	}
+}
+
+func TestVerify_Replay(t *testing.T) {
+	signer := &HMACSigner{ID: "k1", Key: []byte("secret")}
+	verifier := NewVerifier()
+	verifier.AddHMACKey("k1", []byte("secret"))
+
+	signed, err := Sign(signer, []byte(`{"Action":"purge"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(signed); err != nil {
+		t.Fatal(err)
+	}
+	if payload, err := verifier.Verify(signed); err != ErrMessageReplayed || payload != nil {
+		t.Errorf("replayed message: got %q, %v wanted %v", payload, err, ErrMessageReplayed)
+	}
+
+	// the same payload signed again is a new message
+	again, err := Sign(signer, []byte(`{"Action":"purge"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(again); err != nil {
+		t.Errorf("message signed again: %v", err)
+	}
+
+	var msg SignedMessage
+	if err := json.Unmarshal(signed, &msg); err != nil {
+		t.Fatal(err)
+	}
+	msg.ID = ""
+	withoutID, _ := json.Marshal(msg)
+	if _, err := verifier.Verify(withoutID); err != ErrMalformedMessage {
+		t.Errorf("message without id: got %v wanted %v", err, ErrMalformedMessage)
+	}
+}
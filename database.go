@@ -3,6 +3,8 @@ package main
 import (
 	"database/sql"
 	"fmt"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 var dbConn sql.DB
@@ -23,3 +25,10 @@ func dbConnect(username string, password string, host string, port int, database
 	dbConn = *dbc
 	return nil
 }
+
+// isDuplicateKeyError -- whether err is MySQL refusing a row that collides
+// with a unique key
+func isDuplicateKeyError(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == 1062
+}
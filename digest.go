@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"hash"
+	"strings"
+)
+
+// DigestHasher implements django's salted SHA1/MD5 hashers, encoded as
+// "<algorithm>$<salt>$<hex digest of salt + password>". Only kept so old
+// passwords keep working.
+type DigestHasher struct {
+	Algorithm string
+	Digest    func() hash.Hash
+}
+
+// Verify if a plain-text password matches the encoded digest.
+func (h *DigestHasher) Verify(password string, encoded string) (bool, error) {
+	s := strings.Split(encoded, "$")
+	if len(s) != 3 {
+		return false, ErrHashComponentMismatch
+	}
+
+	algorithm, salt := s[0], s[1]
+	if algorithm != h.Algorithm {
+		return false, ErrAlgorithmMismatch
+	}
+
+	digest := h.Digest()
+	digest.Write([]byte(salt + password))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(digest.Sum(nil))), []byte(s[2])) == 1, nil
+}
+
+func NewSHA1Hasher() *DigestHasher {
+	return &DigestHasher{Algorithm: "sha1", Digest: sha1.New}
+}
+
+func NewMD5Hasher() *DigestHasher {
+	return &DigestHasher{Algorithm: "md5", Digest: md5.New}
+}
+
+// UnsaltedDigestHasher implements django's unsalted SHA1/MD5 hashers, encoded
+// as "sha1$$<hex digest>" and "<hex digest>" (or "md5$$<hex digest>").
+type UnsaltedDigestHasher struct {
+	Prefix string
+	Digest func() hash.Hash
+}
+
+// Verify if a plain-text password matches the encoded digest.
+func (h *UnsaltedDigestHasher) Verify(password string, encoded string) (bool, error) {
+	expected := strings.TrimPrefix(encoded, h.Prefix)
+
+	digest := h.Digest()
+	digest.Write([]byte(password))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(digest.Sum(nil))), []byte(expected)) == 1, nil
+}
+
+func NewUnsaltedSHA1Hasher() *UnsaltedDigestHasher {
+	return &UnsaltedDigestHasher{Prefix: "sha1$$", Digest: sha1.New}
+}
+
+func NewUnsaltedMD5Hasher() *UnsaltedDigestHasher {
+	return &UnsaltedDigestHasher{Prefix: "md5$$", Digest: md5.New}
+}
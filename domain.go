@@ -77,7 +77,7 @@ func (d *Domain) Purge(channel chan<- CacheControlMessage) error {
 
 func listDomains(dbConn *sql.DB) []Domain {
 	var domains []Domain
-	query := "SELECT id, name, created_on FROM dns_domain"
+	query := "SELECT id, name, created_on, team_id FROM dns_domain"
 
 	rows, err := dbConn.Query(query)
 	if err != nil {
@@ -86,9 +86,11 @@ func listDomains(dbConn *sql.DB) []Domain {
 	defer rows.Close()
 	for rows.Next() {
 		domain := Domain{}
-		if err := rows.Scan(&domain.ID, &domain.Name, &domain.CreatedOn); err != nil {
+		var teamID sql.NullInt64
+		if err := rows.Scan(&domain.ID, &domain.Name, &domain.CreatedOn, &teamID); err != nil {
 			log.Fatal(err)
 		}
+		domain.TeamID = int(teamID.Int64)
 		domains = append(domains, domain)
 	}
 
@@ -96,7 +98,7 @@ func listDomains(dbConn *sql.DB) []Domain {
 }
 
 func (d *Domain) LookupFromID(id int) error {
-	query := "SELECT id, name, created_on FROM dns_domain WHERE id = ?"
+	query := "SELECT id, name, created_on, team_id FROM dns_domain WHERE id = ?"
 
 	dq, err := dbConn.Prepare(query)
 
@@ -105,7 +107,8 @@ func (d *Domain) LookupFromID(id int) error {
 	}
 
 	defer dq.Close()
-	err = dq.QueryRow(id).Scan(&d.ID, &d.Name, &d.CreatedOn)
+	var teamID sql.NullInt64
+	err = dq.QueryRow(id).Scan(&d.ID, &d.Name, &d.CreatedOn, &teamID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			fmt.Println("Unable to find domain with provided domain id: ", id)
@@ -113,12 +116,13 @@ func (d *Domain) LookupFromID(id int) error {
 		}
 		return err
 	}
+	d.TeamID = int(teamID.Int64)
 
 	return nil
 }
 
 func (d *Domain) LookupFromFQDN(fqdn string) error {
-	query := "SELECT id, name, created_on FROM dns_domain WHERE name = ?"
+	query := "SELECT id, name, created_on, team_id FROM dns_domain WHERE name = ?"
 
 	dq, err := dbConn.Prepare(query)
 
@@ -127,7 +131,8 @@ func (d *Domain) LookupFromFQDN(fqdn string) error {
 	}
 
 	defer dq.Close()
-	err = dq.QueryRow(fqdn).Scan(&d.ID, &d.Name, &d.CreatedOn)
+	var teamID sql.NullInt64
+	err = dq.QueryRow(fqdn).Scan(&d.ID, &d.Name, &d.CreatedOn, &teamID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			fmt.Println("Unable to find domain with provided domain name: ", fqdn)
@@ -135,6 +140,25 @@ func (d *Domain) LookupFromFQDN(fqdn string) error {
 		}
 		return err
 	}
+	d.TeamID = int(teamID.Int64)
 
 	return nil
 }
+
+// SetTeam -- hands the domain to a team, whose members can then manage every
+// record in it. A teamID of 0 takes it away from its team.
+func (d *Domain) SetTeam(teamID int, dbConn *sql.DB) error {
+	query := "UPDATE dns_domain SET team_id = ? WHERE id = ?"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer dq.Close()
+
+	if _, err = dq.Exec(nullID(teamID), d.ID); err != nil {
+		return err
+	}
+	d.TeamID = teamID
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Errors returned when picking a hasher for an encoded password.
+var (
+	ErrUnknownPasswordHasher     = errors.New("unknown password hasher")
+	ErrUnsupportedPasswordHasher = errors.New("password hasher is not supported")
+)
+
+// PasswordHasher -- checks passwords against one of django's encoded formats
+type PasswordHasher interface {
+	// Verify if a plain-text password matches the encoded digest.
+	Verify(password string, encoded string) (bool, error)
+}
+
+// PreferredPasswordHasher -- a hasher passwords can be encoded with, used for
+// new passwords and to rehash old ones on login
+type PreferredPasswordHasher interface {
+	PasswordHasher
+	// Hash encodes a plain-text password with a fresh salt.
+	Hash(password string) (string, error)
+	// MustUpdate if encoded was made by another algorithm or with different
+	// settings than the hasher's.
+	MustUpdate(encoded string) bool
+}
+
+// preferredPasswordHasher -- what passwords are encoded with, configured in [passwords]
+var preferredPasswordHasher PreferredPasswordHasher = NewPBKDF2SHA256Hasher()
+
+// newPreferredPasswordHasher -- returns the hasher for algorithm, workFactor
+// replaces its default iterations (pbkdf2), time cost (argon2), log2 rounds
+// (bcrypt) or CPU/memory cost (scrypt) when set
+func newPreferredPasswordHasher(algorithm string, workFactor int) (PreferredPasswordHasher, error) {
+	if workFactor < 0 {
+		return nil, fmt.Errorf("invalid password work factor: %d", workFactor)
+	}
+
+	switch algorithm {
+	case "", "pbkdf2_sha256", "pbkdf2_sha1":
+		hasher := NewPBKDF2SHA256Hasher()
+		if algorithm == "pbkdf2_sha1" {
+			hasher = NewPBKDF2SHA1Hasher()
+		}
+		if workFactor > 0 {
+			hasher.Iterations = workFactor
+		}
+		return hasher, nil
+	case "argon2":
+		hasher := NewArgon2Hasher()
+		if workFactor > 0 {
+			hasher.Time = uint32(workFactor)
+		}
+		return hasher, nil
+	case "bcrypt_sha256", "bcrypt":
+		hasher := NewBCryptSHA256Hasher()
+		if algorithm == "bcrypt" {
+			hasher = NewBCryptHasher()
+		}
+		if workFactor > 0 {
+			if workFactor < bcrypt.MinCost || workFactor > bcrypt.MaxCost {
+				return nil, fmt.Errorf("bcrypt work factor must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+			}
+			hasher.Cost = workFactor
+		}
+		return hasher, nil
+	case "scrypt":
+		hasher := NewScryptHasher()
+		if workFactor > 0 {
+			if workFactor < 2 || workFactor&(workFactor-1) != 0 {
+				return nil, errors.New("scrypt work factor must be a power of 2")
+			}
+			hasher.WorkFactor = workFactor
+		}
+		return hasher, nil
+	}
+
+	return nil, fmt.Errorf("passwords can't be encoded with %s", algorithm)
+}
+
+// passwordMustUpdate -- whether encoded should be rehashed with the preferred
+// hasher, as django does on login
+func passwordMustUpdate(encoded string) bool {
+	return preferredPasswordHasher.MustUpdate(encoded)
+}
+
+// saltLength -- django's salts are 22 alphanumerics, about 128 bits
+const saltLength = 22
+
+const saltChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// generateSalt -- a random salt in the format django uses
+func generateSalt() (string, error) {
+	b := make([]byte, saltLength)
+	max := big.NewInt(int64(len(saltChars)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = saltChars[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// passwordHashers -- every hasher django ships, keyed by the algorithm prefix
+// of the encoded password
+var passwordHashers = map[string]PasswordHasher{}
+
+func registerPasswordHasher(algorithm string, hasher PasswordHasher) {
+	passwordHashers[algorithm] = hasher
+}
+
+func init() {
+	registerPasswordHasher("pbkdf2_sha256", NewPBKDF2SHA256Hasher())
+	registerPasswordHasher("pbkdf2_sha1", NewPBKDF2SHA1Hasher())
+	registerPasswordHasher("argon2", NewArgon2Hasher())
+	registerPasswordHasher("bcrypt_sha256", NewBCryptSHA256Hasher())
+	registerPasswordHasher("bcrypt", NewBCryptHasher())
+	registerPasswordHasher("scrypt", NewScryptHasher())
+	registerPasswordHasher("sha1", NewSHA1Hasher())
+	registerPasswordHasher("md5", NewMD5Hasher())
+	registerPasswordHasher("unsalted_sha1", NewUnsaltedSHA1Hasher())
+	registerPasswordHasher("unsalted_md5", NewUnsaltedMD5Hasher())
+	// crypt(3) needs the system's crypt library, django dropped it in 5.0
+	registerPasswordHasher("crypt", unsupportedHasher{})
+}
+
+// passwordAlgorithm -- the algorithm an encoded password was made with, the
+// same way django's identify_hasher works it out
+func passwordAlgorithm(encoded string) string {
+	if (len(encoded) == 32 && !strings.Contains(encoded, "$")) || (len(encoded) == 37 && strings.HasPrefix(encoded, "md5$$")) {
+		return "unsalted_md5"
+	}
+	if len(encoded) == 46 && strings.HasPrefix(encoded, "sha1$$") {
+		return "unsalted_sha1"
+	}
+	return strings.SplitN(encoded, "$", 2)[0]
+}
+
+// identifyPasswordHasher -- returns the hasher encoded was made with
+func identifyPasswordHasher(encoded string) (PasswordHasher, error) {
+	hasher, ok := passwordHashers[passwordAlgorithm(encoded)]
+	if !ok {
+		return nil, ErrUnknownPasswordHasher
+	}
+	return hasher, nil
+}
+
+// verifyPassword -- checks password against a django encoded password of any
+// format. Unusable passwords (starting with "!") never match.
+func verifyPassword(password string, encoded string) (bool, error) {
+	if encoded == "" || strings.HasPrefix(encoded, "!") {
+		return false, nil
+	}
+
+	hasher, err := identifyPasswordHasher(encoded)
+	if err != nil {
+		return false, err
+	}
+	return hasher.Verify(password, encoded)
+}
+
+type unsupportedHasher struct{}
+
+func (h unsupportedHasher) Verify(password string, encoded string) (bool, error) {
+	return false, ErrUnsupportedPasswordHasher
+}
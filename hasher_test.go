@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Encoded passwords for "lètmein". The sha1/md5/unsalted vectors are the ones
+// django's auth_tests/test_hashers.py checks, the pbkdf2 and scrypt vectors
+// were made with hashlib.pbkdf2_hmac/hashlib.scrypt, which is what django's
+// hashers call, using django's default parameters.
+var djangoPasswordVectors = map[string]string{
+	"pbkdf2_sha256":                  "pbkdf2_sha256$720000$seasalt2$e8hbsPnTo9qWhT3xYfKWoRth0h0J3360yb/tipPhPtY=",
+	"pbkdf2_sha256 (old iterations)": "pbkdf2_sha256$260000$seasalt2$UCGMhrOoaq1ghQPArIBK5RkI6IZLRxlIwHWA1dMy7y8=",
+	"pbkdf2_sha1":                    "pbkdf2_sha1$720000$seasalt2$2DDbzziqCtfldrRSNAaF8oA9OMw=",
+	"scrypt":                         "scrypt$16384$seasalt$8$1$Qj3+9PPyRjSJIebHnG81TMjsqtaIGxNQG/aEB/NYafTJ7tibgfYz71m0ldQESkXFRkdVCBhhY8mx7rQwite/Pw==",
+	"sha1":                           "sha1$seasalt$cff36ea83f5706ce9aa7454e63e431fc726b2dc8",
+	"md5":                            "md5$seasalt$3f86d0d3d465b7b458c231bf3555c0e3",
+	"unsalted_sha1":                  "sha1$$6d138ca3ae545631b3abd71a4f076ce759c5700b",
+	"unsalted_md5":                   "88a434c88cca4e900f7874cd98123f43",
+	"unsalted_md5 (prefixed)":        "md5$$88a434c88cca4e900f7874cd98123f43",
+}
+
+func TestVerifyPassword_DjangoVectors(t *testing.T) {
+	for name, encoded := range djangoPasswordVectors {
+		valid, err := verifyPassword("lètmein", encoded)
+		if err != nil || !valid {
+			t.Errorf("%s: correct password rejected (%v)", name, err)
+		}
+
+		valid, err = verifyPassword("lètmeinz", encoded)
+		if err != nil || valid {
+			t.Errorf("%s: wrong password accepted (%v)", name, err)
+		}
+	}
+}
+
+func TestVerifyPassword_Argon2(t *testing.T) {
+	vectors := []struct {
+		password string
+		encoded  string
+	}{
+		// from django's auth_tests/test_hashers.py
+		{"secret", "argon2$argon2i$v=19$m=8,t=1,p=1$c2FsdHNhbHQ$YC9+jJCrQhs5R6db7LlN8Q"},
+		// from the argon2 reference implementation's README
+		{"password", "argon2$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG"},
+	}
+
+	for _, v := range vectors {
+		if valid, err := verifyPassword(v.password, v.encoded); err != nil || !valid {
+			t.Errorf("%s: correct password rejected (%v)", v.encoded, err)
+		}
+		if valid, _ := verifyPassword("wrong", v.encoded); valid {
+			t.Errorf("%s: wrong password accepted", v.encoded)
+		}
+	}
+
+	// argon2-cffi hashes from before versions were encoded
+	if _, err := verifyPassword("secret", "argon2$argon2i$m=8,t=1,p=1$c29tZXNhbHQ$gwQOXSNhxiOxPOA0+PY10P9QFO4NAYysnqRt1GSQLE55m+2GYDt9FEjPMHhP2Cuf0nOEXXMocVrsJAtNSsKyfg"); err != ErrUnsupportedPasswordHasher {
+		t.Errorf("version 0x10 argon2 hash should be unsupported, got %v", err)
+	}
+}
+
+func TestVerifyPassword_BCrypt(t *testing.T) {
+	// from pyca/bcrypt's test suite, which django's BCryptPasswordHasher uses
+	encoded := "bcrypt$$2b$04$cVWp4XaNU8a4v1uMRum2SO026BWLIoQMD/TXg5uZV.0P.uO8m3YEm"
+	if valid, err := verifyPassword("Kk4DQuMMfZL9o", encoded); err != nil || !valid {
+		t.Errorf("bcrypt: correct password rejected (%v)", err)
+	}
+	if valid, _ := verifyPassword("wrong", encoded); valid {
+		t.Error("bcrypt: wrong password accepted")
+	}
+
+	// bcrypt_sha256 runs bcrypt over the hex encoded sha256 of the password
+	sum := sha256.Sum256([]byte("lètmein"))
+	hash, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(sum[:])), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded = "bcrypt_sha256$" + string(hash)
+	if valid, err := verifyPassword("lètmein", encoded); err != nil || !valid {
+		t.Errorf("bcrypt_sha256: correct password rejected (%v)", err)
+	}
+	if valid, _ := verifyPassword("lètmeinz", encoded); valid {
+		t.Error("bcrypt_sha256: wrong password accepted")
+	}
+}
+
+func TestVerifyPassword_Unusable(t *testing.T) {
+	for _, encoded := range []string{"", "!", "!RhRrKRTNDvLgFzUP0OIFszFlb2VnaSrnZX3EQqfS"} {
+		if valid, err := verifyPassword("", encoded); err != nil || valid {
+			t.Errorf("%q: unusable password should never match (%v)", encoded, err)
+		}
+	}
+
+	if _, err := verifyPassword("lètmein", "crypt$$ab1Hv2Lg7ltQo"); err != ErrUnsupportedPasswordHasher {
+		t.Errorf("crypt should be unsupported, got %v", err)
+	}
+	if _, err := verifyPassword("lètmein", "whirlpool$salt$hash"); err != ErrUnknownPasswordHasher {
+		t.Errorf("unknown algorithm should be rejected, got %v", err)
+	}
+}
+
+func TestPreferredPasswordHasher_HashAndMustUpdate(t *testing.T) {
+	// cheap settings, only the round trip matters here
+	cases := []struct {
+		algorithm  string
+		workFactor int
+	}{
+		{"pbkdf2_sha256", 1000},
+		{"pbkdf2_sha1", 1000},
+		{"argon2", 1},
+		{"bcrypt_sha256", bcrypt.MinCost},
+		{"bcrypt", bcrypt.MinCost},
+		{"scrypt", 1024},
+	}
+
+	for _, c := range cases {
+		hasher, err := newPreferredPasswordHasher(c.algorithm, c.workFactor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if argon2Hasher, ok := hasher.(*Argon2Hasher); ok {
+			argon2Hasher.Memory = 64
+		}
+
+		encoded, err := hasher.Hash("lètmein")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if valid, err := verifyPassword("lètmein", encoded); err != nil || !valid {
+			t.Errorf("%s: %s does not verify (%v)", c.algorithm, encoded, err)
+		}
+		if hasher.MustUpdate(encoded) {
+			t.Errorf("%s: freshly hashed %s must not be updated", c.algorithm, encoded)
+		}
+
+		// raising the work factor rehashes everything made before
+		stronger, err := newPreferredPasswordHasher(c.algorithm, c.workFactor*2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stronger.MustUpdate(encoded) {
+			t.Errorf("%s: %s must be updated after raising the work factor", c.algorithm, encoded)
+		}
+	}
+}
+
+func TestPasswordMustUpdate(t *testing.T) {
+	defer func(hasher PreferredPasswordHasher) { preferredPasswordHasher = hasher }(preferredPasswordHasher)
+
+	preferredPasswordHasher, _ = newPreferredPasswordHasher("pbkdf2_sha256", 720000)
+	current, err := preferredPasswordHasher.Hash("lètmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{
+		current: false,
+		// salts shorter than django's current 22 characters are replaced
+		djangoPasswordVectors["pbkdf2_sha256"]:                  true,
+		djangoPasswordVectors["pbkdf2_sha256 (old iterations)"]: true,
+		djangoPasswordVectors["pbkdf2_sha1"]:                    true,
+		djangoPasswordVectors["scrypt"]:                         true,
+		djangoPasswordVectors["md5"]:                            true,
+		djangoPasswordVectors["unsalted_md5"]:                   true,
+	}
+
+	for encoded, want := range expected {
+		if got := passwordMustUpdate(encoded); got != want {
+			t.Errorf("%s: got %v wanted %v", encoded, got, want)
+		}
+	}
+}
+
+func TestNewPreferredPasswordHasher_Invalid(t *testing.T) {
+	for _, c := range []struct {
+		algorithm  string
+		workFactor int
+	}{
+		{"md5", 0},
+		{"crypt", 0},
+		{"scrypt", 1000},
+		{"bcrypt", 40},
+		{"pbkdf2_sha256", -1},
+	} {
+		if _, err := newPreferredPasswordHasher(c.algorithm, c.workFactor); err == nil {
+			t.Errorf("%s with work factor %d should be rejected", c.algorithm, c.workFactor)
+		}
+	}
+}
+
+func TestGenerateSalt(t *testing.T) {
+	salt, err := generateSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(salt) != saltLength || strings.Trim(salt, saltChars) != "" {
+		t.Errorf("unexpected salt %q", salt)
+	}
+}
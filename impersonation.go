@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// impersonationLifetime -- how long staff can act as a user before asking again,
+// set by [security] impersonation_lifetime
+var impersonationLifetime = 15 * time.Minute
+
+// newImpersonationToken -- an access token for staff to act as user. There is
+// no refresh token, once it expires staff have to impersonate the user again.
+func newImpersonationToken(staff User, user User) JWTToken {
+	token := JWTToken{}
+	token.ExpiresAt = time.Now().Add(impersonationLifetime).Unix()
+	token.UserID = staff.ID
+	token.ActAs = user.ID
+	token.New("access")
+	return token
+}
+
+// userFromJWT -- the user an access token authenticates, the impersonated user
+// for impersonation tokens. Nobody when the staff member behind one can no
+// longer impersonate the user.
+func userFromJWT(t JWTToken) User {
+	if t.ActAs == 0 {
+		user := User{ID: t.UserID}
+		user.LookupFromID()
+		return user
+	}
+
+	user := User{ID: t.ActAs, ImpersonatorID: t.UserID}
+	user.LookupFromID()
+	if !impersonatorIsAllowed(t.UserID, user) {
+		return User{}
+	}
+	return user
+}
+
+// impersonatorIsAllowed -- whether staffID can still impersonate user, checked
+// on every request as staff can be disabled or lose user.impersonate before
+// their token expires
+func impersonatorIsAllowed(staffID int, user User) bool {
+	staff := User{ID: staffID}
+	staff.LookupFromID()
+	if !staff.Active || !authorize(staff, PermissionUserImpersonate, 0) {
+		return false
+	}
+	return !user.Admin || staff.Admin
+}
+
+// allowImpersonatedRequest -- audits a request made with an impersonation
+// token, or writes a 401 and returns false when it can no longer be used
+func allowImpersonatedRequest(w http.ResponseWriter, t JWTToken, r *http.Request) bool {
+	if (User{}) == userFromJWT(t) {
+		unauthorizedRequestCounter.Inc()
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	auditImpersonatedRequest(t, r)
+	return true
+}
+
+// auditImpersonatedRequest -- every request made with an impersonation token
+// goes in the audit log under both users
+func auditImpersonatedRequest(t JWTToken, r *http.Request) {
+	user := User{ID: t.ActAs, ImpersonatorID: t.UserID}
+	detail := map[string]string{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"query":  r.URL.RawQuery,
+	}
+	if err := audit(&dbConn, user, "impersonation.request", "user", t.ActAs, detail); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// forbidImpersonation -- writes a 403 and returns true when staff are
+// impersonating, for changes to a user's credentials and sessions that staff
+// shouldn't make on their behalf. Managing users, roles, quotas, invites and
+// record transfers is refused too, the user's permissions would otherwise let
+// staff grant themselves more than they have.
+func forbidImpersonation(w http.ResponseWriter, user User) bool {
+	if user.ImpersonatorID == 0 {
+		return false
+	}
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte("403 - Not allowed while impersonating"))
+	return true
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNewImpersonationToken(t *testing.T) {
+	keyring, err := newJWTKeyring("HS256", "", "", nil, "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := jwtKeyring
+	jwtKeyring = keyring
+	defer func() { jwtKeyring = previous }()
+
+	token := newImpersonationToken(User{ID: 1, Staff: true}, User{ID: 42})
+
+	parsed := JWTToken{}
+	parsed.LookupFromString(token.String())
+	if parsed.UserID != 1 || parsed.ActAs != 42 {
+		t.Errorf("got user_id %d act_as %d wanted 1 and 42", parsed.UserID, parsed.ActAs)
+	}
+	if parsed.TokenType != "access" {
+		t.Errorf("got token type %q wanted access", parsed.TokenType)
+	}
+	if lifetime := time.Until(time.Unix(parsed.ExpiresAt, 0)); lifetime > impersonationLifetime {
+		t.Errorf("token lasts %s, longer than %s", lifetime, impersonationLifetime)
+	}
+}
+
+func TestForbidImpersonation(t *testing.T) {
+	rr := httptest.NewRecorder()
+	if forbidImpersonation(rr, User{ID: 42}) {
+		t.Error("forbade a user who isn't being impersonated")
+	}
+
+	rr = httptest.NewRecorder()
+	if !forbidImpersonation(rr, User{ID: 42, ImpersonatorID: 1}) {
+		t.Error("allowed staff impersonating a user")
+	}
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func expectUser(mock sqlmock.Sqlmock, id int, admin int, staff int, active bool) {
+	mock.ExpectPrepare("FROM auth_user WHERE id = ?").ExpectQuery().WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "is_superuser", "is_staff", "is_active"}).AddRow(fmt.Sprintf("user%d", id), admin, staff, active))
+}
+
+func TestUserFromJWT_Impersonation(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+
+	roles["support"] = []Permission{PermissionUserImpersonate}
+	defer delete(roles, "support")
+
+	token := JWTToken{UserID: 1, ActAs: 42}
+
+	expectUser(mock, 42, 0, 0, true)
+	expectUser(mock, 1, 0, 1, true)
+	expectRoles(mock, 1, UserRole{ID: 1, Role: "support"})
+	if user := userFromJWT(token); user.ID != 42 || user.ImpersonatorID != 1 {
+		t.Errorf("got user %d impersonated by %d wanted 42 by 1", user.ID, user.ImpersonatorID)
+	}
+
+	expectUser(mock, 42, 0, 0, true)
+	expectUser(mock, 1, 0, 1, false)
+	if user := userFromJWT(token); (User{}) != user {
+		t.Error("a disabled staff member kept impersonating")
+	}
+
+	expectUser(mock, 42, 0, 0, true)
+	expectUser(mock, 1, 0, 1, true)
+	expectRoles(mock, 1)
+	if user := userFromJWT(token); (User{}) != user {
+		t.Error("a staff member without user.impersonate kept impersonating")
+	}
+
+	expectUser(mock, 42, 1, 0, true)
+	expectUser(mock, 1, 0, 1, true)
+	expectRoles(mock, 1, UserRole{ID: 1, Role: "support"})
+	if user := userFromJWT(token); (User{}) != user {
+		t.Error("staff impersonated a superuser")
+	}
+}
+
+func TestJWTToken_IsRevokedForImpersonatedUser(t *testing.T) {
+	_, reset := mockRedis(t)
+	defer reset()
+
+	jwtRevokeUser(42)
+	token := JWTToken{UserID: 1, ActAs: 42, JTI: "impersonation", IssuedAtMs: revokedBefore(t, 42) - 1}
+	if !isRevoked(t, token) {
+		t.Error("revoking the impersonated user should revoke the impersonation token")
+	}
+}
+
+func TestLongestTokenLifetime_Impersonation(t *testing.T) {
+	previous := impersonationLifetime
+	impersonationLifetime = time.Hour
+	defer func() { impersonationLifetime = previous }()
+
+	if longestTokenLifetime() != time.Hour {
+		t.Errorf("got %s wanted revocations kept as long as impersonation tokens last", longestTokenLifetime())
+	}
+}
+
+func TestRequestMiddleware_ImpersonationQuota(t *testing.T) {
+	mock, done := mockDB(t)
+	defer done()
+	server, reset := mockRedis(t)
+	defer reset()
+	defer useTestKeyring(t)()
+
+	previous := defaultQuotas
+	defaultQuotas.APICallsPerDay = 1
+	defer func() { defaultQuotas = previous }()
+
+	day := quotaDay(time.Now())
+	quotaCountAPICall(42, day)
+
+	// the impersonated user has used up their calls, the staff member hasn't
+	mock.ExpectPrepare("FROM api_user_quota").ExpectQuery().WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"records_per_user", "api_calls_per_day"}))
+
+	token := newImpersonationToken(User{ID: 1, Staff: true}, User{ID: 42})
+	req := httptest.NewRequest("GET", "/record/list", nil)
+	req.Header.Set("Authorization", "Bearer "+token.String())
+	w := httptest.NewRecorder()
+	requestMiddleware(func(w http.ResponseWriter, r *http.Request) {})(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d wanted %d", w.Code, http.StatusTooManyRequests)
+	}
+	if server.Exists(fmt.Sprintf("quota:api:%d:%s", 1, day)) {
+		t.Error("the call was counted against the staff member")
+	}
+}
+
+func TestImpersonationCantManageRoles(t *testing.T) {
+	mock, done := mockDB(t)
+	defer done()
+
+	roles["support"] = []Permission{PermissionUserImpersonate}
+	defer delete(roles, "support")
+
+	// the user staff impersonate can manage roles, the staff member can't
+	expectUser(mock, 42, 0, 0, true)
+	expectUser(mock, 1, 0, 1, true)
+	expectRoles(mock, 1, UserRole{ID: 1, Role: "support"})
+	expectRoles(mock, 42, UserRole{ID: 2, Role: "admin"})
+
+	req := httptest.NewRequest("POST", "/role/assign", strings.NewReader(`{"UserID": 1, "Role": "admin"}`))
+	req = withVerifiedToken(req, JWTToken{UserID: 1, ActAs: 42})
+	w := httptest.NewRecorder()
+	assignRoleView(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d wanted %d", w.Code, http.StatusForbidden)
+	}
+}
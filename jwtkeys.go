@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sort"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA -- Ed25519 signatures (RFC 8037), which jwt-go doesn't ship
+type SigningMethodEdDSA struct{}
+
+var signingMethodEdDSA = &SigningMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+func (m *SigningMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func (m *SigningMethodEdDSA) Verify(signingString string, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// JWTKey -- a key tokens are signed and/or verified with
+type JWTKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	SignKey   interface{} // nil for keys only used to verify
+	VerifyKey interface{}
+}
+
+// JWTKeyring -- the key new tokens are signed with plus every key tokens are
+// accepted from, indexed by the kid header. Keep retired keys configured for
+// verification until the tokens they signed have expired.
+type JWTKeyring struct {
+	Signing *JWTKey
+
+	keys map[string]*JWTKey
+	// secret tokens without a kid header are verified with, nil when HS256
+	// tokens are no longer accepted
+	legacySecret []byte
+}
+
+var jwtKeyring *JWTKeyring
+
+// newJWTKeyring -- builds the keyring from the [jwt] config. HS256 signs with
+// the shared secret, RS256/EdDSA sign with the PEM encoded private key at
+// signingKeyPath. verificationKeys maps key ids to PEM encoded public keys.
+func newJWTKeyring(algorithm string, signingKeyID string, signingKeyPath string, verificationKeys map[string]string, secret string, acceptHS256 bool) (*JWTKeyring, error) {
+	k := &JWTKeyring{
+		keys: make(map[string]*JWTKey),
+	}
+
+	switch algorithm {
+	case "", "HS256":
+		k.Signing = &JWTKey{
+			ID:        signingKeyID,
+			Method:    jwt.SigningMethodHS256,
+			SignKey:   []byte(secret),
+			VerifyKey: []byte(secret),
+		}
+		acceptHS256 = true
+	case "RS256", "EdDSA":
+		if signingKeyID == "" {
+			return nil, errors.New("jwt key_id is required for asymmetric signing")
+		}
+
+		pemBytes, err := ioutil.ReadFile(signingKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		k.Signing, err = parseJWTPrivateKey(signingKeyID, pemBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if k.Signing.Method.Alg() != algorithm {
+			return nil, fmt.Errorf("jwt signing key is not a %s key", algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("unknown jwt signing algorithm: %s", algorithm)
+	}
+
+	if acceptHS256 {
+		k.legacySecret = []byte(secret)
+	}
+
+	if k.Signing.ID != "" {
+		k.keys[k.Signing.ID] = k.Signing
+	}
+
+	for kid, path := range verificationKeys {
+		if kid == k.Signing.ID {
+			continue
+		}
+
+		pemBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := parseJWTPublicKey(kid, pemBytes)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[kid] = key
+	}
+
+	return k, nil
+}
+
+func parseJWTPrivateKey(kid string, pemBytes []byte) (*JWTKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("jwt signing key is not PEM encoded")
+	}
+
+	var privateKey interface{}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+
+	switch privateKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return &JWTKey{ID: kid, Method: jwt.SigningMethodRS256, SignKey: privateKey, VerifyKey: &privateKey.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &JWTKey{ID: kid, Method: signingMethodEdDSA, SignKey: privateKey, VerifyKey: privateKey.Public()}, nil
+	}
+
+	return nil, errors.New("jwt signing key must be an RSA or Ed25519 key")
+}
+
+func parseJWTPublicKey(kid string, pemBytes []byte) (*JWTKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("jwt verification key %s is not PEM encoded", kid)
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		return &JWTKey{ID: kid, Method: jwt.SigningMethodRS256, VerifyKey: publicKey}, nil
+	case ed25519.PublicKey:
+		return &JWTKey{ID: kid, Method: signingMethodEdDSA, VerifyKey: publicKey}, nil
+	}
+
+	return nil, fmt.Errorf("jwt verification key %s must be an RSA or Ed25519 key", kid)
+}
+
+// NewToken -- returns an unsigned token for claims using the signing key
+func (k *JWTKeyring) NewToken(claims jwt.Claims) *jwt.Token {
+	token := jwt.NewWithClaims(k.Signing.Method, claims)
+	if k.Signing.ID != "" {
+		token.Header["kid"] = k.Signing.ID
+	}
+	return token
+}
+
+// Keyfunc -- picks the key a token is verified with from its kid header. The
+// algorithm must match the key, never trust the token to pick it.
+func (k *JWTKeyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if k.legacySecret == nil {
+			return nil, errors.New("token has no kid header")
+		}
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return k.legacySecret, nil
+	}
+
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %s", kid)
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for kid %s", token.Method.Alg(), kid)
+	}
+
+	return key.VerifyKey, nil
+}
+
+// jsonWebKey -- public key in RFC 7517 format
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS -- every asymmetric verification key as a JSON Web Key Set. Shared
+// secrets are never published.
+func (k *JWTKeyring) JWKS() ([]byte, error) {
+	var kids []string
+	for kid := range k.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{
+		Keys: []jsonWebKey{},
+	}
+
+	for _, kid := range kids {
+		key := k.keys[kid]
+		switch publicKey := key.VerifyKey.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, jsonWebKey{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			jwks.Keys = append(jwks.Keys, jsonWebKey{
+				Kty: "OKP",
+				Kid: kid,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(publicKey),
+			})
+		}
+	}
+
+	return json.Marshal(jwks)
+}
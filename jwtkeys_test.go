@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func writePEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWTKeyring_Rotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPublic, _ := x509.MarshalPKIXPublicKey(&oldKey.PublicKey)
+	oldPrivate, _ := x509.MarshalPKCS8PrivateKey(oldKey)
+
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPrivate, _ := x509.MarshalPKCS8PrivateKey(newKey)
+
+	// the old keyring signed with RSA, the new one signs with Ed25519 and
+	// still accepts what the old one signed
+	oldKeyring, err := newJWTKeyring("RS256", "old", writePEM(t, dir, "old.pem", "PRIVATE KEY", oldPrivate), nil, "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := newJWTKeyring("EdDSA", "new", writePEM(t, dir, "new.pem", "PRIVATE KEY", newPrivate),
+		map[string]string{"old": writePEM(t, dir, "old.pub", "PUBLIC KEY", oldPublic)}, "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, signer := range []*JWTKeyring{oldKeyring, keyring} {
+		signed, err := signer.NewToken(jwt.StandardClaims{Subject: "1"}).SignedString(signer.Signing.SignKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := jwt.Parse(signed, keyring.Keyfunc); err != nil {
+			t.Errorf("token signed by %s rejected: %s", signer.Signing.ID, err)
+		}
+	}
+
+	// HS256 tokens are no longer accepted, not even with the kid of a public key
+	hs256, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: "1"}).SignedString([]byte("secret"))
+	if _, err := jwt.Parse(hs256, keyring.Keyfunc); err == nil {
+		t.Error("HS256 token accepted by an EdDSA keyring")
+	}
+
+	confused := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: "1"})
+	confused.Header["kid"] = "old"
+	confusedSigned, _ := confused.SignedString(oldPublic)
+	if _, err := jwt.Parse(confusedSigned, keyring.Keyfunc); err == nil {
+		t.Error("HS256 token signed with a public key accepted")
+	}
+
+	jwks, err := keyring.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(jwks, &set); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(set.Keys) != 2 || set.Keys[0].Kid != "new" || set.Keys[0].Kty != "OKP" || set.Keys[1].Kid != "old" || set.Keys[1].Kty != "RSA" {
+		t.Errorf("unexpected jwks: %s", jwks)
+	}
+}
+
+func TestJWTKeyring_HS256(t *testing.T) {
+	keyring, err := newJWTKeyring("HS256", "", "", nil, "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: "1"}).SignedString([]byte("secret"))
+	if _, err := jwt.Parse(signed, keyring.Keyfunc); err != nil {
+		t.Error(err)
+	}
+
+	jwks, _ := keyring.JWKS()
+	if string(jwks) != `{"keys":[]}` {
+		t.Errorf("shared secret published in jwks: %s", jwks)
+	}
+}
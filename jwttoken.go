@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -10,29 +11,69 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	accessTokenLifetime  = 5 * time.Minute
+	refreshTokenLifetime = 10 * time.Minute
+)
+
+// longestTokenLifetime -- how long any token stays valid, so how long a user's
+// revocation has to be kept around
+func longestTokenLifetime() time.Duration {
+	lifetime := refreshTokenLifetime
+	for _, other := range []time.Duration{accessTokenLifetime, impersonationLifetime} {
+		if other > lifetime {
+			lifetime = other
+		}
+	}
+	return lifetime
+}
+
 type JWTToken struct {
 	Token     *jwt.Token
 	Claims    *jwt.Claims
-	Salt      string
 	Issuer    string
 	ExpiresAt int64
 	UserID    int
+	TokenType string
+	JTI       string
+	Family    string
+	IssuedAt  int64
+	// IssuedAt in milliseconds, so revocations don't have to spare the second
+	// they happened in
+	IssuedAtMs int64
+	// the user staff are impersonating, UserID is the staff member
+	ActAs int
 }
 
+// JWTTokens -- an access/refresh token pair. Every refresh token issued by
+// rotating another one shares its Family, which is what gets revoked when an
+// already used refresh token is presented again.
 type JWTTokens struct {
 	AccessToken  JWTToken
 	RefreshToken JWTToken
+	Family       string
 }
 
+// Errors returned by JWTTokens.Refresh, which also returns the redis error
+// when the token's revocation couldn't be checked
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenRevoked = errors.New("refresh token has been revoked")
+	ErrRefreshTokenReused  = errors.New("refresh token has already been used")
+)
+
 type JWTTokenMessage struct {
 	Access  string `json:"access"`
 	Refresh string `json:"refresh"`
 }
 
 type JWTClaim struct {
-	TokenType string `json:"token_type"`
-	UserID    int    `json:"user_id"`
-	JTI       string `json:"jti"`
+	TokenType  string `json:"token_type"`
+	UserID     int    `json:"user_id"`
+	JTI        string `json:"jti"`
+	Family     string `json:"fam,omitempty"`
+	ActAs      int    `json:"act_as,omitempty"`
+	IssuedAtMs int64  `json:"iat_ms,omitempty"`
 
 	jwt.StandardClaims
 }
@@ -48,25 +89,33 @@ func (t *JWTToken) New(tokenType string) {
 		log.Fatal(err)
 	}
 
+	now := time.Now()
+	t.TokenType = tokenType
+	t.JTI = jti.String()
+	t.IssuedAt = now.Unix()
+	t.IssuedAtMs = unixMilli(now)
+
 	claims := JWTClaim{
 		tokenType,
 		t.UserID,
-		jti.String(),
+		t.JTI,
+		t.Family,
+		t.ActAs,
+		t.IssuedAtMs,
 		jwt.StandardClaims{
 			ExpiresAt: t.ExpiresAt,
+			IssuedAt:  t.IssuedAt,
 			Issuer:    t.Issuer,
 		},
 	}
 
-	t.Token = jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	t.Token = jwtKeyring.NewToken(claims)
 }
 
 func (t *JWTToken) LookupFromString(tokenStr string) {
-	token, err := jwt.ParseWithClaims(tokenStr, &JWTClaim{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(encryptionSalt), nil
-	})
+	token, err := jwt.ParseWithClaims(tokenStr, &JWTClaim{}, jwtKeyring.Keyfunc)
 
-	if !token.Valid {
+	if token == nil || !token.Valid {
 		if ve, ok := err.(*jwt.ValidationError); ok {
 			if ve.Errors&jwt.ValidationErrorMalformed != 0 {
 				fmt.Println("thats not even a token")
@@ -77,29 +126,89 @@ func (t *JWTToken) LookupFromString(tokenStr string) {
 			log.Fatal(err)
 		}
 	}
+	if token == nil {
+		return
+	}
 	if claims, ok := token.Claims.(*JWTClaim); ok && token.Valid {
 		t.Token = token
 		t.UserID = claims.UserID
 		t.ExpiresAt = claims.ExpiresAt
 		t.Issuer = claims.Issuer
+		t.TokenType = claims.TokenType
+		t.JTI = claims.JTI
+		t.Family = claims.Family
+		t.IssuedAt = claims.IssuedAt
+		t.IssuedAtMs = claims.IssuedAtMs
+		if t.IssuedAtMs == 0 {
+			// issued before iat_ms, as early in its second as it could have been
+			t.IssuedAtMs = claims.IssuedAt * 1000
+		}
+		t.ActAs = claims.ActAs
 	}
 }
 
-func (t *JWTToken) IsValid() bool {
+// unixMilli -- t as milliseconds since the unix epoch
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// IsValid -- whether the token hasn't expired or been revoked, the error is set
+// when revocations couldn't be checked and the token must be refused
+func (t *JWTToken) IsValid() (bool, error) {
 	if time.Now().Unix() < t.ExpiresAt {
-		return true
+		revoked, err := t.IsRevoked()
+		return !revoked && err == nil, err
+	}
+
+	return false, nil
+}
+
+// IsRevoked -- whether the token was logged out, belongs to a revoked family or
+// was issued before its user (or the user it impersonates) logged out everywhere
+func (t *JWTToken) IsRevoked() (bool, error) {
+	if revoked, err := jwtTokenIsRevoked(t.JTI); revoked || err != nil {
+		return revoked, err
+	}
+
+	if t.Family != "" {
+		if revoked, err := jwtFamilyIsRevoked(t.Family); revoked || err != nil {
+			return revoked, err
+		}
+	}
+
+	// impersonation tokens also stop when the impersonated user is revoked
+	for _, userID := range []int{t.UserID, t.ActAs} {
+		if userID == 0 {
+			continue
+		}
+		revokedBefore, err := jwtUserRevokedBefore(userID)
+		if err != nil {
+			return false, err
+		}
+		if t.IssuedAtMs <= revokedBefore {
+			return true, nil
+		}
 	}
 
-	return false
+	return false, nil
+}
+
+// ActingUserID -- the user requests made with the token act as, which is the
+// impersonated user while staff impersonate
+func (t *JWTToken) ActingUserID() int {
+	if t.ActAs != 0 {
+		return t.ActAs
+	}
+	return t.UserID
 }
 
-func (t *JWTToken) SetSalt(salt string) {
-	t.Salt = salt
+// Revoke -- denylists the token until it expires
+func (t *JWTToken) Revoke() {
+	jwtRevokeToken(t.JTI, time.Unix(t.ExpiresAt, 0))
 }
 
 func (t *JWTToken) String() string {
-	sk := []byte(t.Salt)
-	token, err := t.Token.SignedString(sk)
+	token, err := t.Token.SignedString(jwtKeyring.Signing.SignKey)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -108,27 +217,74 @@ func (t *JWTToken) String() string {
 
 func (j *JWTTokens) NewAccess(userId int) {
 	token := JWTToken{}
-	token.Salt = encryptionSalt
-	token.ExpiresAt = time.Now().Unix() + int64(60*5)
+	token.ExpiresAt = time.Now().Add(accessTokenLifetime).Unix()
 	token.UserID = userId
+	token.Family = j.Family
 	token.New("access")
 	j.AccessToken = token
 }
 
 func (j *JWTTokens) NewRefresh(userId int) {
 	token := JWTToken{}
-	token.Salt = encryptionSalt
-	token.ExpiresAt = time.Now().Unix() + int64(60*10)
+	token.ExpiresAt = time.Now().Add(refreshTokenLifetime).Unix()
 	token.UserID = userId
+	token.Family = j.Family
 	token.New("refresh")
 	j.RefreshToken = token
 }
 
 func (j *JWTTokens) New(userId int) {
+	if j.Family == "" {
+		family, err := uuid.NewRandom()
+		if err != nil {
+			log.Fatal(err)
+		}
+		j.Family = family.String()
+	}
+
 	j.NewAccess(userId)
 	j.NewRefresh(userId)
 }
 
+// Refresh -- exchanges a refresh token for a new access/refresh token pair in
+// the same family. Each refresh token can only be used once, presenting one a
+// second time revokes the whole family as the token has most likely been stolen.
+func (j *JWTTokens) Refresh(refreshToken string) error {
+	token := JWTToken{}
+	token.LookupFromString(refreshToken)
+	if token.Token == nil || token.TokenType != "refresh" {
+		return ErrRefreshTokenInvalid
+	}
+	if valid, err := token.IsValid(); err != nil {
+		return err
+	} else if !valid {
+		return ErrRefreshTokenInvalid
+	}
+
+	// tokens issued before families existed start their own
+	family := token.Family
+	if family == "" {
+		family = token.JTI
+	}
+
+	if revoked, err := jwtFamilyIsRevoked(family); err != nil {
+		return err
+	} else if revoked {
+		return ErrRefreshTokenRevoked
+	}
+
+	if firstUse, err := jwtMarkRefreshTokenUsed(token.JTI, time.Unix(token.ExpiresAt, 0)); err != nil {
+		return err
+	} else if !firstUse {
+		jwtRevokeFamily(family)
+		return ErrRefreshTokenReused
+	}
+
+	j.Family = family
+	j.New(token.UserID)
+	return nil
+}
+
 func (j *JWTTokens) String() string {
 	tokenMSG := JWTTokenMessage{}
 	tokenMSG.Access = j.AccessToken.String()
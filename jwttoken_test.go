@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// isRevoked -- token.IsRevoked, failing the test when redis couldn't be asked
+func isRevoked(t *testing.T, token JWTToken) bool {
+	t.Helper()
+	revoked, err := token.IsRevoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return revoked
+}
+
+func revokedBefore(t *testing.T, userID int) int64 {
+	t.Helper()
+	revokedBefore, err := jwtUserRevokedBefore(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return revokedBefore
+}
+
+func TestJWTToken_IsRevokedForUser(t *testing.T) {
+	server, reset := mockRedis(t)
+	defer reset()
+
+	now := unixMilli(time.Now())
+	jwtRevokeUser(1)
+	revoked := revokedBefore(t, 1)
+
+	before := JWTToken{UserID: 1, JTI: "before", IssuedAtMs: revoked - 1}
+	if !isRevoked(t, before) {
+		t.Error("a token issued before the user was revoked should be revoked")
+	}
+
+	// a token refreshed as the user logs out everywhere mustn't survive it
+	sameTime := JWTToken{UserID: 1, JTI: "same-time", IssuedAtMs: revoked}
+	if !isRevoked(t, sameTime) {
+		t.Error("a token issued as the user was revoked should be revoked")
+	}
+
+	after := JWTToken{UserID: 1, JTI: "after", IssuedAtMs: revoked + 1}
+	if isRevoked(t, after) {
+		t.Error("a token issued after the user was revoked shouldn't be revoked")
+	}
+
+	otherUser := JWTToken{UserID: 2, JTI: "other", IssuedAtMs: now - 60000}
+	if isRevoked(t, otherUser) {
+		t.Error("revoking a user shouldn't revoke someone else's tokens")
+	}
+
+	// kept for as long as the longest lived token
+	if ttl := server.TTL(fmt.Sprintf("jwt:user:%d:revoked_before_ms", 1)); ttl < longestTokenLifetime() {
+		t.Errorf("revocation kept for %s, shorter than %s", ttl, longestTokenLifetime())
+	}
+}
+
+func TestJWTToken_IssuedAtMs(t *testing.T) {
+	_, reset := mockRedis(t)
+	defer reset()
+	defer useTestKeyring(t)()
+
+	tokens := JWTTokens{}
+	tokens.New(1)
+
+	parsed := JWTToken{}
+	parsed.LookupFromString(tokens.AccessToken.String())
+	if parsed.IssuedAtMs != tokens.AccessToken.IssuedAtMs || parsed.IssuedAtMs/1000 != parsed.IssuedAt {
+		t.Errorf("got iat_ms %d wanted %d within iat %d", parsed.IssuedAtMs, tokens.AccessToken.IssuedAtMs, parsed.IssuedAt)
+	}
+}
+
+func TestJWTToken_IsRevokedRedisDown(t *testing.T) {
+	server, reset := mockRedis(t)
+	defer reset()
+
+	server.Close()
+	token := JWTToken{UserID: 1, JTI: "jti", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+	if valid, err := token.IsValid(); valid || err == nil {
+		t.Errorf("got %v and %v, wanted the token refused with an error", valid, err)
+	}
+}
+
+func TestRequestMiddleware_RedisDown(t *testing.T) {
+	server, reset := mockRedis(t)
+	defer reset()
+	defer useTestKeyring(t)()
+
+	tokens := JWTTokens{}
+	tokens.New(1)
+	server.Close()
+
+	reached := false
+	handler := requestMiddleware(func(w http.ResponseWriter, r *http.Request) { reached = true })
+
+	req := httptest.NewRequest("GET", "/record/list", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken.String())
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != http.StatusServiceUnavailable || reached {
+		t.Errorf("got status %d (view reached %v) wanted %d", w.Code, reached, http.StatusServiceUnavailable)
+	}
+}
+
+func TestJWTToken_Revoke(t *testing.T) {
+	_, reset := mockRedis(t)
+	defer reset()
+	defer useTestKeyring(t)()
+
+	tokens := JWTTokens{}
+	tokens.New(1)
+
+	tokens.AccessToken.Revoke()
+	if !isRevoked(t, tokens.AccessToken) {
+		t.Error("the revoked token should be revoked")
+	}
+	if isRevoked(t, tokens.RefreshToken) {
+		t.Error("revoking a token shouldn't revoke the rest of its family")
+	}
+
+	jwtRevokeFamily(tokens.Family)
+	if !isRevoked(t, tokens.RefreshToken) {
+		t.Error("revoking the family should revoke its tokens")
+	}
+}
+
+func TestJWTMarkRefreshTokenUsed(t *testing.T) {
+	_, reset := mockRedis(t)
+	defer reset()
+
+	expiresAt := time.Now().Add(refreshTokenLifetime)
+	if firstUse, _ := jwtMarkRefreshTokenUsed("jti", expiresAt); !firstUse {
+		t.Error("the first use should be allowed")
+	}
+	if firstUse, _ := jwtMarkRefreshTokenUsed("jti", expiresAt); firstUse {
+		t.Error("the second use should be refused")
+	}
+	if firstUse, _ := jwtMarkRefreshTokenUsed("other", expiresAt); !firstUse {
+		t.Error("another token's first use should be allowed")
+	}
+}
+
+func TestJWTTokens_Refresh(t *testing.T) {
+	_, reset := mockRedis(t)
+	defer reset()
+	defer useTestKeyring(t)()
+
+	login := JWTTokens{}
+	login.New(1)
+
+	rotated := JWTTokens{}
+	if err := rotated.Refresh(login.RefreshToken.String()); err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Family != login.Family {
+		t.Errorf("got family %q wanted %q", rotated.Family, login.Family)
+	}
+	if rotated.RefreshToken.JTI == login.RefreshToken.JTI || rotated.RefreshToken.UserID != 1 {
+		t.Error("refreshing should issue a new refresh token for the same user")
+	}
+
+	// an access token can't be exchanged
+	if err := (&JWTTokens{}).Refresh(rotated.AccessToken.String()); err != ErrRefreshTokenInvalid {
+		t.Errorf("got %v wanted %v", err, ErrRefreshTokenInvalid)
+	}
+
+	// the login's refresh token was stolen and used again
+	if err := (&JWTTokens{}).Refresh(login.RefreshToken.String()); err != ErrRefreshTokenReused {
+		t.Errorf("got %v wanted %v", err, ErrRefreshTokenReused)
+	}
+
+	// which revokes everything issued in the family since
+	if !isRevoked(t, rotated.AccessToken) || !isRevoked(t, rotated.RefreshToken) {
+		t.Error("reusing a refresh token should revoke its family")
+	}
+	if err := (&JWTTokens{}).Refresh(rotated.RefreshToken.String()); err == nil {
+		t.Error("refreshed a token of a revoked family")
+	}
+
+	// other logins are left alone
+	other := JWTTokens{}
+	other.New(1)
+	if err := (&JWTTokens{}).Refresh(other.RefreshToken.String()); err != nil {
+		t.Errorf("another family couldn't be refreshed: %v", err)
+	}
+}
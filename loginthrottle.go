@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LoginThrottlePolicy -- how failed logins are punished. Once failures within
+// Window reach DelayAfter every further failure blocks the key for a doubling
+// delay starting at BaseDelay and capped at MaxDelay, and once they reach
+// LockoutAfter the key is locked out for LockoutDuration.
+type LoginThrottlePolicy struct {
+	Window          time.Duration
+	DelayAfter      int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+}
+
+// BlockFor -- how long to block a key after its nth failure
+func (p LoginThrottlePolicy) BlockFor(failures int) time.Duration {
+	if p.LockoutAfter > 0 && failures >= p.LockoutAfter {
+		return p.LockoutDuration
+	}
+	if p.DelayAfter <= 0 || failures < p.DelayAfter {
+		return 0
+	}
+
+	delay := p.BaseDelay * time.Duration(math.Pow(2, float64(failures-p.DelayAfter)))
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+var (
+	// usernames are guessed far less often than an IP fails, so they lock sooner
+	loginThrottleIP = LoginThrottlePolicy{
+		Window:          15 * time.Minute,
+		DelayAfter:      10,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: time.Hour,
+	}
+	loginThrottleUsername = LoginThrottlePolicy{
+		Window:          15 * time.Minute,
+		DelayAfter:      3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+	}
+	// use the last X-Forwarded-For entry (added by our proxy) as the client address
+	trustForwardedFor bool
+
+	loginBlockedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uberdns_api_login_blocked_total",
+			Help: "Login and password reset attempts refused because the IP, username or email was throttled",
+		},
+		[]string{
+			"scope",
+		},
+	)
+)
+
+// clientIP -- the address a request came from
+func clientIP(r *http.Request) string {
+	if trustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// LoginAttempt -- throttling state for one login request, keyed by the
+// client IP and the username being logged in to
+type LoginAttempt struct {
+	IP       string
+	Username string
+
+	// throttling scope of Username, "username" unless the attempt is keyed by
+	// something else, so those can't lock the account's logins
+	scope string
+}
+
+func newLoginAttempt(r *http.Request, username string) LoginAttempt {
+	return LoginAttempt{
+		IP:       clientIP(r),
+		Username: strings.ToLower(username),
+	}
+}
+
+// newPasswordResetAttempt -- throttles password reset requests like logins, by
+// the client IP and the email address the reset link would be sent to
+func newPasswordResetAttempt(r *http.Request, email string) LoginAttempt {
+	return LoginAttempt{
+		IP:       clientIP(r),
+		Username: strings.ToLower(email),
+		scope:    "email",
+	}
+}
+
+func (a LoginAttempt) usernameScope() string {
+	if a.scope == "" {
+		return "username"
+	}
+	return a.scope
+}
+
+// Blocked -- how long until the attempt may be made, 0 when it may be made now
+func (a LoginAttempt) Blocked() time.Duration {
+	retryAfter := loginThrottleBlocked("ip", a.IP)
+	if retryAfter > 0 {
+		loginBlockedCounter.WithLabelValues("ip").Inc()
+		return retryAfter
+	}
+
+	if a.Username != "" {
+		retryAfter = loginThrottleBlocked(a.usernameScope(), a.Username)
+		if retryAfter > 0 {
+			loginBlockedCounter.WithLabelValues(a.usernameScope()).Inc()
+		}
+	}
+	return retryAfter
+}
+
+// Failed -- records a failed attempt against both the IP and the username
+func (a LoginAttempt) Failed() {
+	failures := loginThrottleFail("ip", a.IP, loginThrottleIP.Window)
+	if block := loginThrottleIP.BlockFor(failures); block > 0 {
+		loginThrottleBlock("ip", a.IP, block)
+	}
+
+	if a.Username != "" {
+		failures = loginThrottleFail(a.usernameScope(), a.Username, loginThrottleUsername.Window)
+		if block := loginThrottleUsername.BlockFor(failures); block > 0 {
+			loginThrottleBlock(a.usernameScope(), a.Username, block)
+		}
+	}
+}
+
+// Succeeded -- forgets the username's failures. The IP's are kept, otherwise
+// logging in to your own account would reset the count for the accounts you
+// are guessing.
+func (a LoginAttempt) Succeeded() {
+	if a.Username != "" {
+		loginThrottleReset(a.usernameScope(), a.Username)
+	}
+}
+
+// writeLoginBlocked -- the response for a throttled login attempt
+func writeLoginBlocked(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Add("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("429 - Too many failed login attempts, try again later"))
+}
+
+// writeLoginFailed -- the response for every failed login, so callers can't
+// tell unknown usernames from wrong passwords
+func writeLoginFailed(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("401 - Invalid username or password"))
+}
+
+// authenticateUser -- looks the user up and checks their password, spending the
+// same time whether or not the user exists
+func authenticateUser(username string, password string) (User, bool) {
+	var user = User{}
+	user.LookupFromName(username)
+
+	if user.ID == 0 {
+		// costs as much as checking a password made by the preferred hasher
+		preferredPasswordHasher.Hash(password)
+		return User{}, false
+	}
+
+	// accounts that haven't been confirmed or were disabled can't log in
+	if !user.IsPasswordAuthenticated(password, &dbConn) || !user.Active {
+		return User{}, false
+	}
+	return user, true
+}
+
+func loginThrottleKey(kind string, scope string, key string) string {
+	return fmt.Sprintf("login:%s:%s:%s", kind, scope, key)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoginThrottlePolicy_BlockFor(t *testing.T) {
+	policy := LoginThrottlePolicy{
+		DelayAfter:      3,
+		BaseDelay:       time.Second,
+		MaxDelay:        10 * time.Second,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+	}
+
+	expected := map[int]time.Duration{
+		1:  0,
+		2:  0,
+		3:  time.Second,
+		4:  2 * time.Second,
+		5:  4 * time.Second,
+		6:  8 * time.Second,
+		7:  10 * time.Second,
+		9:  10 * time.Second,
+		10: 15 * time.Minute,
+		50: 15 * time.Minute,
+	}
+
+	for failures, want := range expected {
+		if got := policy.BlockFor(failures); got != want {
+			t.Errorf("%d failures: got %s wanted %s", failures, got, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://127.0.0.1:8080/login", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.2")
+
+	trustForwardedFor = false
+	if ip := clientIP(req); ip != "10.0.0.1" {
+		t.Errorf("got %s wanted the remote address", ip)
+	}
+
+	trustForwardedFor = true
+	defer func() { trustForwardedFor = false }()
+	if ip := clientIP(req); ip != "198.51.100.2" {
+		t.Errorf("got %s wanted the address added by our proxy", ip)
+	}
+}
+
+func TestDisableTwoFactorView_Throttled(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+	_, resetRedis := mockRedis(t)
+	defer resetRedis()
+
+	disable := func() int {
+		req := httptest.NewRequest("POST", "/user/2fa/disable", strings.NewReader(`{"code": "not-a-code"}`))
+		req = withVerifiedToken(req, JWTToken{UserID: 7})
+		w := httptest.NewRecorder()
+		disableTwoFactorView(w, req)
+		return w.Code
+	}
+
+	// a wrong code, checked against the recovery codes too, counts as a failed login
+	expectUser(mock, 7, 0, 0, true)
+	mock.ExpectPrepare("FROM api_totp WHERE user_id = ?").ExpectQuery().WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret", "confirmed", "created_on"}).AddRow(7, "JBSWY3DPEHPK3PXP", true, time.Now()))
+	mock.ExpectPrepare("FROM api_recovery_code WHERE user_id = ?").ExpectQuery().WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "code_hash"}))
+
+	if code := disable(); code != http.StatusUnauthorized {
+		t.Fatalf("got status %d wanted %d", code, http.StatusUnauthorized)
+	}
+	if failures, _ := redisClient.Get(loginThrottleKey("failures", "username", "user7")).Int(); failures != 1 {
+		t.Errorf("got %d failures wanted 1", failures)
+	}
+
+	// once blocked no code is checked at all
+	loginThrottleBlock("username", "user7", time.Minute)
+	expectUser(mock, 7, 0, 0, true)
+	mock.ExpectPrepare("FROM api_totp WHERE user_id = ?").ExpectQuery().WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret", "confirmed", "created_on"}).AddRow(7, "JBSWY3DPEHPK3PXP", true, time.Now()))
+
+	if code := disable(); code != http.StatusTooManyRequests {
+		t.Errorf("got status %d wanted %d", code, http.StatusTooManyRequests)
+	}
+}
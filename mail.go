@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer -- interface for anything capable of sending email to users
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+var mailer Mailer = &MemoryMailer{}
+
+// pendingMail -- mail being sent by sendMailAsync
+var pendingMail sync.WaitGroup
+
+// sendMailAsync -- sends in the background and only logs failures, for views
+// whose response time mustn't depend on whether any mail was sent
+func sendMailAsync(to string, subject string, body string) {
+	pendingMail.Add(1)
+	go func() {
+		defer pendingMail.Done()
+		if err := mailer.Send(to, subject, body); err != nil {
+			fmt.Printf("Unable to send %q to %s: %v\n", subject, to, err)
+		}
+	}()
+}
+
+// ErrMailNotConfigured -- returned for every message when no SMTP host is set
+var ErrMailNotConfigured = errors.New("no smtp host is configured")
+
+// newMailer -- returns an SMTPMailer for the [smtp] config, or a mailer that
+// refuses to send when no host is configured
+func newMailer(host string, port int, username string, password string, from string) (Mailer, error) {
+	if host == "" {
+		return noMailer{}, nil
+	}
+	if from == "" {
+		return nil, errors.New("smtp from address is not configured")
+	}
+
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		From:     from,
+	}, nil
+}
+
+// SMTPMailer -- sends mail through an SMTP server, upgrading to TLS with
+// STARTTLS when the server offers it
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		// net/smtp refuses to send credentials without TLS, except to localhost
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	return smtp.SendMail(addr, auth, m.From, []string{to}, buildMailMessage(m.From, to, subject, body, time.Now()))
+}
+
+// buildMailMessage -- a plain text RFC 5322 message
+func buildMailMessage(from string, to string, subject string, body string, date time.Time) []byte {
+	// header injection through user supplied addresses
+	from = strings.NewReplacer("\r", "", "\n", "").Replace(from)
+	to = strings.NewReplacer("\r", "", "\n", "").Replace(to)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.Replace(strings.Replace(body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	return msg.Bytes()
+}
+
+// noMailer -- fails every message rather than dropping it
+type noMailer struct{}
+
+func (noMailer) Send(to string, subject string, body string) error {
+	return ErrMailNotConfigured
+}
+
+// MailMessage -- a message kept by the MemoryMailer
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MemoryMailer -- keeps sent mail in memory, used by tests
+type MemoryMailer struct {
+	Messages []MailMessage
+	mu       sync.Mutex
+}
+
+func (m *MemoryMailer) Send(to string, subject string, body string) error {
+	m.mu.Lock()
+	m.Messages = append(m.Messages, MailMessage{To: to, Subject: subject, Body: body})
+	m.mu.Unlock()
+	return nil
+}
+
+// Sent -- returns a copy of everything sent so far
+func (m *MemoryMailer) Sent() []MailMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := make([]MailMessage, len(m.Messages))
+	copy(msgs, m.Messages)
+	return msgs
+}
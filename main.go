@@ -13,12 +13,14 @@ import (
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	"gitlab.com/lsoftop/api-server/cachecontrol"
 
 	"gopkg.in/ini.v1"
 )
@@ -28,6 +30,7 @@ type Domain struct {
 	ID        int       `json:"id"`
 	Name      string    `json:"name"`
 	CreatedOn time.Time `json:"created_on"`
+	TeamID    int       `json:"team_id,omitempty"`
 }
 
 // Record -- struct for storing information regarding records
@@ -39,6 +42,7 @@ type Record struct {
 	CreatedOn time.Time `json:"created_on"`
 	DomainID  int       `json:"domain_id"`
 	OwnerID   int       `json:"owner_id"`
+	TeamID    int       `json:"team_id,omitempty"`
 }
 
 type RequestCounter struct {
@@ -47,11 +51,18 @@ type RequestCounter struct {
 }
 
 // CacheControlMessage -- struct for storing/parsing redis cache control messages
-//  					  to the dns server
+//
+//	to the dns server
+//
+// Messages published within the configured batch window are sent as a single
+// message with an Action of "batch", the individual messages are in Batch.
+// Messages with an Action of "update" carry the state being replaced in Previous.
 type CacheControlMessage struct {
-	Action string
-	Type   string
-	Object string
+	Action   string
+	Type     string
+	Object   string
+	Previous string                `json:",omitempty"`
+	Batch    []CacheControlMessage `json:",omitempty"`
 }
 
 var (
@@ -88,6 +99,17 @@ func main() {
 	redisDB, _ := cfg.Section("redis").Key("db").Int()
 	redisCacheChannel = cfg.Section("redis").Key("cache_channel").String()
 
+	cachePublisherType := cfg.Section("cache").Key("publisher").MustString("redis")
+	cacheBatchWindow := cfg.Section("cache").Key("batch_window").MustDuration(0)
+	cacheBatchSize := cfg.Section("cache").Key("batch_size").MustInt(500)
+	cacheSigningAlgorithm := cfg.Section("cache").Key("signing_algorithm").MustString("hmac")
+	cacheSigningKeyID := cfg.Section("cache").Key("signing_key_id").String()
+	cacheSigningKey := cfg.Section("cache").Key("signing_key").String()
+	cacheMaxAge := cfg.Section("cache").Key("max_age").MustDuration(cachecontrol.DefaultMaxAge)
+	natsHost := cfg.Section("nats").Key("host").MustString("127.0.0.1:4222")
+	natsSubject := cfg.Section("nats").Key("subject").MustString(redisCacheChannel)
+	webhookURLs := configList(cfg.Section("webhook").Key("urls").String())
+
 	apiPort, _ := cfg.Section("api").Key("api_port").Int()
 	prometheusPort, _ = cfg.Section("api").Key("prometheus_port").Int()
 	pprofPort, _ := cfg.Section("api").Key("pprof_port").Int()
@@ -104,6 +126,90 @@ func main() {
 	}
 
 	encryptionSalt = cfg.Section("security").Key("secret_key").String()
+	openRecordCreation = cfg.Section("security").Key("open_record_creation").MustBool(true)
+	requireStaffTwoFactor = cfg.Section("security").Key("require_staff_2fa").MustBool(false)
+	twoFactorIssuer = cfg.Section("security").Key("2fa_issuer").MustString(twoFactorIssuer)
+	impersonationLifetime = cfg.Section("security").Key("impersonation_lifetime").MustDuration(impersonationLifetime)
+	loadRoles(cfg.Section("roles").KeysHash())
+	registrationMode = cfg.Section("registration").Key("mode").In(registrationClosed, []string{registrationClosed, registrationOpen, registrationInvite})
+	registrationConfirmURL = cfg.Section("registration").Key("confirm_url").String()
+	registrationConfirmLifetime = cfg.Section("registration").Key("confirm_lifetime").MustDuration(registrationConfirmLifetime)
+
+	defaultQuotas = Quotas{
+		RecordsPerUser:   cfg.Section("quotas").Key(quotaRecordsPerUser).MustInt(0),
+		RecordsPerDomain: cfg.Section("quotas").Key(quotaRecordsPerDomain).MustInt(0),
+		APICallsPerDay:   cfg.Section("quotas").Key(quotaAPICallsPerDay).MustInt(0),
+	}
+
+	passwordPolicy = PasswordPolicy{
+		MinLength:        cfg.Section("password_policy").Key("min_length").MustInt(passwordPolicy.MinLength),
+		MaxLength:        cfg.Section("password_policy").Key("max_length").MustInt(passwordPolicy.MaxLength),
+		RequireLetter:    cfg.Section("password_policy").Key("require_letter").MustBool(passwordPolicy.RequireLetter),
+		RequireDigit:     cfg.Section("password_policy").Key("require_digit").MustBool(passwordPolicy.RequireDigit),
+		RequireMixedCase: cfg.Section("password_policy").Key("require_mixed_case").MustBool(passwordPolicy.RequireMixedCase),
+		RequireSymbol:    cfg.Section("password_policy").Key("require_symbol").MustBool(passwordPolicy.RequireSymbol),
+		RejectUsername:   cfg.Section("password_policy").Key("reject_username").MustBool(passwordPolicy.RejectUsername),
+	}
+	passwordResetURL = cfg.Section("password_reset").Key("reset_url").String()
+	passwordResetLifetime = cfg.Section("password_reset").Key("lifetime").MustDuration(passwordResetLifetime)
+
+	mailer, err = newMailer(
+		cfg.Section("smtp").Key("host").String(),
+		cfg.Section("smtp").Key("port").MustInt(25),
+		cfg.Section("smtp").Key("username").String(),
+		cfg.Section("smtp").Key("password").String(),
+		cfg.Section("smtp").Key("from").String(),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := mailer.(noMailer); ok {
+		// new users could never confirm their accounts
+		if registrationMode != registrationClosed {
+			log.Fatal("[SMTP] No smtp host configured, registration needs one to send confirmation emails")
+		}
+		log.Warn("[SMTP] No smtp host configured, password reset emails will not be sent")
+	}
+
+	preferredPasswordHasher, err = newPreferredPasswordHasher(
+		cfg.Section("passwords").Key("algorithm").MustString("pbkdf2_sha256"),
+		cfg.Section("passwords").Key("work_factor").MustInt(0),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	trustForwardedFor = cfg.Section("security").Key("trust_forwarded_for").MustBool(false)
+	loginThrottleIP = loadLoginThrottlePolicy(cfg.Section("login_throttle_ip"), loginThrottleIP)
+	loginThrottleUsername = loadLoginThrottlePolicy(cfg.Section("login_throttle_username"), loginThrottleUsername)
+
+	jwtKeyring, err = newJWTKeyring(
+		cfg.Section("jwt").Key("algorithm").MustString("HS256"),
+		cfg.Section("jwt").Key("key_id").String(),
+		cfg.Section("jwt").Key("signing_key").String(),
+		cfg.Section("jwt_verification_keys").KeysHash(),
+		encryptionSalt,
+		cfg.Section("jwt").Key("accept_hs256").MustBool(false),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.Section("oidc").Key("enabled").MustBool(false) {
+		oidcProvider = &OIDCProvider{
+			Issuer:        cfg.Section("oidc").Key("issuer").String(),
+			ClientID:      cfg.Section("oidc").Key("client_id").String(),
+			ClientSecret:  cfg.Section("oidc").Key("client_secret").String(),
+			RedirectURL:   cfg.Section("oidc").Key("redirect_url").String(),
+			Scopes:        configList(cfg.Section("oidc").Key("scopes").MustString("openid,profile,email")),
+			UsernameClaim: cfg.Section("oidc").Key("username_claim").MustString("preferred_username"),
+			GroupsClaim:   cfg.Section("oidc").Key("groups_claim").String(),
+			AdminGroups:   configList(cfg.Section("oidc").Key("admin_groups").String()),
+			StaffGroups:   configList(cfg.Section("oidc").Key("staff_groups").String()),
+			CreateUsers:   cfg.Section("oidc").Key("create_users").MustBool(true),
+			LinkByEmail:   cfg.Section("oidc").Key("link_by_email").MustBool(false),
+			Client:        &http.Client{Timeout: 10 * time.Second},
+		}
+	}
 
 	go func() {
 		r := http.NewServeMux()
@@ -131,16 +237,41 @@ func main() {
 		log.Fatal(err)
 	}
 
-	redisClient := redisConnect(redisHost, redisPassword, redisDB)
+	// redis is needed whatever the cache publisher, token revocation, sessions,
+	// login throttling and quotas are all kept in it
+	redisClient = redisConnect(redisHost, redisPassword, redisDB)
 
-	// start subscribing to redis cache channel and begin receiving data
-	redisClient.Subscribe(redisCacheChannel).Receive()
+	cachePublisher, err := newCachePublisher(cachePublisherType, redisClient, redisCacheChannel, natsHost, natsSubject, webhookURLs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cacheSigner, err := newCacheSigner(cacheSigningAlgorithm, cacheSigningKeyID, cacheSigningKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cachePublisher = &SigningCachePublisher{
+		Publisher: cachePublisher,
+		Signer:    cacheSigner,
+		MaxAge:    cacheMaxAge,
+	}
+	if cacheMaxAge < 0 {
+		log.Fatal("[CACHE] max_age can't be negative")
+	}
+	if cacheMaxAge == 0 {
+		log.Warn("[CACHE] max_age is 0, messages are only limited by the MaxAge of the dns servers verifying them")
+	}
+
+	if cachePublisherType == "" || cachePublisherType == "redis" {
+		// start subscribing to redis cache channel and begin receiving data
+		redisClient.Subscribe(redisCacheChannel).Receive()
+	}
 
 	domainChannel = make(chan CacheControlMessage)
-	go manageCacheChannel(domainChannel, redisClient, redisCacheChannel)
+	go manageCacheChannel(domainChannel, cachePublisher, cacheBatchWindow, cacheBatchSize)
 
 	recordChannel = make(chan CacheControlMessage)
-	go manageCacheChannel(recordChannel, redisClient, redisCacheChannel)
+	go manageCacheChannel(recordChannel, cachePublisher, cacheBatchWindow, cacheBatchSize)
 
 	// Start prometheus metrics
 	go startPrometheus()
@@ -148,20 +279,69 @@ func main() {
 	go func() {
 		router := mux.NewRouter().StrictSlash(true)
 		router.HandleFunc("/", requestMiddleware(indexView))
-		router.HandleFunc("/login", loginView) // No middleware here as its expected to have a clean session state
+		router.HandleFunc("/.well-known/jwks.json", jwksView)
+		router.HandleFunc("/login", loginView)              // No middleware here as its expected to have a clean session state
+		router.HandleFunc("/login/2fa", loginTwoFactorView) // Second login step, authenticated by the mfa token
+		router.HandleFunc("/login/oidc", oidcLoginView)
+		router.HandleFunc("/login/oidc/callback", oidcCallbackView)
 		router.HandleFunc("/logout", requestMiddleware(logoutView))
+		router.HandleFunc("/logout/all", requestMiddleware(logoutAllView))
+		router.HandleFunc("/admin/audit/list", requestMiddleware(listAuditView))
+		router.HandleFunc("/admin/user/list", requestMiddleware(listUserView))
+		router.HandleFunc("/admin/user/view", requestMiddleware(viewUserView))
+		router.HandleFunc("/admin/user/disable", requestMiddleware(disableUserView))
+		router.HandleFunc("/admin/user/enable", requestMiddleware(enableUserView))
+		router.HandleFunc("/admin/user/flags", requestMiddleware(setUserFlagsView))
+		router.HandleFunc("/admin/user/quota", requestMiddleware(setUserQuotaView))
+		router.HandleFunc("/admin/user/impersonate", requestMiddleware(impersonateUserView))
 		router.HandleFunc("/cache/purge", requestMiddleware(purgeCacheView))
 		router.HandleFunc("/cache/record/purge", requestMiddleware(purgeCacheRecordView))
 		router.HandleFunc("/domain/create", requestMiddleware(createDomainView))
 		router.HandleFunc("/domain/list", requestMiddleware(listDomainView))
 		router.HandleFunc("/domain/delete", requestMiddleware(deleteDomainView))
+		router.HandleFunc("/domain/team", requestMiddleware(setDomainTeamView))
+		router.HandleFunc("/org/create", requestMiddleware(createOrganizationView))
+		router.HandleFunc("/org/list", requestMiddleware(listOrganizationView))
+		router.HandleFunc("/org/view", requestMiddleware(viewOrganizationView))
+		router.HandleFunc("/org/delete", requestMiddleware(deleteOrganizationView))
+		router.HandleFunc("/org/member/set", requestMiddleware(setOrganizationMemberView))
+		router.HandleFunc("/org/member/remove", requestMiddleware(removeOrganizationMemberView))
 		router.HandleFunc("/record/create", requestMiddleware(createRecordView))
 		router.HandleFunc("/record/update", requestMiddleware(updateRecordView))
 		router.HandleFunc("/record/list", requestMiddleware(listRecordView))
 		router.HandleFunc("/record/list/all", requestMiddleware(listAllRecordView))
 		router.HandleFunc("/record/delete", requestMiddleware(deleteRecordView))
+		router.HandleFunc("/record/transfer", requestMiddleware(createRecordTransferView))
+		router.HandleFunc("/record/transfer/list", requestMiddleware(listRecordTransferView))
+		router.HandleFunc("/record/transfer/accept", requestMiddleware(acceptRecordTransferView))
+		router.HandleFunc("/record/transfer/decline", requestMiddleware(declineRecordTransferView))
+		router.HandleFunc("/role/list", requestMiddleware(listRoleView))
+		router.HandleFunc("/role/user", requestMiddleware(listUserRoleView))
+		router.HandleFunc("/role/assign", requestMiddleware(assignRoleView))
+		router.HandleFunc("/role/revoke", requestMiddleware(revokeRoleView))
+		router.HandleFunc("/team/create", requestMiddleware(createTeamView))
+		router.HandleFunc("/team/view", requestMiddleware(viewTeamView))
+		router.HandleFunc("/team/delete", requestMiddleware(deleteTeamView))
+		router.HandleFunc("/team/member/set", requestMiddleware(setTeamMemberView))
+		router.HandleFunc("/team/member/remove", requestMiddleware(removeTeamMemberView))
 		router.HandleFunc("/session/jwt/create", requestMiddleware(createJWTTokenView))
+		router.HandleFunc("/session/jwt/refresh", refreshJWTTokenView) // No middleware, the access token has usually expired by now
 		router.HandleFunc("/user/profile", requestMiddleware(userProfileView))
+		router.HandleFunc("/user/password/change", requestMiddleware(changePasswordView))
+		router.HandleFunc("/user/session/list", requestMiddleware(listSessionView))
+		router.HandleFunc("/user/session/revoke", requestMiddleware(revokeSessionView))
+		router.HandleFunc("/user/password/reset", requestPasswordResetView)  // No middleware, the user has forgotten their password
+		router.HandleFunc("/user/password/reset/confirm", resetPasswordView) // No middleware, authenticated by the emailed token
+		router.HandleFunc("/user/register", registerView)                    // No middleware, new users have no credentials yet
+		router.HandleFunc("/user/register/confirm", confirmRegistrationView) // No middleware, authenticated by the emailed token
+		router.HandleFunc("/user/invite/create", requestMiddleware(createInviteCodeView))
+		router.HandleFunc("/user/2fa/enroll", enrollTwoFactorView)   // No middleware, enrollment may be required before logging in
+		router.HandleFunc("/user/2fa/confirm", confirmTwoFactorView) // No middleware, enrollment may be required before logging in
+		router.HandleFunc("/user/2fa/disable", requestMiddleware(disableTwoFactorView))
+		router.HandleFunc("/user/2fa/recovery", requestMiddleware(regenerateRecoveryCodesView))
+		router.HandleFunc("/user/apikey/create", requestMiddleware(createAPIKeyView))
+		router.HandleFunc("/user/apikey/list", requestMiddleware(listAPIKeyView))
+		router.HandleFunc("/user/apikey/revoke", requestMiddleware(revokeAPIKeyView))
 		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", apiPort), router))
 	}()
 
@@ -171,3 +351,26 @@ func main() {
 	log.Fatalf("Signal (%v) received, stopping\n", s)
 
 }
+
+// configList -- splits a comma separated config value, skipping empty entries
+func configList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// loadLoginThrottlePolicy -- overrides the defaults with whatever the section sets
+func loadLoginThrottlePolicy(section *ini.Section, defaults LoginThrottlePolicy) LoginThrottlePolicy {
+	return LoginThrottlePolicy{
+		Window:          section.Key("window").MustDuration(defaults.Window),
+		DelayAfter:      section.Key("delay_after").MustInt(defaults.DelayAfter),
+		BaseDelay:       section.Key("base_delay").MustDuration(defaults.BaseDelay),
+		MaxDelay:        section.Key("max_delay").MustDuration(defaults.MaxDelay),
+		LockoutAfter:    section.Key("lockout_after").MustInt(defaults.LockoutAfter),
+		LockoutDuration: section.Key("lockout_duration").MustDuration(defaults.LockoutDuration),
+	}
+}
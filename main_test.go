@@ -1,10 +1,16 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
 )
 
 var testRecord = Record{
@@ -87,6 +93,69 @@ func TestIndexView_MissingAPIKey(t *testing.T) {
 	}
 }
 
+var mockDBCount int
+
+// mockDB -- points dbConn at a sqlmock database, call the returned func to
+// put the (unconnected) database back
+func mockDB(t *testing.T) (sqlmock.Sqlmock, func()) {
+	mockDBCount++
+	dsn := fmt.Sprintf("mock_db_%d", mockDBCount)
+	_, mock, err := sqlmock.NewWithDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a database opened but not yet connected, so every connection dbConn
+	// makes belongs to it rather than to the copied *sql.DB
+	dbConn = *openMockDB(t, dsn)
+
+	return mock, func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		dbConn = sql.DB{}
+	}
+}
+
+func openMockDB(t *testing.T, dsn string) *sql.DB {
+	db, err := sql.Open("sqlmock", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// mockRedis -- points redisClient at a miniredis server, call the returned
+// func to stop it
+func mockRedis(t *testing.T) (*miniredis.Miniredis, func()) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := redisClient
+	redisClient = redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	return server, func() {
+		redisClient.Close()
+		redisClient = previous
+		server.Close()
+	}
+}
+
+// useTestKeyring -- signs and verifies tokens with a throwaway HS256 key, call
+// the returned func to put the previous keyring back
+func useTestKeyring(t *testing.T) func() {
+	keyring, err := newJWTKeyring("HS256", "", "", nil, "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := jwtKeyring
+	jwtKeyring = keyring
+	return func() { jwtKeyring = previous }
+}
+
 func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 
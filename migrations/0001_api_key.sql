@@ -0,0 +1,14 @@
+-- Named api keys, several per user. authtoken_token (managed by django) only
+-- allows a single key per user and is kept for existing keys.
+CREATE TABLE api_key (
+    id INT NOT NULL AUTO_INCREMENT,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    `key` VARCHAR(64) NOT NULL,
+    created_on DATETIME(6) NOT NULL,
+    last_used_on DATETIME(6) NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY api_key_key_uniq (`key`),
+    KEY api_key_user_id_idx (user_id),
+    CONSTRAINT api_key_user_id_fk FOREIGN KEY (user_id) REFERENCES auth_user (id) ON DELETE CASCADE
+);
@@ -0,0 +1,15 @@
+-- Only keep a prefix (to find the key) and a sha256 hash of every api key.
+ALTER TABLE api_key
+    ADD COLUMN prefix VARCHAR(8) NOT NULL DEFAULT '',
+    ADD COLUMN key_hash CHAR(64) NOT NULL DEFAULT '';
+
+UPDATE api_key SET prefix = LEFT(`key`, 8), key_hash = SHA2(`key`, 256);
+
+ALTER TABLE api_key
+    DROP INDEX api_key_key_uniq,
+    DROP COLUMN `key`,
+    ADD KEY api_key_prefix_idx (prefix);
+
+-- Keys in django's authtoken_token keep working as they are, a hashed copy
+-- (named "legacy") is kept in api_key the first time they are used and the
+-- authtoken_token row is left for django, see 0014_api_key_legacy.sql.
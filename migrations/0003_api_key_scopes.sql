@@ -0,0 +1,6 @@
+-- Optional scopes limiting what an api key can do. Empty domains/endpoints
+-- mean the key isn't limited, both are comma separated lists.
+ALTER TABLE api_key
+    ADD COLUMN read_only TINYINT(1) NOT NULL DEFAULT 0,
+    ADD COLUMN domains VARCHAR(2048) NOT NULL DEFAULT '',
+    ADD COLUMN endpoints VARCHAR(2048) NOT NULL DEFAULT '';
@@ -0,0 +1,11 @@
+-- Roles assigned to users, either everywhere (domain_id NULL) or for a single domain.
+CREATE TABLE api_user_role (
+    id INT NOT NULL AUTO_INCREMENT,
+    user_id INT NOT NULL,
+    role VARCHAR(64) NOT NULL,
+    domain_id INT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY api_user_role_uniq (user_id, role, domain_id),
+    CONSTRAINT api_user_role_user_id_fk FOREIGN KEY (user_id) REFERENCES auth_user (id) ON DELETE CASCADE,
+    CONSTRAINT api_user_role_domain_id_fk FOREIGN KEY (domain_id) REFERENCES dns_domain (id) ON DELETE CASCADE
+);
@@ -0,0 +1,20 @@
+-- TOTP (RFC 6238) two factor authentication
+CREATE TABLE api_totp (
+    user_id INT NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    confirmed TINYINT(1) NOT NULL DEFAULT 0,
+    created_on DATETIME(6) NOT NULL,
+    PRIMARY KEY (user_id),
+    CONSTRAINT api_totp_user_id_fk FOREIGN KEY (user_id) REFERENCES auth_user (id) ON DELETE CASCADE
+);
+
+-- Single use recovery codes, stored as sha256 hashes
+CREATE TABLE api_recovery_code (
+    id INT NOT NULL AUTO_INCREMENT,
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_on DATETIME(6) NULL,
+    PRIMARY KEY (id),
+    KEY api_recovery_code_user_id_idx (user_id),
+    CONSTRAINT api_recovery_code_user_id_fk FOREIGN KEY (user_id) REFERENCES auth_user (id) ON DELETE CASCADE
+);
@@ -0,0 +1,14 @@
+-- Invite codes for invite only registration, stored as sha256 hashes
+CREATE TABLE api_invite_code (
+    id INT NOT NULL AUTO_INCREMENT,
+    code_hash CHAR(64) NOT NULL,
+    created_by_id INT NOT NULL,
+    created_on DATETIME(6) NOT NULL,
+    expires_on DATETIME(6) NULL,
+    used_by_id INT NULL,
+    used_on DATETIME(6) NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY api_invite_code_code_hash_uniq (code_hash),
+    CONSTRAINT api_invite_code_created_by_id_fk FOREIGN KEY (created_by_id) REFERENCES auth_user (id) ON DELETE CASCADE,
+    CONSTRAINT api_invite_code_used_by_id_fk FOREIGN KEY (used_by_id) REFERENCES auth_user (id) ON DELETE SET NULL
+);
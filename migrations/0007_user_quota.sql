@@ -0,0 +1,8 @@
+-- Per user quota overrides, NULL uses the [quotas] default and 0 is unlimited
+CREATE TABLE api_user_quota (
+    user_id INT NOT NULL,
+    records_per_user INT NULL,
+    api_calls_per_day INT NULL,
+    PRIMARY KEY (user_id),
+    CONSTRAINT api_user_quota_user_id_fk FOREIGN KEY (user_id) REFERENCES auth_user (id) ON DELETE CASCADE
+);
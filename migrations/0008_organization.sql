@@ -0,0 +1,46 @@
+-- Organizations and their members, role is owner, admin or member
+CREATE TABLE api_organization (
+    id INT NOT NULL AUTO_INCREMENT,
+    name VARCHAR(150) NOT NULL,
+    created_on DATETIME(6) NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY api_organization_name_uniq (name)
+);
+
+CREATE TABLE api_organization_member (
+    org_id INT NOT NULL,
+    user_id INT NOT NULL,
+    role VARCHAR(16) NOT NULL,
+    PRIMARY KEY (org_id, user_id),
+    CONSTRAINT api_organization_member_org_id_fk FOREIGN KEY (org_id) REFERENCES api_organization (id) ON DELETE CASCADE,
+    CONSTRAINT api_organization_member_user_id_fk FOREIGN KEY (user_id) REFERENCES auth_user (id) ON DELETE CASCADE
+);
+
+-- Teams within an organization and their members, role is maintainer or member
+CREATE TABLE api_team (
+    id INT NOT NULL AUTO_INCREMENT,
+    org_id INT NOT NULL,
+    name VARCHAR(150) NOT NULL,
+    created_on DATETIME(6) NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY api_team_org_id_name_uniq (org_id, name),
+    CONSTRAINT api_team_org_id_fk FOREIGN KEY (org_id) REFERENCES api_organization (id) ON DELETE CASCADE
+);
+
+CREATE TABLE api_team_member (
+    team_id INT NOT NULL,
+    user_id INT NOT NULL,
+    role VARCHAR(16) NOT NULL,
+    PRIMARY KEY (team_id, user_id),
+    CONSTRAINT api_team_member_team_id_fk FOREIGN KEY (team_id) REFERENCES api_team (id) ON DELETE CASCADE,
+    CONSTRAINT api_team_member_user_id_fk FOREIGN KEY (user_id) REFERENCES auth_user (id) ON DELETE CASCADE
+);
+
+-- Records and domains can belong to a team, whose members can then manage them
+ALTER TABLE dns_record
+    ADD COLUMN team_id INT NULL,
+    ADD CONSTRAINT dns_record_team_id_fk FOREIGN KEY (team_id) REFERENCES api_team (id) ON DELETE SET NULL;
+
+ALTER TABLE dns_domain
+    ADD COLUMN team_id INT NULL,
+    ADD CONSTRAINT dns_domain_team_id_fk FOREIGN KEY (team_id) REFERENCES api_team (id) ON DELETE SET NULL;
@@ -0,0 +1,44 @@
+-- Audit trail of sensitive actions, detail is a JSON object
+CREATE TABLE api_audit_log (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    created_on DATETIME(6) NOT NULL,
+    actor_id INT NULL,
+    action VARCHAR(64) NOT NULL,
+    object_type VARCHAR(32) NOT NULL,
+    object_id INT NULL,
+    detail TEXT NULL,
+    PRIMARY KEY (id),
+    KEY api_audit_log_actor_id_idx (actor_id),
+    KEY api_audit_log_object_idx (object_type, object_id),
+    CONSTRAINT api_audit_log_actor_id_fk FOREIGN KEY (actor_id) REFERENCES auth_user (id) ON DELETE SET NULL
+);
+
+-- Record ownership transfers to a user or a team, status is pending, accepted,
+-- declined or cancelled
+CREATE TABLE api_record_transfer (
+    id INT NOT NULL AUTO_INCREMENT,
+    from_user_id INT NOT NULL,
+    to_user_id INT NULL,
+    to_team_id INT NULL,
+    created_by_id INT NOT NULL,
+    created_on DATETIME(6) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    resolved_by_id INT NULL,
+    resolved_on DATETIME(6) NULL,
+    PRIMARY KEY (id),
+    KEY api_record_transfer_status_idx (status),
+    CONSTRAINT api_record_transfer_from_user_id_fk FOREIGN KEY (from_user_id) REFERENCES auth_user (id) ON DELETE CASCADE,
+    CONSTRAINT api_record_transfer_to_user_id_fk FOREIGN KEY (to_user_id) REFERENCES auth_user (id) ON DELETE CASCADE,
+    CONSTRAINT api_record_transfer_to_team_id_fk FOREIGN KEY (to_team_id) REFERENCES api_team (id) ON DELETE CASCADE,
+    CONSTRAINT api_record_transfer_created_by_id_fk FOREIGN KEY (created_by_id) REFERENCES auth_user (id) ON DELETE CASCADE,
+    CONSTRAINT api_record_transfer_resolved_by_id_fk FOREIGN KEY (resolved_by_id) REFERENCES auth_user (id) ON DELETE SET NULL
+);
+
+-- The records a transfer was created for
+CREATE TABLE api_record_transfer_record (
+    transfer_id INT NOT NULL,
+    record_id INT NOT NULL,
+    PRIMARY KEY (transfer_id, record_id),
+    CONSTRAINT api_record_transfer_record_transfer_id_fk FOREIGN KEY (transfer_id) REFERENCES api_record_transfer (id) ON DELETE CASCADE,
+    CONSTRAINT api_record_transfer_record_record_id_fk FOREIGN KEY (record_id) REFERENCES dns_record (id) ON DELETE CASCADE
+);
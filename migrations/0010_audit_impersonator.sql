@@ -0,0 +1,5 @@
+-- Staff member who took the action while impersonating actor_id
+ALTER TABLE api_audit_log
+    ADD COLUMN impersonator_id INT NULL AFTER actor_id,
+    ADD KEY api_audit_log_impersonator_id_idx (impersonator_id),
+    ADD CONSTRAINT api_audit_log_impersonator_id_fk FOREIGN KEY (impersonator_id) REFERENCES auth_user (id) ON DELETE SET NULL;
@@ -0,0 +1,16 @@
+-- Logins, one per refresh token family, so users can see and revoke them
+CREATE TABLE api_session (
+    id INT NOT NULL AUTO_INCREMENT,
+    family CHAR(36) NOT NULL,
+    user_id INT NOT NULL,
+    user_agent VARCHAR(512) NOT NULL,
+    ip_address VARCHAR(45) NOT NULL,
+    created_on DATETIME(6) NOT NULL,
+    last_used_on DATETIME(6) NOT NULL,
+    expires_on DATETIME(6) NOT NULL,
+    revoked_on DATETIME(6) NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY api_session_family_uniq (family),
+    KEY api_session_user_id_expires_on_idx (user_id, expires_on),
+    CONSTRAINT api_session_user_id_fk FOREIGN KEY (user_id) REFERENCES auth_user (id) ON DELETE CASCADE
+);
@@ -0,0 +1,16 @@
+-- domain_id is NULL for roles assigned everywhere, and NULLs never collide in
+-- a unique key, so compare a domain_scope of 0 instead.
+DELETE duplicate FROM api_user_role duplicate
+    JOIN api_user_role original
+        ON original.user_id = duplicate.user_id
+        AND original.role = duplicate.role
+        AND original.domain_id IS NULL
+        AND duplicate.domain_id IS NULL
+        AND original.id < duplicate.id;
+
+ALTER TABLE api_user_role
+    ADD COLUMN domain_scope INT AS (IFNULL(domain_id, 0)) STORED,
+    ADD UNIQUE KEY api_user_role_scope_uniq (user_id, role, domain_scope);
+
+ALTER TABLE api_user_role
+    DROP INDEX api_user_role_uniq;
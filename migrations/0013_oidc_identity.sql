@@ -0,0 +1,12 @@
+-- OIDC logins linked to a user by the issuer's subject, which (unlike the
+-- username or email) the IdP never reassigns.
+CREATE TABLE api_oidc_identity (
+    id INT NOT NULL AUTO_INCREMENT,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id INT NOT NULL,
+    created_on DATETIME(6) NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY api_oidc_identity_uniq (issuer, subject),
+    CONSTRAINT api_oidc_identity_user_id_fk FOREIGN KEY (user_id) REFERENCES auth_user (id) ON DELETE CASCADE
+);
@@ -0,0 +1,25 @@
+-- Keys in django's authtoken_token are no longer deleted when they are first
+-- used, a hashed copy marked legacy is kept in api_key and dropped once django
+-- rotates the key. Keys moved before this keep working as they are.
+ALTER TABLE api_key
+    ADD COLUMN legacy TINYINT(1) NOT NULL DEFAULT 0;
+
+-- Concurrent first uses could copy a key twice, key_hash is unique from now on
+DELETE duplicate FROM api_key duplicate
+    JOIN api_key original
+        ON original.key_hash = duplicate.key_hash
+        AND original.id < duplicate.id;
+
+ALTER TABLE api_key
+    ADD UNIQUE KEY api_key_key_hash_uniq (key_hash);
+
+-- To copy all of them right away instead, leaving authtoken_token alone:
+--
+-- INSERT IGNORE INTO api_key (user_id, name, prefix, key_hash, legacy, created_on)
+--     SELECT user_id, 'legacy', LEFT(`key`, 8), SHA2(`key`, 256), 1, created FROM authtoken_token;
+--
+-- authtoken_token keeps the keys in plaintext. Once every client uses a key
+-- from /user/apikey/create, retire them all (their legacy copies stop working
+-- with them):
+--
+-- DELETE FROM authtoken_token;
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// oidcLoginLifetime -- how long a user has to complete the login at the IdP
+const oidcLoginLifetime = 10 * time.Minute
+
+var oidcProvider *OIDCProvider
+
+// OIDCProvider -- an OpenID Connect identity provider users can log in with
+// using the authorization code flow with PKCE
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// claim holding the username of users created on first login, falls back
+	// to a verified email when missing
+	UsernameClaim string
+	// claim holding the user's groups, members of AdminGroups/StaffGroups get
+	// is_superuser/is_staff set on every login
+	GroupsClaim string
+	AdminGroups []string
+	StaffGroups []string
+	// create auth_user rows for users logging in for the first time
+	CreateUsers bool
+	// link a first login to the existing account with its verified email,
+	// never superuser or staff accounts. Only safe when the IdP controls
+	// which emails its users can verify.
+	LinkByEmail bool
+
+	Client *http.Client
+
+	mu                    sync.Mutex
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURI               string
+	keys                  map[string]interface{}
+}
+
+// OIDCLoginState -- what we need to remember between redirecting the user to
+// the IdP and the callback, stored under the state parameter
+type OIDCLoginState struct {
+	Nonce    string
+	Verifier string
+}
+
+// OIDCClaims -- the ID token claims we map to auth_user
+type OIDCClaims struct {
+	Subject       string
+	Username      string
+	Email         string
+	EmailVerified bool
+	FirstName     string
+	LastName      string
+	Groups        []string
+}
+
+// ErrOIDCConflict -- the IdP user has no account linked yet and one can't be
+// created, their username is taken by an account they weren't linked to
+var ErrOIDCConflict = errors.New("oidc login conflicts with an existing account")
+
+// discover -- fetches the provider's endpoints from its discovery document,
+// done on first use so the api starts even when the IdP is down
+func (p *OIDCProvider) discover() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.tokenEndpoint != "" {
+		return nil
+	}
+
+	var config struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &config); err != nil {
+		return err
+	}
+
+	if config.Issuer != p.Issuer {
+		return fmt.Errorf("oidc discovery issuer %s does not match %s", config.Issuer, p.Issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return errors.New("oidc discovery document is missing endpoints")
+	}
+
+	p.authorizationEndpoint = config.AuthorizationEndpoint
+	p.tokenEndpoint = config.TokenEndpoint
+	p.jwksURI = config.JWKSURI
+	return nil
+}
+
+func (p *OIDCProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// NewLogin -- returns a fresh state parameter and the state to store under it
+func (p *OIDCProvider) NewLogin() (string, OIDCLoginState, error) {
+	state, err := oidcRandomString()
+	if err != nil {
+		return "", OIDCLoginState{}, err
+	}
+	nonce, err := oidcRandomString()
+	if err != nil {
+		return "", OIDCLoginState{}, err
+	}
+	verifier, err := oidcRandomString()
+	if err != nil {
+		return "", OIDCLoginState{}, err
+	}
+	return state, OIDCLoginState{Nonce: nonce, Verifier: verifier}, nil
+}
+
+func oidcRandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge -- S256 code challenge for verifier (RFC 7636)
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL -- where to send the user to log in
+func (p *OIDCProvider) AuthCodeURL(state string, login OIDCLoginState) (string, error) {
+	if err := p.discover(); err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURL)
+	params.Set("scope", strings.Join(p.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", login.Nonce)
+	params.Set("code_challenge", pkceChallenge(login.Verifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.authorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.authorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange -- trades the authorization code for tokens, returns the raw ID token
+func (p *OIDCProvider) Exchange(code string, login OIDCLoginState) (string, error) {
+	if err := p.discover(); err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", login.Verifier)
+
+	req, err := http.NewRequest("POST", p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc token endpoint returned %s: %s %s", resp.Status, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("oidc token response has no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// VerifyIDToken -- checks the ID token signature, issuer, audience, expiry
+// and nonce and returns the claims we care about
+func (p *OIDCProvider) VerifyIDToken(rawIDToken string, nonce string) (OIDCClaims, error) {
+	if err := p.discover(); err != nil {
+		return OIDCClaims{}, err
+	}
+
+	parser := &jwt.Parser{ValidMethods: []string{"RS256", "EdDSA"}}
+	claims := jwt.MapClaims{}
+	if _, err := parser.ParseWithClaims(rawIDToken, claims, p.keyfunc); err != nil {
+		return OIDCClaims{}, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return OIDCClaims{}, fmt.Errorf("id token issuer %s does not match %s", iss, p.Issuer)
+	}
+
+	// aud is either a string or an array of strings
+	audience := oidcStrings(claims["aud"])
+	if !oidcContains(audience, p.ClientID) {
+		return OIDCClaims{}, errors.New("id token was not issued for this client")
+	}
+	if len(audience) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.ClientID {
+			return OIDCClaims{}, errors.New("id token azp does not match this client")
+		}
+	}
+
+	// MapClaims only checks exp when present, an ID token must have one
+	if _, ok := claims["exp"]; !ok {
+		return OIDCClaims{}, errors.New("id token has no exp claim")
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+		return OIDCClaims{}, errors.New("id token nonce does not match")
+	}
+
+	result := OIDCClaims{}
+	result.Subject, _ = claims["sub"].(string)
+	result.Email, _ = claims["email"].(string)
+	result.EmailVerified = oidcBool(claims["email_verified"])
+	result.FirstName, _ = claims["given_name"].(string)
+	result.LastName, _ = claims["family_name"].(string)
+	result.Username, _ = claims[p.UsernameClaim].(string)
+	if result.Username == "" && result.EmailVerified {
+		result.Username = result.Email
+	}
+	if result.Subject == "" {
+		return OIDCClaims{}, errors.New("id token has no subject")
+	}
+	if p.GroupsClaim != "" {
+		result.Groups = oidcStrings(claims[p.GroupsClaim])
+	}
+
+	return result, nil
+}
+
+// oidcStrings -- a claim that may be a single string or an array of them
+func oidcStrings(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []interface{}:
+		var values []string
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// oidcBool -- a boolean claim, some providers send email_verified as a string
+func oidcBool(claim interface{}) bool {
+	switch claim := claim.(type) {
+	case bool:
+		return claim
+	case string:
+		return claim == "true"
+	}
+	return false
+}
+
+func oidcContains(values []string, want string) bool {
+	for _, value := range values {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
+
+func oidcInGroups(groups []string, wanted []string) bool {
+	for _, group := range wanted {
+		if oidcContains(groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin -- whether the claims make the user a superuser
+func (p *OIDCProvider) IsAdmin(claims OIDCClaims) bool {
+	return oidcInGroups(claims.Groups, p.AdminGroups)
+}
+
+// IsStaff -- whether the claims make the user staff, superusers always are
+func (p *OIDCProvider) IsStaff(claims OIDCClaims) bool {
+	return p.IsAdmin(claims) || oidcInGroups(claims.Groups, p.StaffGroups)
+}
+
+// managesFlags -- only touch is_superuser/is_staff when groups are mapped,
+// otherwise they stay whatever django says
+func (p *OIDCProvider) managesFlags() bool {
+	return p.GroupsClaim != "" && (len(p.AdminGroups) > 0 || len(p.StaffGroups) > 0)
+}
+
+// keyfunc -- picks the IdP key by kid, refetching the JWKS once when the kid
+// is unknown in case the IdP rotated its keys
+func (p *OIDCProvider) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+
+	if !ok {
+		if err := p.fetchKeys(); err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		key, ok = p.keys[kid]
+		p.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown oidc kid %s", kid)
+		}
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if token.Method.Alg() != "RS256" {
+			return nil, fmt.Errorf("unexpected signing method %s for kid %s", token.Method.Alg(), kid)
+		}
+	case ed25519.PublicKey:
+		if token.Method.Alg() != "EdDSA" {
+			return nil, fmt.Errorf("unexpected signing method %s for kid %s", token.Method.Alg(), kid)
+		}
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) fetchKeys() error {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(p.jwksURI, &jwks); err != nil {
+		return err
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch jwk.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+			if err != nil {
+				return err
+			}
+			e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err != nil {
+				return err
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if err != nil {
+				return err
+			}
+			if jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			keys[jwk.Kid] = ed25519.PublicKey(x)
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	return nil
+}
+
+// LookupFromOIDC -- finds the user linked to the claims' subject. On first
+// login the subject is linked to the one active account with the (verified)
+// email when the provider allows it, or a user is created with an unusable
+// password, as django does. Usernames are never matched, the IdP doesn't own
+// them.
+func (u *User) LookupFromOIDC(provider *OIDCProvider, claims OIDCClaims, dbConn *sql.DB) error {
+	userID, err := oidcLinkedUserID(provider.Issuer, claims.Subject, dbConn)
+	if err != nil {
+		return err
+	}
+
+	if userID == 0 && provider.LinkByEmail && claims.EmailVerified && claims.Email != "" {
+		if userID, err = oidcUserIDFromEmail(claims.Email, dbConn); err != nil {
+			return err
+		}
+		if userID != 0 {
+			if err := oidcLink(dbConn, provider.Issuer, claims.Subject, userID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if userID == 0 {
+		if !provider.CreateUsers || claims.Username == "" {
+			return nil
+		}
+		return u.createFromOIDC(provider, claims, dbConn)
+	}
+
+	u.ID = userID
+	u.LookupFromID()
+
+	isAdmin, isStaff := provider.IsAdmin(claims), provider.IsStaff(claims)
+	if !provider.managesFlags() {
+		isAdmin, isStaff = u.Admin, u.Staff
+	}
+
+	query := "UPDATE auth_user SET last_login = ?, is_superuser = ?, is_staff = ? WHERE id = ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	if _, err = dq.Exec(time.Now(), isAdmin, isStaff, u.ID); err != nil {
+		return err
+	}
+
+	u.Admin = isAdmin
+	u.Staff = isStaff
+	return nil
+}
+
+// createFromOIDC -- creates the user and links the subject to them in one go
+func (u *User) createFromOIDC(provider *OIDCProvider, claims OIDCClaims, dbConn *sql.DB) error {
+	existing := User{}
+	existing.LookupFromName(claims.Username)
+	if existing.ID != 0 {
+		return ErrOIDCConflict
+	}
+
+	isAdmin, isStaff := provider.IsAdmin(claims), provider.IsStaff(claims)
+	if !provider.managesFlags() {
+		isAdmin, isStaff = false, false
+	}
+
+	unusable := make([]byte, 20)
+	if _, err := rand.Read(unusable); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO auth_user (password, last_login, is_superuser, username, first_name, last_name, email, is_staff, is_active, date_joined) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1, ?)"
+
+	now := time.Now()
+	result, err := tx.Exec(query, "!"+hex.EncodeToString(unusable), now, isAdmin, claims.Username, claims.FirstName, claims.LastName, claims.Email, isStaff, now)
+	if err != nil {
+		// someone took the username, or logged in as the subject, meanwhile
+		if isDuplicateKeyError(err) {
+			return ErrOIDCConflict
+		}
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if err := oidcLink(tx, provider.Issuer, claims.Subject, int(id)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	u.ID = int(id)
+	u.Name = claims.Username
+	u.Admin = isAdmin
+	u.Staff = isStaff
+	u.Active = true
+	return nil
+}
+
+// oidcLinkedUserID -- the user the issuer's subject is linked to, 0 for none
+func oidcLinkedUserID(issuer string, subject string, dbConn *sql.DB) (int, error) {
+	var userID int
+	query := "SELECT user_id FROM api_oidc_identity WHERE issuer = ? AND subject = ?"
+	if err := dbConn.QueryRow(query, issuer, subject).Scan(&userID); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// oidcUserIDFromEmail -- the active user with email, 0 when there is none or
+// more than one so it's unclear which account the login is for. Superuser and
+// staff accounts are never returned, taking one over through an email the IdP
+// lets anyone verify would be too easy.
+func oidcUserIDFromEmail(email string, dbConn *sql.DB) (int, error) {
+	rows, err := dbConn.Query("SELECT id, is_superuser, is_staff FROM auth_user WHERE email = ? AND is_active = 1 LIMIT 2", email)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user := User{}
+		if err := rows.Scan(&user.ID, &user.Admin, &user.Staff); err != nil {
+			return 0, err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(users) != 1 || users[0].Admin || users[0].Staff {
+		return 0, nil
+	}
+	return users[0].ID, nil
+}
+
+// oidcLink -- links the issuer's subject to the user
+func oidcLink(db execer, issuer string, subject string, userID int) error {
+	query := "INSERT INTO api_oidc_identity (issuer, subject, user_id, created_on) VALUES (?, ?, ?, ?)"
+	_, err := db.Exec(query, issuer, subject, userID, time.Now())
+	if isDuplicateKeyError(err) {
+		return ErrOIDCConflict
+	}
+	return err
+}
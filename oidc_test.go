@@ -0,0 +1,443 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-sql-driver/mysql"
+)
+
+// mockIdP -- a minimal OpenID Connect provider issuing RS256 ID tokens
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	// set by the authorize request, checked by the token request
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{key: key}
+	mux := http.NewServeMux()
+	idp.server = httptest.NewServer(mux)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jsonWebKey{
+			"keys": {{
+				Kty: "RSA",
+				Kid: "idp-1",
+				Use: "sig",
+				Alg: "RS256",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		if clientID != "uberdns" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		if r.FormValue("code") != "good-code" || pkceChallenge(r.FormValue("code_verifier")) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "unused",
+			"token_type":   "Bearer",
+			"id_token":     idp.sign(t, idp.claims),
+		})
+	})
+
+	return idp
+}
+
+func (idp *mockIdP) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "idp-1"
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// authorize -- plays the user logging in at the IdP, remembers the PKCE
+// challenge and nonce from the authorization URL
+func (idp *mockIdP) authorize(t *testing.T, authURL string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := u.Query()
+	if params.Get("code_challenge_method") != "S256" || params.Get("response_type") != "code" {
+		t.Fatalf("unexpected authorization request: %s", authURL)
+	}
+	idp.challenge = params.Get("code_challenge")
+	idp.nonce = params.Get("nonce")
+
+	idp.claims = jwt.MapClaims{
+		"iss":                idp.server.URL,
+		"sub":                "248289761001",
+		"aud":                "uberdns",
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              idp.nonce,
+		"preferred_username": "jane",
+		"email":              "jane@example.com",
+		"groups":             []string{"engineering", "dns-admins"},
+	}
+}
+
+func newTestOIDCProvider(idp *mockIdP) *OIDCProvider {
+	return &OIDCProvider{
+		Issuer:        idp.server.URL,
+		ClientID:      "uberdns",
+		ClientSecret:  "secret",
+		RedirectURL:   "https://api.example.com/login/oidc/callback",
+		Scopes:        []string{"openid", "profile", "email"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		AdminGroups:   []string{"dns-admins"},
+		StaffGroups:   []string{"dns-staff"},
+		Client:        idp.server.Client(),
+	}
+}
+
+func TestOIDCProvider_Login(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+	provider := newTestOIDCProvider(idp)
+
+	state, login, err := provider.NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := provider.AuthCodeURL(state, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, idp.server.URL+"/authorize?") {
+		t.Fatalf("unexpected authorization url %s", authURL)
+	}
+	idp.authorize(t, authURL)
+
+	idToken, err := provider.Exchange("good-code", login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := provider.VerifyIDToken(idToken, login.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Username != "jane" || claims.Email != "jane@example.com" || claims.Subject != "248289761001" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if !provider.IsAdmin(claims) || !provider.IsStaff(claims) {
+		t.Errorf("dns-admins member should be admin and staff")
+	}
+}
+
+func TestOIDCProvider_ExchangeWrongVerifier(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+	provider := newTestOIDCProvider(idp)
+
+	state, login, _ := provider.NewLogin()
+	authURL, err := provider.AuthCodeURL(state, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.authorize(t, authURL)
+
+	login.Verifier = "intercepted-code-without-the-verifier"
+	if _, err := provider.Exchange("good-code", login); err == nil {
+		t.Error("exchange with the wrong code verifier should fail")
+	}
+}
+
+func TestOIDCProvider_VerifyIDTokenRejects(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+	provider := newTestOIDCProvider(idp)
+
+	state, login, _ := provider.NewLogin()
+	authURL, err := provider.AuthCodeURL(state, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.authorize(t, authURL)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]func(claims jwt.MapClaims) string{
+		"wrong nonce": func(claims jwt.MapClaims) string {
+			claims["nonce"] = "replayed"
+			return idp.sign(t, claims)
+		},
+		"wrong audience": func(claims jwt.MapClaims) string {
+			claims["aud"] = []string{"another-client"}
+			return idp.sign(t, claims)
+		},
+		"wrong issuer": func(claims jwt.MapClaims) string {
+			claims["iss"] = "https://evil.example.com"
+			return idp.sign(t, claims)
+		},
+		"expired": func(claims jwt.MapClaims) string {
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			return idp.sign(t, claims)
+		},
+		"no expiry": func(claims jwt.MapClaims) string {
+			delete(claims, "exp")
+			return idp.sign(t, claims)
+		},
+		"unknown key": func(claims jwt.MapClaims) string {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+			token.Header["kid"] = "idp-1"
+			signed, _ := token.SignedString(otherKey)
+			return signed
+		},
+		"hs256": func(claims jwt.MapClaims) string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+			token.Header["kid"] = "idp-1"
+			signed, _ := token.SignedString([]byte("secret"))
+			return signed
+		},
+	}
+
+	for name, tamper := range cases {
+		claims := jwt.MapClaims{}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+
+		if _, err := provider.VerifyIDToken(tamper(claims), login.Nonce); err == nil {
+			t.Errorf("%s: id token should have been rejected", name)
+		}
+	}
+}
+
+func TestOIDCProvider_Groups(t *testing.T) {
+	provider := &OIDCProvider{
+		GroupsClaim: "groups",
+		AdminGroups: []string{"dns-admins"},
+		StaffGroups: []string{"dns-staff"},
+	}
+
+	staff := OIDCClaims{Groups: []string{"dns-staff"}}
+	if provider.IsAdmin(staff) || !provider.IsStaff(staff) {
+		t.Error("dns-staff member should be staff only")
+	}
+
+	nobody := OIDCClaims{Groups: []string{"engineering"}}
+	if provider.IsAdmin(nobody) || provider.IsStaff(nobody) {
+		t.Error("engineering member should be neither admin nor staff")
+	}
+}
+
+func TestOIDCProvider_UsernameFromVerifiedEmail(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+	provider := newTestOIDCProvider(idp)
+
+	state, login, _ := provider.NewLogin()
+	authURL, err := provider.AuthCodeURL(state, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.authorize(t, authURL)
+
+	cases := []struct {
+		verified interface{}
+		username string
+	}{
+		{nil, ""},
+		{false, ""},
+		{"false", ""},
+		{true, "jane@example.com"},
+		{"true", "jane@example.com"},
+	}
+
+	for _, c := range cases {
+		claims := jwt.MapClaims{}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		delete(claims, "preferred_username")
+		if c.verified != nil {
+			claims["email_verified"] = c.verified
+		}
+
+		result, err := provider.VerifyIDToken(idp.sign(t, claims), login.Nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Username != c.username {
+			t.Errorf("email_verified %v: got username %q wanted %q", c.verified, result.Username, c.username)
+		}
+	}
+}
+
+func expectOIDCLink(mock sqlmock.Sqlmock, subject string, userID int) {
+	rows := sqlmock.NewRows([]string{"user_id"})
+	if userID != 0 {
+		rows.AddRow(userID)
+	}
+	mock.ExpectQuery("FROM api_oidc_identity").WithArgs("https://idp.example.com", subject).WillReturnRows(rows)
+}
+
+func TestUser_LookupFromOIDC(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+
+	provider := &OIDCProvider{Issuer: "https://idp.example.com", CreateUsers: true, LinkByEmail: true}
+	userRow := func(admin int) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"username", "is_superuser", "is_staff", "is_active"}).AddRow("jane", admin, 0, true)
+	}
+
+	// linked by subject, whatever the username and email say
+	expectOIDCLink(mock, "sub-1", 7)
+	mock.ExpectPrepare("FROM auth_user WHERE id = ?").ExpectQuery().WithArgs(7).WillReturnRows(userRow(0))
+	mock.ExpectPrepare("UPDATE auth_user SET last_login").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+
+	user := User{}
+	if err := user.LookupFromOIDC(provider, OIDCClaims{Subject: "sub-1", Username: "admin"}, &dbConn); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 7 {
+		t.Errorf("got user %d wanted the linked user 7", user.ID)
+	}
+
+	// an unverified email or a username matching an account isn't enough
+	expectOIDCLink(mock, "sub-2", 0)
+	mock.ExpectPrepare("FROM auth_user WHERE username = ?").ExpectQuery().WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "is_superuser", "is_staff", "is_active"}).AddRow(1, 1, 1, true))
+
+	user = User{}
+	err := user.LookupFromOIDC(provider, OIDCClaims{Subject: "sub-2", Username: "admin", Email: "admin@example.com"}, &dbConn)
+	if err != ErrOIDCConflict || user.ID != 0 {
+		t.Errorf("got user %d and %v, wanted no user and %v", user.ID, err, ErrOIDCConflict)
+	}
+
+	// a verified email links the one active account with it
+	expectOIDCLink(mock, "sub-3", 0)
+	mock.ExpectQuery("FROM auth_user WHERE email = ?").WithArgs("jane@example.com").WillReturnRows(sqlmock.NewRows([]string{"id", "is_superuser", "is_staff"}).AddRow(8, 0, 0))
+	mock.ExpectExec("INSERT INTO api_oidc_identity").WithArgs("https://idp.example.com", "sub-3", 8, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare("FROM auth_user WHERE id = ?").ExpectQuery().WithArgs(8).WillReturnRows(userRow(0))
+	mock.ExpectPrepare("UPDATE auth_user SET last_login").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+
+	user = User{}
+	if err := user.LookupFromOIDC(provider, OIDCClaims{Subject: "sub-3", Username: "jane", Email: "jane@example.com", EmailVerified: true}, &dbConn); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 8 {
+		t.Errorf("got user %d wanted 8", user.ID)
+	}
+
+	// new users are created and linked together
+	expectOIDCLink(mock, "sub-4", 0)
+	mock.ExpectPrepare("FROM auth_user WHERE username = ?").ExpectQuery().WithArgs("new").WillReturnRows(sqlmock.NewRows([]string{"id", "is_superuser", "is_staff", "is_active"}))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO auth_user").WillReturnResult(sqlmock.NewResult(9, 1))
+	mock.ExpectExec("INSERT INTO api_oidc_identity").WithArgs("https://idp.example.com", "sub-4", 9, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+
+	user = User{}
+	if err := user.LookupFromOIDC(provider, OIDCClaims{Subject: "sub-4", Username: "new"}, &dbConn); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 9 || !user.Active {
+		t.Errorf("got user %+v wanted the new active user 9", user)
+	}
+
+	// losing a race for the username is a conflict, not a crash
+	expectOIDCLink(mock, "sub-5", 0)
+	mock.ExpectPrepare("FROM auth_user WHERE username = ?").ExpectQuery().WithArgs("raced").WillReturnRows(sqlmock.NewRows([]string{"id", "is_superuser", "is_staff", "is_active"}))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO auth_user").WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	mock.ExpectRollback()
+
+	user = User{}
+	if err := user.LookupFromOIDC(provider, OIDCClaims{Subject: "sub-5", Username: "raced"}, &dbConn); err != ErrOIDCConflict {
+		t.Errorf("got %v wanted %v", err, ErrOIDCConflict)
+	}
+}
+
+func TestUser_LookupFromOIDCLinkByEmail(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+
+	provider := &OIDCProvider{Issuer: "https://idp.example.com"}
+	claims := OIDCClaims{Subject: "sub-1", Email: "jane@example.com", EmailVerified: true}
+
+	// off unless configured, the email isn't even looked up
+	expectOIDCLink(mock, "sub-1", 0)
+
+	user := User{}
+	if err := user.LookupFromOIDC(provider, claims, &dbConn); err != nil || user.ID != 0 {
+		t.Errorf("got user %d and %v, wanted no user", user.ID, err)
+	}
+
+	// superuser and staff accounts are never linked by email
+	provider.LinkByEmail = true
+	for _, flags := range [][2]int{{1, 0}, {0, 1}} {
+		expectOIDCLink(mock, "sub-1", 0)
+		mock.ExpectQuery("FROM auth_user WHERE email = ?").WithArgs("jane@example.com").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "is_superuser", "is_staff"}).AddRow(1, flags[0], flags[1]))
+
+		user = User{}
+		if err := user.LookupFromOIDC(provider, claims, &dbConn); err != nil || user.ID != 0 {
+			t.Errorf("is_superuser %d is_staff %d: got user %d and %v, wanted no user", flags[0], flags[1], user.ID, err)
+		}
+	}
+
+	// nor is an email shared by several accounts
+	expectOIDCLink(mock, "sub-1", 0)
+	mock.ExpectQuery("FROM auth_user WHERE email = ?").WithArgs("jane@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "is_superuser", "is_staff"}).AddRow(8, 0, 0).AddRow(9, 0, 0))
+
+	user = User{}
+	if err := user.LookupFromOIDC(provider, claims, &dbConn); err != nil || user.ID != 0 {
+		t.Errorf("got user %d and %v, wanted no user", user.ID, err)
+	}
+}
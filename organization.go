@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Organization member roles. Owners and admins manage the organization's
+// members and teams, only owners can touch other owners or delete it.
+const (
+	orgRoleOwner  = "owner"
+	orgRoleAdmin  = "admin"
+	orgRoleMember = "member"
+)
+
+// Team member roles. Every member can manage the team's records and records in
+// its domains, maintainers also manage the team's members.
+const (
+	teamRoleMaintainer = "maintainer"
+	teamRoleMember     = "member"
+)
+
+func validOrgRole(role string) bool {
+	return role == orgRoleOwner || role == orgRoleAdmin || role == orgRoleMember
+}
+
+func validTeamRole(role string) bool {
+	return role == teamRoleMaintainer || role == teamRoleMember
+}
+
+// validGroupName -- organization and team names are 1 to 150 characters
+func validGroupName(name string) bool {
+	length := utf8.RuneCountInString(strings.TrimSpace(name))
+	return length > 0 && length <= 150
+}
+
+// orgRoleManages -- whether the role can manage members and teams
+func orgRoleManages(role string) bool {
+	return role == orgRoleOwner || role == orgRoleAdmin
+}
+
+// orgRoleCanSet -- whether a member with actorRole may change a member's role
+// from currentRole ("" when not a member yet) to newRole ("" to remove them)
+func orgRoleCanSet(actorRole string, currentRole string, newRole string) bool {
+	switch actorRole {
+	case orgRoleOwner:
+		return true
+	case orgRoleAdmin:
+		return currentRole != orgRoleOwner && newRole != orgRoleOwner
+	}
+	return false
+}
+
+// nullID -- a foreign key that is NULL when id is 0
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// Organization -- groups users and the teams records and domains can belong to
+type Organization struct {
+	ID        int                  `json:"id"`
+	Name      string               `json:"name"`
+	CreatedOn time.Time            `json:"created_on"`
+	Role      string               `json:"role,omitempty"` // the requesting user's role
+	Members   []OrganizationMember `json:"members,omitempty"`
+	Teams     []Team               `json:"teams,omitempty"`
+}
+
+// OrganizationMember -- a user's role in an organization
+type OrganizationMember struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+func (o *Organization) Save(dbConn *sql.DB) error {
+	o.CreatedOn = time.Now()
+
+	query := "INSERT INTO api_organization (name, created_on) VALUES (?, ?)"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	res, err := dq.Exec(o.Name, o.CreatedOn)
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	o.ID = int(id)
+	return nil
+}
+
+// Delete -- deletes the organization with its teams, their records and domains
+// are left without a team
+func (o *Organization) Delete(dbConn *sql.DB) error {
+	query := "DELETE FROM api_organization WHERE id = ?"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	_, err = dq.Exec(o.ID)
+	return err
+}
+
+// LookupFromID -- fills in the organization with id, ID stays 0 when there is none
+func (o *Organization) LookupFromID(id int, dbConn *sql.DB) error {
+	query := "SELECT id, name, created_on FROM api_organization WHERE id = ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	if err := dq.QueryRow(id).Scan(&o.ID, &o.Name, &o.CreatedOn); err != nil {
+		if err == sql.ErrNoRows {
+			*o = Organization{}
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// GetMembers -- the organization's members ordered by username
+func (o *Organization) GetMembers(dbConn *sql.DB) ([]OrganizationMember, error) {
+	members := []OrganizationMember{}
+
+	query := "SELECT m.user_id, u.username, m.role FROM api_organization_member m JOIN auth_user u ON u.id = m.user_id WHERE m.org_id = ? ORDER BY u.username"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer dq.Close()
+
+	rows, err := dq.Query(o.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		member := OrganizationMember{}
+		if err := rows.Scan(&member.UserID, &member.Username, &member.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// GetTeams -- the organization's teams ordered by name
+func (o *Organization) GetTeams(dbConn *sql.DB) ([]Team, error) {
+	teams := []Team{}
+
+	query := "SELECT id, org_id, name, created_on FROM api_team WHERE org_id = ? ORDER BY name"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer dq.Close()
+
+	rows, err := dq.Query(o.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		team := Team{}
+		if err := rows.Scan(&team.ID, &team.OrgID, &team.Name, &team.CreatedOn); err != nil {
+			return nil, err
+		}
+		teams = append(teams, team)
+	}
+	return teams, rows.Err()
+}
+
+// MemberRole -- the user's role in the organization, "" when they aren't a member
+func (o *Organization) MemberRole(userID int, dbConn *sql.DB) string {
+	return memberRole("SELECT role FROM api_organization_member WHERE org_id = ? AND user_id = ?", o.ID, userID, dbConn)
+}
+
+// CountOwners -- organizations must keep at least one owner
+func (o *Organization) CountOwners(dbConn *sql.DB) int {
+	return countRows("SELECT COUNT(*) FROM api_organization_member WHERE role = 'owner' AND org_id = ?", o.ID, dbConn)
+}
+
+// SetMember -- adds the user to the organization or changes their role
+func (o *Organization) SetMember(userID int, role string, dbConn *sql.DB) error {
+	query := "REPLACE INTO api_organization_member (org_id, user_id, role) VALUES (?, ?, ?)"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	_, err = dq.Exec(o.ID, userID, role)
+	return err
+}
+
+// RemoveMember -- removes the user from the organization and all of its teams
+func (o *Organization) RemoveMember(userID int, dbConn *sql.DB) (bool, error) {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM api_team_member WHERE user_id = ? AND team_id IN (SELECT id FROM api_team WHERE org_id = ?)", userID, o.ID); err != nil {
+		return false, err
+	}
+
+	res, err := tx.Exec("DELETE FROM api_organization_member WHERE org_id = ? AND user_id = ?", o.ID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return removed > 0, tx.Commit()
+}
+
+// listUserOrganizations -- the organizations the user is a member of, with
+// their role in each
+func listUserOrganizations(userID int, dbConn *sql.DB) ([]Organization, error) {
+	orgs := []Organization{}
+
+	query := "SELECT o.id, o.name, o.created_on, m.role FROM api_organization o JOIN api_organization_member m ON m.org_id = o.id WHERE m.user_id = ? ORDER BY o.name"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer dq.Close()
+
+	rows, err := dq.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		org := Organization{}
+		if err := rows.Scan(&org.ID, &org.Name, &org.CreatedOn, &org.Role); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, rows.Err()
+}
+
+// Team -- a group of organization members that can own records and domains
+type Team struct {
+	ID        int          `json:"id"`
+	OrgID     int          `json:"org_id"`
+	Name      string       `json:"name"`
+	CreatedOn time.Time    `json:"created_on"`
+	Members   []TeamMember `json:"members,omitempty"`
+}
+
+// TeamMember -- a user's role in a team
+type TeamMember struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+func (t *Team) Save(dbConn *sql.DB) error {
+	t.CreatedOn = time.Now()
+
+	query := "INSERT INTO api_team (org_id, name, created_on) VALUES (?, ?, ?)"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	res, err := dq.Exec(t.OrgID, t.Name, t.CreatedOn)
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	t.ID = int(id)
+	return nil
+}
+
+// Delete -- deletes the team, its records and domains are left without a team
+func (t *Team) Delete(dbConn *sql.DB) error {
+	query := "DELETE FROM api_team WHERE id = ?"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	_, err = dq.Exec(t.ID)
+	return err
+}
+
+// LookupFromID -- fills in the team with id, ID stays 0 when there is none
+func (t *Team) LookupFromID(id int, dbConn *sql.DB) error {
+	query := "SELECT id, org_id, name, created_on FROM api_team WHERE id = ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	if err := dq.QueryRow(id).Scan(&t.ID, &t.OrgID, &t.Name, &t.CreatedOn); err != nil {
+		if err == sql.ErrNoRows {
+			*t = Team{}
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// GetMembers -- the team's members ordered by username
+func (t *Team) GetMembers(dbConn *sql.DB) ([]TeamMember, error) {
+	members := []TeamMember{}
+
+	query := "SELECT m.user_id, u.username, m.role FROM api_team_member m JOIN auth_user u ON u.id = m.user_id WHERE m.team_id = ? ORDER BY u.username"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer dq.Close()
+
+	rows, err := dq.Query(t.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		member := TeamMember{}
+		if err := rows.Scan(&member.UserID, &member.Username, &member.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// MemberRole -- the user's role in the team, "" when they aren't a member
+func (t *Team) MemberRole(userID int, dbConn *sql.DB) string {
+	return memberRole("SELECT role FROM api_team_member WHERE team_id = ? AND user_id = ?", t.ID, userID, dbConn)
+}
+
+// SetMember -- adds the user to the team or changes their role
+func (t *Team) SetMember(userID int, role string, dbConn *sql.DB) error {
+	query := "REPLACE INTO api_team_member (team_id, user_id, role) VALUES (?, ?, ?)"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	_, err = dq.Exec(t.ID, userID, role)
+	return err
+}
+
+// RemoveMember -- removes the user from the team
+func (t *Team) RemoveMember(userID int, dbConn *sql.DB) (bool, error) {
+	query := "DELETE FROM api_team_member WHERE team_id = ? AND user_id = ?"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return false, err
+	}
+	defer dq.Close()
+
+	res, err := dq.Exec(t.ID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return removed > 0, nil
+}
+
+func memberRole(query string, groupID int, userID int, dbConn *sql.DB) string {
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dq.Close()
+
+	var role string
+	if err := dq.QueryRow(groupID, userID).Scan(&role); err != nil {
+		if err == sql.ErrNoRows {
+			return ""
+		}
+		log.Fatal(err)
+	}
+	return role
+}
+
+// orgRoleForUser -- the user's role in the organization, users allowed to
+// manage every organization act as owners
+func orgRoleForUser(user User, org Organization) string {
+	if authorize(user, PermissionOrgManage, 0) {
+		return orgRoleOwner
+	}
+	return org.MemberRole(user.ID, &dbConn)
+}
+
+// teamRoleForUser -- the user's role in the team, anyone managing the team's
+// organization acts as a maintainer
+func teamRoleForUser(user User, team Team) string {
+	if orgRoleManages(orgRoleForUser(user, Organization{ID: team.OrgID})) {
+		return teamRoleMaintainer
+	}
+	return team.MemberRole(user.ID, &dbConn)
+}
+
+// teamAllowsUser -- whether the user is a member of either team (0 for none),
+// or an owner/admin of its organization
+func teamAllowsUser(user User, teamID int, otherTeamID int) bool {
+	if teamID == 0 && otherTeamID == 0 {
+		return false
+	}
+
+	query := "SELECT COUNT(*) FROM api_team t " +
+		"LEFT JOIN api_team_member tm ON tm.team_id = t.id AND tm.user_id = ? " +
+		"LEFT JOIN api_organization_member om ON om.org_id = t.org_id AND om.user_id = ? AND om.role IN ('owner', 'admin') " +
+		"WHERE t.id IN (?, ?) AND (tm.user_id IS NOT NULL OR om.user_id IS NOT NULL)"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dq.Close()
+
+	var count int
+	if err := dq.QueryRow(user.ID, user.ID, nullID(teamID), nullID(otherTeamID)).Scan(&count); err != nil {
+		log.Fatal(err)
+	}
+	return count > 0
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOrgRoleCanSet(t *testing.T) {
+	cases := []struct {
+		actor, current, role string
+		allowed              bool
+	}{
+		{orgRoleOwner, "", orgRoleOwner, true},
+		{orgRoleOwner, orgRoleOwner, orgRoleMember, true},
+		{orgRoleOwner, orgRoleOwner, "", true},
+		{orgRoleAdmin, "", orgRoleMember, true},
+		{orgRoleAdmin, orgRoleMember, orgRoleAdmin, true},
+		{orgRoleAdmin, orgRoleAdmin, "", true},
+		{orgRoleAdmin, "", orgRoleOwner, false},
+		{orgRoleAdmin, orgRoleMember, orgRoleOwner, false},
+		{orgRoleAdmin, orgRoleOwner, orgRoleMember, false},
+		{orgRoleAdmin, orgRoleOwner, "", false},
+		{orgRoleMember, "", orgRoleMember, false},
+		{orgRoleMember, orgRoleMember, "", false},
+		{"", "", orgRoleMember, false},
+	}
+
+	for _, c := range cases {
+		if got := orgRoleCanSet(c.actor, c.current, c.role); got != c.allowed {
+			t.Errorf("%q changing %q to %q: got %v wanted %v", c.actor, c.current, c.role, got, c.allowed)
+		}
+	}
+}
+
+func TestValidGroupName(t *testing.T) {
+	expected := map[string]bool{
+		"":                       false,
+		"   ":                    false,
+		"infra":                  true,
+		"Équipe réseau":          true,
+		strings.Repeat("a", 150): true,
+		strings.Repeat("a", 151): false,
+	}
+
+	for name, valid := range expected {
+		if validGroupName(name) != valid {
+			t.Errorf("%q: got %v wanted %v", name, !valid, valid)
+		}
+	}
+}
+
+func TestNullID(t *testing.T) {
+	if id := nullID(0); id.Valid {
+		t.Errorf("0 should be NULL, got %+v", id)
+	}
+	if id := nullID(7); !id.Valid || id.Int64 != 7 {
+		t.Errorf("7 should be 7, got %+v", id)
+	}
+}
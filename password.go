@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy -- what new passwords have to look like, set by [password_policy]
+type PasswordPolicy struct {
+	MinLength int
+	// stops hashing megabytes of "password" on every login attempt
+	MaxLength        int
+	RequireLetter    bool
+	RequireDigit     bool
+	RequireMixedCase bool
+	RequireSymbol    bool
+	// reject passwords containing the username (or the other way around)
+	RejectUsername bool
+}
+
+var passwordPolicy = PasswordPolicy{
+	MinLength:      8,
+	MaxLength:      4096,
+	RejectUsername: true,
+}
+
+// Errors returned by PasswordPolicy.Validate.
+var (
+	ErrPasswordTooShort       = errors.New("password is too short")
+	ErrPasswordTooLong        = errors.New("password is too long")
+	ErrPasswordNeedsLetter    = errors.New("password must contain a letter")
+	ErrPasswordNeedsDigit     = errors.New("password must contain a digit")
+	ErrPasswordNeedsMixedCase = errors.New("password must contain upper and lower case letters")
+	ErrPasswordNeedsSymbol    = errors.New("password must contain a symbol")
+	ErrPasswordHasUsername    = errors.New("password is too similar to the username")
+)
+
+// Validate -- returns why password isn't allowed for username, nil when it is
+func (p PasswordPolicy) Validate(password string, username string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf("%w, it needs at least %d characters", ErrPasswordTooShort, p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return ErrPasswordTooLong
+	}
+
+	var letter, digit, upper, lower, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			letter = true
+			upper = upper || unicode.IsUpper(c)
+			lower = lower || unicode.IsLower(c)
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	switch {
+	case p.RequireLetter && !letter:
+		return ErrPasswordNeedsLetter
+	case p.RequireDigit && !digit:
+		return ErrPasswordNeedsDigit
+	case p.RequireMixedCase && !(upper && lower):
+		return ErrPasswordNeedsMixedCase
+	case p.RequireSymbol && !symbol:
+		return ErrPasswordNeedsSymbol
+	}
+
+	if p.RejectUsername && username != "" {
+		lowerPassword, lowerUsername := strings.ToLower(password), strings.ToLower(username)
+		if strings.Contains(lowerPassword, lowerUsername) || strings.Contains(lowerUsername, lowerPassword) {
+			return ErrPasswordHasUsername
+		}
+	}
+
+	return nil
+}
+
+var (
+	// link sent to reset a password, the token is appended as ?token=
+	passwordResetURL      string
+	passwordResetLifetime = time.Hour
+)
+
+// ChangePassword -- sets a new password and logs the user out everywhere
+func (u *User) ChangePassword(password string, dbConn *sql.DB) error {
+	if err := u.SetPassword(password, dbConn); err != nil {
+		return err
+	}
+
+	// outstanding reset links were meant for the old password
+	passwordResetInvalidate(u.ID)
+	jwtRevokeUser(u.ID)
+	return revokeUserSessions(u.ID, dbConn)
+}
+
+// SendPasswordReset -- emails the user a single use link to set a new password.
+// The mail is sent in the background, failures are only logged.
+func (u *User) SendPasswordReset(email string) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+	passwordResetSave(hashToken(token), u.ID, passwordResetLifetime)
+
+	body := fmt.Sprintf("Hi %s,\n\n"+
+		"Someone asked to reset the password of your uberdns account. Follow this\n"+
+		"link within %s to choose a new one:\n\n"+
+		"%s?token=%s\n\n"+
+		"If it wasn't you, you can ignore this email and your password stays the same.\n",
+		u.Name, passwordResetLifetime, passwordResetURL, token)
+
+	sendMailAsync(email, "Reset your uberdns password", body)
+	return nil
+}
+
+// lookupUsersFromEmail -- every active user with the email address, django
+// doesn't make them unique
+func lookupUsersFromEmail(email string, dbConn *sql.DB) ([]User, error) {
+	var users []User
+
+	query := "SELECT id, username, is_superuser, is_staff FROM auth_user WHERE email = ? AND is_active = 1"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer dq.Close()
+
+	rows, err := dq.Query(email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user := User{Active: true}
+		if err := rows.Scan(&user.ID, &user.Name, &user.Admin, &user.Staff); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPasswordPolicy_Validate(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        64,
+		RequireLetter:    true,
+		RequireDigit:     true,
+		RequireMixedCase: true,
+		RequireSymbol:    true,
+		RejectUsername:   true,
+	}
+
+	cases := []struct {
+		password string
+		err      error
+	}{
+		{"Corr3ct-horse", nil},
+		{"Sh0rt!", ErrPasswordTooShort},
+		{strings.Repeat("Aa1!", 17), ErrPasswordTooLong},
+		{"12345678!", ErrPasswordNeedsLetter},
+		{"Password!", ErrPasswordNeedsDigit},
+		{"password1!", ErrPasswordNeedsMixedCase},
+		{"Password1", ErrPasswordNeedsSymbol},
+		{"Jane.Doe-2019", ErrPasswordHasUsername},
+	}
+
+	for _, c := range cases {
+		if err := policy.Validate(c.password, "jane.doe"); !errors.Is(err, c.err) {
+			t.Errorf("%q: got %v wanted %v", c.password, err, c.err)
+		}
+	}
+}
+
+func TestPasswordPolicy_Defaults(t *testing.T) {
+	if err := passwordPolicy.Validate("lètmein!", "jane"); err != nil {
+		t.Errorf("default policy should only check the length: %v", err)
+	}
+	if err := passwordPolicy.Validate("jane", ""); !errors.Is(err, ErrPasswordTooShort) {
+		t.Errorf("got %v wanted %v", err, ErrPasswordTooShort)
+	}
+}
+
+func TestUser_ChangePasswordRevokesSessions(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+	_, resetRedis := mockRedis(t)
+	defer resetRedis()
+
+	mock.ExpectPrepare("UPDATE auth_user SET password = ?").ExpectExec().WithArgs(sqlmock.AnyArg(), 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectPrepare("UPDATE api_session SET revoked_on = ?").ExpectExec().WithArgs(sqlmock.AnyArg(), 7).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	user := User{ID: 7, Name: "jane"}
+	if err := user.ChangePassword("Correct-horse-9", &dbConn); err != nil {
+		t.Fatal(err)
+	}
+	if revokedBefore(t, 7) == 0 {
+		t.Error("tokens issued before the change should be revoked")
+	}
+}
+
+func TestRequestPasswordResetView_Throttled(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+	_, resetRedis := mockRedis(t)
+	defer resetRedis()
+
+	previous := mailer
+	sent := &MemoryMailer{}
+	mailer = sent
+	defer func() { mailer = previous }()
+
+	// the email locks out before the IP does, every request counts
+	for i := 0; i < loginThrottleUsername.LockoutAfter; i++ {
+		mock.ExpectPrepare("FROM auth_user WHERE email = ?").ExpectQuery().WithArgs("Jane@example.com").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "is_superuser", "is_staff"}).AddRow(7, "jane", false, false))
+	}
+
+	var w *httptest.ResponseRecorder
+	for i := 0; i <= loginThrottleUsername.LockoutAfter; i++ {
+		// skip the delays between requests, only the lockout matters here
+		if i < loginThrottleUsername.LockoutAfter {
+			loginThrottleReset("ip", "192.0.2.1")
+			redisClient.Del(loginThrottleKey("blocked", "email", "jane@example.com"))
+		}
+
+		r := httptest.NewRequest("POST", "/user/password/reset", bytes.NewBufferString(`{"email":"Jane@example.com"}`))
+		r.RemoteAddr = "192.0.2.1:1234"
+		w = httptest.NewRecorder()
+		requestPasswordResetView(w, r)
+	}
+	pendingMail.Wait()
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d wanted %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := len(sent.Sent()); got != loginThrottleUsername.LockoutAfter {
+		t.Errorf("got %d reset mails wanted %d", got, loginThrottleUsername.LockoutAfter)
+	}
+	if loginThrottleBlocked("username", "jane@example.com") > 0 {
+		t.Error("reset requests shouldn't lock out logins")
+	}
+}
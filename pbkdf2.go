@@ -79,6 +79,25 @@ func (h *PBKDF2Hasher) Verify(password string, encoded string) (bool, error) {
 	return hmac.Equal([]byte(newencoded), []byte(encoded)), nil
 }
 
+// Hash encodes a plain-text password with a fresh salt.
+func (h *PBKDF2Hasher) Hash(password string) (string, error) {
+	salt, err := generateSalt()
+	if err != nil {
+		return "", err
+	}
+	return h.Encode(password, salt, h.Iterations)
+}
+
+// MustUpdate if encoded was made by another algorithm, with a different number
+// of iterations or with a short salt.
+func (h *PBKDF2Hasher) MustUpdate(encoded string) bool {
+	s := strings.Split(encoded, "$")
+	if len(s) != 4 || s[0] != h.Algorithm {
+		return true
+	}
+	return s[1] != strconv.Itoa(h.Iterations) || len(s[2]) < saltLength
+}
+
 // NewPBKDF2SHA1Hasher secures password hashing using the PBKDF2 algorithm.
 //
 // Alternate PBKDF2 hasher which uses SHA1, the default PRF
@@ -32,6 +32,7 @@ func startPrometheus() {
 	}()
 
 	prometheus.MustRegister(requestGauge)
+	prometheus.MustRegister(loginBlockedCounter)
 	http.Handle("/metrics", promhttp.Handler())
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", prometheusPort), nil))
 
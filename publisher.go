@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"gitlab.com/lsoftop/api-server/cachecontrol"
+)
+
+// CachePublisher -- interface for anything capable of fanning cache control
+// messages out to the dns servers
+type CachePublisher interface {
+	Publish(msg []byte) error
+}
+
+// newCachePublisher -- returns the CachePublisher configured by the [cache] publisher key
+func newCachePublisher(kind string, redisClient *redis.Client, redisChannel string, natsHost string, natsSubject string, webhookURLs []string) (CachePublisher, error) {
+	switch kind {
+	case "", "redis":
+		return &RedisCachePublisher{
+			Client:  redisClient,
+			Channel: redisChannel,
+		}, nil
+	case "nats":
+		return &NATSCachePublisher{
+			Host:    natsHost,
+			Subject: natsSubject,
+		}, nil
+	case "webhook":
+		if len(webhookURLs) == 0 {
+			return nil, errors.New("webhook cache publisher requires at least one url")
+		}
+		return &WebhookCachePublisher{
+			URLs:   webhookURLs,
+			Client: &http.Client{Timeout: 5 * time.Second},
+		}, nil
+	case "memory":
+		return &MemoryCachePublisher{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown cache publisher: %s", kind)
+}
+
+// exampleCacheSigningKey -- the signing key config.ini ships with
+const exampleCacheSigningKey = "changeme"
+
+// newCacheSigner -- returns the signer configured by the [cache] signing_* keys.
+// HMAC keys are used as-is, ed25519 keys are a base64 encoded seed or private key.
+func newCacheSigner(algorithm string, keyID string, key string) (cachecontrol.Signer, error) {
+	if key == "" {
+		return nil, errors.New("cache signing key is not configured")
+	}
+	if key == exampleCacheSigningKey {
+		// anyone could sign messages the dns servers would act on
+		return nil, errors.New("cache signing key is still the example from config.ini")
+	}
+
+	switch algorithm {
+	case "", "hmac":
+		return &cachecontrol.HMACSigner{
+			ID:  keyID,
+			Key: []byte(key),
+		}, nil
+	case "ed25519":
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, err
+		}
+		switch len(raw) {
+		case ed25519.SeedSize:
+			return &cachecontrol.Ed25519Signer{ID: keyID, Key: ed25519.NewKeyFromSeed(raw)}, nil
+		case ed25519.PrivateKeySize:
+			return &cachecontrol.Ed25519Signer{ID: keyID, Key: ed25519.PrivateKey(raw)}, nil
+		}
+		return nil, fmt.Errorf("ed25519 cache signing key has invalid length %d", len(raw))
+	}
+
+	return nil, fmt.Errorf("unknown cache signing algorithm: %s", algorithm)
+}
+
+// SigningCachePublisher -- wraps every message in a cachecontrol.SignedMessage
+// before handing it to the underlying publisher. MaxAge is signed into every
+// message, verifiers reject it once older than that (or their own MaxAge).
+type SigningCachePublisher struct {
+	Publisher CachePublisher
+	Signer    cachecontrol.Signer
+	MaxAge    time.Duration
+}
+
+func (p *SigningCachePublisher) Publish(msg []byte) error {
+	signed, err := cachecontrol.SignWithMaxAge(p.Signer, msg, p.MaxAge)
+	if err != nil {
+		return err
+	}
+	return p.Publisher.Publish(signed)
+}
+
+// RedisCachePublisher -- publishes cache control messages over redis pub/sub
+type RedisCachePublisher struct {
+	Client  *redis.Client
+	Channel string
+}
+
+func (p *RedisCachePublisher) Publish(msg []byte) error {
+	if err := redisPublish(p.Client, p.Channel, string(msg)); err != nil {
+		return fmt.Errorf("could not publish message to redis: %v", err)
+	}
+	return nil
+}
+
+// NATSCachePublisher -- publishes cache control messages to a NATS (or NATS
+// protocol compatible) server using the plain text protocol
+type NATSCachePublisher struct {
+	Host    string
+	Subject string
+
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (p *NATSCachePublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.Host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// The server greets us with an INFO line before accepting a CONNECT
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	info, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting from nats server: %s", strings.TrimSpace(info))
+	}
+
+	if _, err = conn.Write([]byte("CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"uberdns-api-server\"}\r\n")); err != nil {
+		conn.Close()
+		return err
+	}
+
+	// Answer server keepalives so we don't get disconnected as a stale client
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "PING") {
+				p.mu.Lock()
+				conn.Write([]byte("PONG\r\n"))
+				p.mu.Unlock()
+			}
+		}
+	}()
+
+	p.conn = conn
+	return nil
+}
+
+func (p *NATSCachePublisher) Publish(msg []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "PUB %s %d\r\n", p.Subject, len(msg))
+	buf.Write(msg)
+	buf.WriteString("\r\n")
+
+	if _, err := p.conn.Write(buf.Bytes()); err != nil {
+		// drop the connection so the next publish reconnects
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// WebhookCachePublisher -- POSTs cache control messages directly to every dns node
+type WebhookCachePublisher struct {
+	URLs   []string
+	Client *http.Client
+}
+
+func (p *WebhookCachePublisher) Publish(msg []byte) error {
+	var failed []string
+	for _, url := range p.URLs {
+		resp, err := p.Client.Post(url, "application/json", bytes.NewReader(msg))
+		if err != nil {
+			failed = append(failed, url)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			failed = append(failed, url)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not publish message to webhook(s): %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// MemoryCachePublisher -- keeps published messages in memory, used by tests
+type MemoryCachePublisher struct {
+	Messages [][]byte
+	mu       sync.Mutex
+}
+
+func (p *MemoryCachePublisher) Publish(msg []byte) error {
+	p.mu.Lock()
+	p.Messages = append(p.Messages, msg)
+	p.mu.Unlock()
+	return nil
+}
+
+// Published -- returns a copy of everything published so far
+func (p *MemoryCachePublisher) Published() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	msgs := make([][]byte, len(p.Messages))
+	copy(msgs, p.Messages)
+	return msgs
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Quota names, as used in the [quotas] config section and quota errors
+const (
+	quotaRecordsPerUser   = "records_per_user"
+	quotaRecordsPerDomain = "records_per_domain"
+	quotaAPICallsPerDay   = "api_calls_per_day"
+)
+
+// Quotas -- limits on what a user can do, 0 is unlimited
+type Quotas struct {
+	RecordsPerUser   int
+	RecordsPerDomain int
+	APICallsPerDay   int
+}
+
+// defaultQuotas -- set by [quotas], apply unless a user has an override
+var defaultQuotas Quotas
+
+// QuotaOverride -- per user limits set by admins, nil fields use the default
+type QuotaOverride struct {
+	UserID         int  `json:"user_id"`
+	RecordsPerUser *int `json:"records_per_user"`
+	APICallsPerDay *int `json:"api_calls_per_day"`
+}
+
+// Save -- replaces the user's override, removing it when neither limit is set
+func (o *QuotaOverride) Save(dbConn *sql.DB) error {
+	query := "REPLACE INTO api_user_quota (user_id, records_per_user, api_calls_per_day) VALUES (?, ?, ?)"
+	if o.RecordsPerUser == nil && o.APICallsPerDay == nil {
+		query = "DELETE FROM api_user_quota WHERE user_id = ?"
+	}
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	if o.RecordsPerUser == nil && o.APICallsPerDay == nil {
+		_, err = dq.Exec(o.UserID)
+	} else {
+		_, err = dq.Exec(o.UserID, o.RecordsPerUser, o.APICallsPerDay)
+	}
+	return err
+}
+
+// GetQuotas -- the defaults with the user's override applied
+func (u *User) GetQuotas(dbConn *sql.DB) Quotas {
+	quotas := defaultQuotas
+
+	query := "SELECT records_per_user, api_calls_per_day FROM api_user_quota WHERE user_id = ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dq.Close()
+
+	var recordsPerUser, apiCallsPerDay sql.NullInt64
+	if err := dq.QueryRow(u.ID).Scan(&recordsPerUser, &apiCallsPerDay); err != nil {
+		if err == sql.ErrNoRows {
+			return quotas
+		}
+		log.Fatal(err)
+	}
+
+	if recordsPerUser.Valid {
+		quotas.RecordsPerUser = int(recordsPerUser.Int64)
+	}
+	if apiCallsPerDay.Valid {
+		quotas.APICallsPerDay = int(apiCallsPerDay.Int64)
+	}
+	return quotas
+}
+
+// CountRecords -- how many records the user owns
+func (u *User) CountRecords(dbConn *sql.DB) int {
+	return countRows("SELECT COUNT(*) FROM dns_record WHERE owner_id = ?", u.ID, dbConn)
+}
+
+// CountRecords -- how many records the domain holds
+func (d *Domain) CountRecords(dbConn *sql.DB) int {
+	return countRows("SELECT COUNT(*) FROM dns_record WHERE domain_id = ?", d.ID, dbConn)
+}
+
+func countRows(query string, id int, dbConn *sql.DB) int {
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dq.Close()
+
+	var count int
+	if err := dq.QueryRow(id).Scan(&count); err != nil {
+		log.Fatal(err)
+	}
+	return count
+}
+
+// QuotaUsage -- a limit next to how much of it is used, a limit of 0 is unlimited
+type QuotaUsage struct {
+	Limit int `json:"limit"`
+	Usage int `json:"usage"`
+}
+
+// Exceeded -- whether nothing more may be used
+func (q QuotaUsage) Exceeded() bool {
+	return q.Limit > 0 && q.Usage >= q.Limit
+}
+
+// GetQuotaUsage -- the user's per user quotas and their usage
+func (u *User) GetQuotaUsage(dbConn *sql.DB) map[string]QuotaUsage {
+	quotas := u.GetQuotas(dbConn)
+	return map[string]QuotaUsage{
+		quotaRecordsPerUser: {Limit: quotas.RecordsPerUser, Usage: u.CountRecords(dbConn)},
+		quotaAPICallsPerDay: {Limit: quotas.APICallsPerDay, Usage: quotaAPICalls(u.ID, quotaDay(time.Now()))},
+	}
+}
+
+// quotaDay -- API calls are counted per UTC day
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// writeQuotaExceeded -- the error for a request over quota, with the usage
+func writeQuotaExceeded(w http.ResponseWriter, status int, quota string, usage QuotaUsage) {
+	quotaError := struct {
+		Error string `json:"error"`
+		Quota string `json:"quota"`
+		QuotaUsage
+	}{
+		Error:      "quota exceeded",
+		Quota:      quota,
+		QuotaUsage: usage,
+	}
+
+	quotaErrorJSON, err := json.Marshal(quotaError)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(quotaErrorJSON)
+}
+
+// checkAPICallQuota -- counts an API call by the user, writes the error and
+// returns false once they are over their daily quota
+func checkAPICallQuota(w http.ResponseWriter, userID int) bool {
+	now := time.Now()
+	calls := quotaCountAPICall(userID, quotaDay(now))
+
+	user := User{ID: userID}
+	usage := QuotaUsage{Limit: user.GetQuotas(&dbConn).APICallsPerDay, Usage: calls - 1}
+	if !usage.Exceeded() {
+		return true
+	}
+
+	midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	w.Header().Add("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+	writeQuotaExceeded(w, http.StatusTooManyRequests, quotaAPICallsPerDay, QuotaUsage{Limit: usage.Limit, Usage: usage.Limit})
+	return false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQuotaUsage_Exceeded(t *testing.T) {
+	cases := []struct {
+		usage    QuotaUsage
+		exceeded bool
+	}{
+		{QuotaUsage{Limit: 0, Usage: 1000000}, false},
+		{QuotaUsage{Limit: 10, Usage: 9}, false},
+		{QuotaUsage{Limit: 10, Usage: 10}, true},
+		{QuotaUsage{Limit: 10, Usage: 11}, true},
+	}
+
+	for _, c := range cases {
+		if c.usage.Exceeded() != c.exceeded {
+			t.Errorf("%+v: got %v wanted %v", c.usage, !c.exceeded, c.exceeded)
+		}
+	}
+}
+
+func TestQuotaDay(t *testing.T) {
+	// 8pm on the 1st in New York is already the 2nd in UTC
+	day := quotaDay(time.Date(2019, 11, 1, 20, 0, 0, 0, time.FixedZone("EST", -5*60*60)))
+	if day != "2019-11-02" {
+		t.Errorf("got %s wanted 2019-11-02", day)
+	}
+}
+
+func TestWriteQuotaExceeded(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeQuotaExceeded(rr, http.StatusForbidden, quotaRecordsPerUser, QuotaUsage{Limit: 100, Usage: 100})
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	expected := `{"error":"quota exceeded","quota":"records_per_user","limit":100,"usage":100}`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v wanted %v", rr.Body.String(), expected)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Permission -- something a role allows its users to do
+type Permission string
+
+const (
+	// PermissionRecordCreate -- create records, only checked when open record creation is disabled
+	PermissionRecordCreate Permission = "record.create"
+	// PermissionRecordUpdate -- update records owned by someone else
+	PermissionRecordUpdate Permission = "record.update"
+	// PermissionRecordDelete -- delete records owned by someone else
+	PermissionRecordDelete Permission = "record.delete"
+	// PermissionRecordTransfer -- transfer anyone's records, granted for every
+	// domain the recipient doesn't have to accept
+	PermissionRecordTransfer Permission = "record.transfer"
+	// PermissionRecordListAll -- list every record
+	PermissionRecordListAll Permission = "record.list_all"
+	// PermissionCachePurge -- purge the entire cache
+	PermissionCachePurge Permission = "cache.purge"
+	// PermissionCachePurgeRecord -- purge records owned by someone else from the cache
+	PermissionCachePurgeRecord Permission = "cache.purge_record"
+	PermissionDomainCreate     Permission = "domain.create"
+	PermissionDomainDelete     Permission = "domain.delete"
+	PermissionDomainList       Permission = "domain.list"
+	// PermissionDomainTeam -- hand domains to a team
+	PermissionDomainTeam Permission = "domain.team"
+	// PermissionRoleManage -- assign and revoke roles
+	PermissionRoleManage Permission = "role.manage"
+	// PermissionUserInvite -- create invite codes for invite only registration
+	PermissionUserInvite Permission = "user.invite"
+	// PermissionUserManage -- list, view, disable and enable users. Only
+	// superusers can change the superuser and staff flags.
+	PermissionUserManage Permission = "user.manage"
+	// PermissionUserImpersonate -- act as another user, only superusers can
+	// impersonate superusers
+	PermissionUserImpersonate Permission = "user.impersonate"
+	// PermissionOrgManage -- manage every organization and team as if their owner
+	PermissionOrgManage Permission = "org.manage"
+	// PermissionAuditView -- read the audit log
+	PermissionAuditView Permission = "audit.view"
+)
+
+var allPermissions = []Permission{
+	PermissionRecordCreate,
+	PermissionRecordUpdate,
+	PermissionRecordDelete,
+	PermissionRecordTransfer,
+	PermissionRecordListAll,
+	PermissionCachePurge,
+	PermissionCachePurgeRecord,
+	PermissionDomainCreate,
+	PermissionDomainDelete,
+	PermissionDomainList,
+	PermissionDomainTeam,
+	PermissionRoleManage,
+	PermissionUserInvite,
+	PermissionUserManage,
+	PermissionUserImpersonate,
+	PermissionOrgManage,
+	PermissionAuditView,
+}
+
+// roles -- permissions granted by each role, extended/overridden by the [roles] config section
+var roles = map[string][]Permission{
+	"admin": allPermissions,
+	"domain_manager": {
+		PermissionRecordCreate,
+		PermissionRecordUpdate,
+		PermissionRecordDelete,
+		PermissionRecordListAll,
+		PermissionCachePurgeRecord,
+		PermissionDomainList,
+	},
+	"auditor": {
+		PermissionRecordListAll,
+		PermissionDomainList,
+		PermissionAuditView,
+	},
+}
+
+// openRecordCreation -- whether any user can create records, otherwise record.create is required
+var openRecordCreation = true
+
+// loadRoles -- adds the roles defined in the [roles] config section, each key
+// is a role name and its value a comma separated list of permissions
+func loadRoles(definitions map[string]string) {
+	for role, permissions := range definitions {
+		var granted []Permission
+		for _, permission := range strings.Split(permissions, ",") {
+			if permission = strings.TrimSpace(permission); permission != "" {
+				granted = append(granted, Permission(permission))
+			}
+		}
+		roles[role] = granted
+	}
+}
+
+func roleHasPermission(role string, permission Permission) bool {
+	for _, granted := range roles[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// UserRole -- a role assigned to a user, for a single domain when DomainID is set
+type UserRole struct {
+	ID       int    `json:"id"`
+	UserID   int    `json:"user_id"`
+	Role     string `json:"role"`
+	DomainID int    `json:"domain_id,omitempty"`
+}
+
+func (ur *UserRole) Save(dbConn *sql.DB) error {
+	query := "INSERT INTO api_user_role (user_id, role, domain_id) VALUES (?, ?, ?)"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer dq.Close()
+
+	domainID := sql.NullInt64{Int64: int64(ur.DomainID), Valid: ur.DomainID != 0}
+	res, err := dq.Exec(ur.UserID, ur.Role, domainID)
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	ur.ID = int(id)
+	return nil
+}
+
+// LookupFromID -- fills in the role assignment with id, ID stays 0 when there
+// is none
+func (ur *UserRole) LookupFromID(id int, dbConn *sql.DB) error {
+	query := "SELECT id, user_id, role, domain_id FROM api_user_role WHERE id = ?"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer dq.Close()
+
+	var domainID sql.NullInt64
+	if err := dq.QueryRow(id).Scan(&ur.ID, &ur.UserID, &ur.Role, &domainID); err != nil {
+		if err == sql.ErrNoRows {
+			*ur = UserRole{}
+			return nil
+		}
+		return err
+	}
+	ur.DomainID = int(domainID.Int64)
+	return nil
+}
+
+func (ur *UserRole) Delete(dbConn *sql.DB) (bool, error) {
+	query := "DELETE FROM api_user_role WHERE id = ?"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return false, err
+	}
+
+	defer dq.Close()
+
+	res, err := dq.Exec(ur.ID)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, nil
+}
+
+func (u *User) GetRoles(dbConn *sql.DB) []UserRole {
+	userRoles := []UserRole{}
+	query := "SELECT id, role, domain_id FROM api_user_role WHERE user_id = ? ORDER BY id"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer dq.Close()
+
+	rows, err := dq.Query(u.ID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		userRole := UserRole{UserID: u.ID}
+		var domainID sql.NullInt64
+		if err := rows.Scan(&userRole.ID, &userRole.Role, &domainID); err != nil {
+			log.Fatal(err)
+		}
+		userRole.DomainID = int(domainID.Int64)
+		userRoles = append(userRoles, userRole)
+	}
+
+	return userRoles
+}
+
+// authorize -- whether the user holds permission, through a role assigned
+// everywhere or for domainID. Pass a domainID of 0 for checks that don't
+// concern a single domain. Superusers hold every permission, staff only those
+// of their roles.
+func authorize(user User, permission Permission, domainID int) bool {
+	if (User{}) == user {
+		return false
+	}
+
+	if user.Admin {
+		return true
+	}
+
+	return rolesGrant(user.GetRoles(&dbConn), permission, domainID)
+}
+
+// rolesGrant -- whether any of the roles, assigned everywhere or for domainID,
+// grants permission
+func rolesGrant(userRoles []UserRole, permission Permission, domainID int) bool {
+	for _, userRole := range userRoles {
+		if userRole.DomainID != 0 && userRole.DomainID != domainID {
+			continue
+		}
+		if roleHasPermission(userRole.Role, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// canGrantRole -- whether the user may assign or revoke role (for domainID,
+// or everywhere when 0). Nobody can hand out permissions they don't hold.
+func canGrantRole(user User, role string, domainID int) bool {
+	if !authorize(user, PermissionRoleManage, 0) {
+		return false
+	}
+	if user.Admin {
+		return true
+	}
+
+	userRoles := user.GetRoles(&dbConn)
+	for _, permission := range roles[role] {
+		if !rolesGrant(userRoles, permission, domainID) {
+			return false
+		}
+	}
+	return true
+}
+
+// authorizeRecord -- owners can do anything to their records, everyone else
+// needs permission for the record's domain
+func authorizeRecord(user User, permission Permission, record Record) bool {
+	if (User{}) == user {
+		return false
+	}
+
+	return record.IsUserAllowed(user) || authorize(user, permission, record.DomainID)
+}
+
+// roleNames -- every known role, sorted
+func roleNames() []string {
+	var names []string
+	for role := range roles {
+		names = append(names, role)
+	}
+	sort.Strings(names)
+	return names
+}
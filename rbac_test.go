@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func expectRoles(mock sqlmock.Sqlmock, userID int, roles ...UserRole) {
+	rows := sqlmock.NewRows([]string{"id", "role", "domain_id"})
+	for _, userRole := range roles {
+		var domainID interface{}
+		if userRole.DomainID != 0 {
+			domainID = userRole.DomainID
+		}
+		rows.AddRow(userRole.ID, userRole.Role, domainID)
+	}
+	mock.ExpectPrepare("FROM api_user_role WHERE user_id = ?").ExpectQuery().WithArgs(userID).WillReturnRows(rows)
+}
+
+func TestAuthorize(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+
+	if authorize(User{}, PermissionDomainList, 0) {
+		t.Error("authorized nobody")
+	}
+
+	if !authorize(User{ID: 1, Admin: true}, PermissionUserImpersonate, 0) {
+		t.Error("superusers should hold every permission")
+	}
+
+	// staff only hold the permissions of their roles
+	expectRoles(mock, 2)
+	if authorize(User{ID: 2, Staff: true}, PermissionRoleManage, 0) {
+		t.Error("authorized staff without any role")
+	}
+
+	expectRoles(mock, 3, UserRole{ID: 1, Role: "auditor"})
+	if !authorize(User{ID: 3}, PermissionAuditView, 0) {
+		t.Error("a role assigned everywhere should apply to every check")
+	}
+
+	expectRoles(mock, 3, UserRole{ID: 1, Role: "auditor"})
+	if authorize(User{ID: 3}, PermissionDomainDelete, 0) {
+		t.Error("authorized a permission the role doesn't grant")
+	}
+
+	expectRoles(mock, 4, UserRole{ID: 2, Role: "domain_manager", DomainID: 7})
+	if !authorize(User{ID: 4}, PermissionRecordDelete, 7) {
+		t.Error("a domain role should apply to its domain")
+	}
+
+	expectRoles(mock, 4, UserRole{ID: 2, Role: "domain_manager", DomainID: 7})
+	if authorize(User{ID: 4}, PermissionRecordDelete, 8) {
+		t.Error("a domain role shouldn't apply to other domains")
+	}
+
+	expectRoles(mock, 4, UserRole{ID: 2, Role: "domain_manager", DomainID: 7})
+	if authorize(User{ID: 4}, PermissionDomainList, 0) {
+		t.Error("a domain role shouldn't apply to checks outside a domain")
+	}
+}
+
+func TestAuthorizeRecord(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+
+	record := Record{ID: 1, DomainID: 7, OwnerID: 3}
+
+	if authorizeRecord(User{}, PermissionRecordUpdate, record) {
+		t.Error("authorized nobody")
+	}
+
+	if !authorizeRecord(User{ID: 3}, PermissionRecordUpdate, record) {
+		t.Error("owners should manage their records")
+	}
+
+	// neither the record nor its domain belong to a team
+	expectDomain := func() {
+		mock.ExpectPrepare("FROM dns_domain WHERE id = ?").ExpectQuery().WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "created_on", "team_id"}).AddRow(7, "example.com", testRecord.CreatedOn, nil))
+	}
+
+	expectDomain()
+	expectRoles(mock, 4, UserRole{ID: 2, Role: "domain_manager", DomainID: 7})
+	if !authorizeRecord(User{ID: 4}, PermissionRecordUpdate, record) {
+		t.Error("a domain manager should manage the domain's records")
+	}
+
+	expectDomain()
+	expectRoles(mock, 5, UserRole{ID: 3, Role: "domain_manager", DomainID: 8})
+	if authorizeRecord(User{ID: 5}, PermissionRecordUpdate, record) {
+		t.Error("authorized the manager of another domain")
+	}
+}
+
+func TestCanGrantRole(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+
+	previous := roles["role_manager"]
+	roles["role_manager"] = []Permission{PermissionRoleManage, PermissionRecordListAll, PermissionDomainList}
+	defer func() { roles["role_manager"] = previous }()
+
+	if !canGrantRole(User{ID: 1, Admin: true}, "admin", 0) {
+		t.Error("superusers should grant any role")
+	}
+
+	expectRoles(mock, 2)
+	if canGrantRole(User{ID: 2, Staff: true}, "auditor", 0) {
+		t.Error("staff without role.manage shouldn't grant roles")
+	}
+
+	manager := []UserRole{{ID: 1, Role: "role_manager"}}
+
+	expectRoles(mock, 3, manager...)
+	expectRoles(mock, 3, manager...)
+	if canGrantRole(User{ID: 3}, "admin", 0) {
+		t.Error("granted a role with permissions the granter lacks")
+	}
+
+	expectRoles(mock, 3, manager...)
+	expectRoles(mock, 3, manager...)
+	if canGrantRole(User{ID: 3}, "auditor", 0) {
+		t.Error("granted audit.view without holding it")
+	}
+
+	expectRoles(mock, 3, manager...)
+	expectRoles(mock, 3, manager...)
+	if !canGrantRole(User{ID: 3}, "role_manager", 0) {
+		t.Error("should grant a role whose permissions the granter holds")
+	}
+
+	// domain roles only need the permissions for that domain
+	domainManager := append(manager, UserRole{ID: 2, Role: "domain_manager", DomainID: 7})
+
+	expectRoles(mock, 3, domainManager...)
+	expectRoles(mock, 3, domainManager...)
+	if !canGrantRole(User{ID: 3}, "domain_manager", 7) {
+		t.Error("should grant the domain role held for the same domain")
+	}
+
+	expectRoles(mock, 3, domainManager...)
+	expectRoles(mock, 3, domainManager...)
+	if canGrantRole(User{ID: 3}, "domain_manager", 8) {
+		t.Error("granted a domain role for another domain")
+	}
+
+	expectRoles(mock, 3, domainManager...)
+	expectRoles(mock, 3, domainManager...)
+	if canGrantRole(User{ID: 3}, "domain_manager", 0) {
+		t.Error("granted a domain role everywhere")
+	}
+}
+
+func TestUpdateRecordView_NotFound(t *testing.T) {
+	mock, done := mockDB(t)
+	defer done()
+
+	views := []struct {
+		method string
+		view   http.HandlerFunc
+	}{
+		{"POST", updateRecordView},
+		{"DELETE", deleteRecordView},
+	}
+
+	// a missing record is a 404 before any permission is checked, so no roles
+	// are looked up
+	for _, v := range views {
+		expectUser(mock, 7, 0, 0, true)
+		mock.ExpectPrepare("FROM dns_domain WHERE name = ?").ExpectQuery().WithArgs("example.com").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "created_on", "team_id"}).AddRow(3, "example.com", time.Now(), nil))
+		mock.ExpectPrepare("FROM dns_record WHERE name = ?").ExpectQuery().WithArgs("missing", 3).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "ip_address", "ttl", "created_on", "owner_id", "team_id"}))
+
+		req := httptest.NewRequest(v.method, "/record", strings.NewReader(`{"Name": "missing.example.com", "IPAddress": "192.0.2.1"}`))
+		req = withVerifiedToken(req, JWTToken{UserID: 7})
+		w := httptest.NewRecorder()
+		v.view(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d wanted %d", v.method, w.Code, http.StatusNotFound)
+		}
+	}
+}
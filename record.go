@@ -24,7 +24,7 @@ func recordExists(dbConn *sql.DB, record Record) bool {
 }
 
 func (r *Record) Save(dbConn *sql.DB) error {
-	query := "INSERT INTO dns_record (name, ip_address, ttl, created_on, domain_id, owner_id) VALUES (?, ?, ?,  ?, ?, ?)"
+	query := "INSERT INTO dns_record (name, ip_address, ttl, created_on, domain_id, owner_id, team_id) VALUES (?, ?, ?,  ?, ?, ?, ?)"
 	dq, err := dbConn.Prepare(query)
 	if err != nil {
 		return err
@@ -32,14 +32,52 @@ func (r *Record) Save(dbConn *sql.DB) error {
 
 	defer dq.Close()
 
-	_, err = dq.Exec(r.Name, r.IP, r.TTL, r.CreatedOn, r.DomainID, r.OwnerID)
+	_, err = dq.Exec(r.Name, r.IP, r.TTL, r.CreatedOn, r.DomainID, r.OwnerID, nullID(r.TeamID))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (r *Record) Cache(channel chan<- CacheControlMessage) error {
+// Update -- persists changes made to an existing record
+func (r *Record) Update(dbConn *sql.DB) error {
+	query := "UPDATE dns_record SET name = ?, ip_address = ?, ttl = ?, domain_id = ?, owner_id = ?, team_id = ? WHERE id = ?"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer dq.Close()
+
+	_, err = dq.Exec(r.Name, r.IP, r.TTL, r.DomainID, r.OwnerID, nullID(r.TeamID), r.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// negativeCacheEntry -- object of the negative cache purge messages, Name is a FQDN
+type negativeCacheEntry struct {
+	Name string `json:"name"`
+}
+
+// Cache -- caches the record in domain. Any negative answers the dns servers
+// hold for the record's FQDN and its parent domain are purged first so the new
+// record is served straight away instead of a cached NXDOMAIN.
+func (r *Record) Cache(channel chan<- CacheControlMessage, domain Domain) error {
+	for _, name := range []string{r.Name + "." + domain.Name, domain.Name} {
+		jsonMSG, err := json.Marshal(negativeCacheEntry{Name: name})
+		if err != nil {
+			return err
+		}
+
+		channel <- CacheControlMessage{
+			Action: "purge",
+			Type:   "negative",
+			Object: string(jsonMSG),
+		}
+	}
+
 	jsonMSG, err := json.Marshal(r)
 	if err != nil {
 		return err
@@ -54,6 +92,29 @@ func (r *Record) Cache(channel chan<- CacheControlMessage) error {
 	return nil
 }
 
+// CacheUpdate -- replaces the cached previous state of the record with its
+// current state in a single message, so there is no gap where neither is served
+func (r *Record) CacheUpdate(channel chan<- CacheControlMessage, previous Record) error {
+	jsonMSG, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	previousJSON, err := json.Marshal(previous)
+	if err != nil {
+		return err
+	}
+
+	msg := CacheControlMessage{
+		Action:   "update",
+		Type:     "record",
+		Object:   string(jsonMSG),
+		Previous: string(previousJSON),
+	}
+	channel <- msg
+	return nil
+}
+
 func (r *Record) Delete(dbConn *sql.DB) error {
 	query := "DELETE FROM dns_record WHERE id = ?"
 	dq, err := dbConn.Prepare(query)
@@ -73,16 +134,22 @@ func (r *Record) Delete(dbConn *sql.DB) error {
 	return nil
 }
 
+// splitFQDN -- the record name and the domain it's looked up in, the first
+// label is the record and the rest its domain
+func splitFQDN(fqdn string) (string, string) {
+	labels := strings.Split(fqdn, ".")
+	return labels[0], strings.Join(labels[1:], ".")
+}
+
 func (r *Record) LookupFromFQDN(fqdn string) error {
-	recordName := strings.Split(fqdn, ".")[0]
-	topLevelDomain := strings.Join(strings.Split(fqdn, ".")[1:], ".")
+	recordName, topLevelDomain := splitFQDN(fqdn)
 
 	domain := Domain{}
 	if err := domain.LookupFromFQDN(topLevelDomain); err != nil {
 		log.Fatal(err)
 	}
 
-	query := "SELECT id, name, ip_address, ttl, created_on, owner_id FROM dns_record WHERE name = ? AND domain_id = ?"
+	query := "SELECT id, name, ip_address, ttl, created_on, owner_id, team_id FROM dns_record WHERE name = ? AND domain_id = ?"
 
 	dq, err := dbConn.Prepare(query)
 
@@ -92,7 +159,8 @@ func (r *Record) LookupFromFQDN(fqdn string) error {
 
 	defer dq.Close()
 
-	err = dq.QueryRow(recordName, domain.ID).Scan(&r.ID, &r.Name, &r.IP, &r.TTL, &r.CreatedOn, &r.OwnerID)
+	var teamID sql.NullInt64
+	err = dq.QueryRow(recordName, domain.ID).Scan(&r.ID, &r.Name, &r.IP, &r.TTL, &r.CreatedOn, &r.OwnerID, &teamID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			fmt.Println("Unable to find record with that FQDN.")
@@ -100,6 +168,8 @@ func (r *Record) LookupFromFQDN(fqdn string) error {
 		}
 		log.Fatal(err)
 	}
+	r.DomainID = domain.ID
+	r.TeamID = int(teamID.Int64)
 
 	return nil
 }
@@ -120,17 +190,24 @@ func (r *Record) Purge(channel chan<- CacheControlMessage) error {
 	return nil
 }
 
+// IsUserAllowed -- owners can manage their records, and so can the members of
+// the team the record or its domain belongs to
 func (r *Record) IsUserAllowed(user User) bool {
 	if r.OwnerID == user.ID {
 		return true
 	}
 
-	return false
+	domain := Domain{}
+	if err := domain.LookupFromID(r.DomainID); err != nil {
+		log.Fatal(err)
+	}
+
+	return teamAllowsUser(user, r.TeamID, domain.TeamID)
 }
 
 func listRecords(dbConn *sql.DB) []Record {
 	var records []Record
-	query := "SELECT id, name, ip_address, ttl, created_on, owner_id FROM dns_record"
+	query := "SELECT id, name, ip_address, ttl, created_on, owner_id, team_id FROM dns_record"
 
 	rows, err := dbConn.Query(query)
 	if err != nil {
@@ -139,9 +216,11 @@ func listRecords(dbConn *sql.DB) []Record {
 	defer rows.Close()
 	for rows.Next() {
 		record := Record{}
-		if err := rows.Scan(&record.ID, &record.Name, &record.IP, &record.TTL, &record.CreatedOn, &record.OwnerID); err != nil {
+		var teamID sql.NullInt64
+		if err := rows.Scan(&record.ID, &record.Name, &record.IP, &record.TTL, &record.CreatedOn, &record.OwnerID, &teamID); err != nil {
 			log.Fatal(err)
 		}
+		record.TeamID = int(teamID.Int64)
 		records = append(records, record)
 	}
 
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -10,13 +13,8 @@ import (
 var redisClient *redis.Client
 var redisCacheChannelName string
 
-func redisPublish(redisClient *redis.Client, redisChannel string, msg string) bool {
-	err := redisClient.Publish(redisChannel, msg).Err()
-	if err != nil {
-		log.Fatal(err)
-		return false
-	}
-	return true
+func redisPublish(redisClient *redis.Client, redisChannel string, msg string) error {
+	return redisClient.Publish(redisChannel, msg).Err()
 }
 
 func redisConnect(redisHost string, redisPassword string, redisDB int) *redis.Client {
@@ -44,3 +42,292 @@ func redisConnect(redisHost string, redisPassword string, redisDB int) *redis.Cl
 
 	return redisClient
 }
+
+// jwtMarkRefreshTokenUsed -- records that the refresh token jti has been
+// exchanged, returns false when it already had been
+func jwtMarkRefreshTokenUsed(jti string, expiresAt time.Time) (bool, error) {
+	return redisClient.SetNX(fmt.Sprintf("jwt:refresh:used:%s", jti), 1, time.Until(expiresAt)).Result()
+}
+
+// jwtRevokeFamily -- stops every token in the family from being refreshed
+func jwtRevokeFamily(family string) {
+	log.Warnf("[JWT] Revoking token family %s", family)
+	// outlive every refresh token that could have been issued in the family
+	err := redisClient.Set(fmt.Sprintf("jwt:family:revoked:%s", family), 1, refreshTokenLifetime).Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// jwtFamilyIsRevoked -- errors are returned rather than fatal as this is
+// checked on every authenticated request
+func jwtFamilyIsRevoked(family string) (bool, error) {
+	revoked, err := redisClient.Exists(fmt.Sprintf("jwt:family:revoked:%s", family)).Result()
+	return revoked > 0, err
+}
+
+// jwtRevokeToken -- denylists the token jti until it would have expired anyway
+func jwtRevokeToken(jti string, expiresAt time.Time) {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return
+	}
+
+	err := redisClient.Set(fmt.Sprintf("jwt:revoked:%s", jti), 1, ttl).Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func jwtTokenIsRevoked(jti string) (bool, error) {
+	revoked, err := redisClient.Exists(fmt.Sprintf("jwt:revoked:%s", jti)).Result()
+	return revoked > 0, err
+}
+
+// jwtRevokeUser -- revokes every token issued to the user up until now
+func jwtRevokeUser(userID int) {
+	log.Infof("[JWT] Revoking all tokens for user %d", userID)
+	// once every token issued before now has expired there is nothing left to reject
+	err := redisClient.Set(fmt.Sprintf("jwt:user:%d:revoked_before_ms", userID), unixMilli(time.Now()), longestTokenLifetime()).Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// jwtUserRevokedBefore -- tokens issued to the user up until the returned unix
+// time in milliseconds are revoked
+func jwtUserRevokedBefore(userID int) (int64, error) {
+	value, err := redisClient.Get(fmt.Sprintf("jwt:user:%d:revoked_before_ms", userID)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// totpMarkStepUsed -- records that the user's TOTP code for step has been
+// used, returns false when it already had been
+func totpMarkStepUsed(userID int, step uint64, ttl time.Duration) bool {
+	used, err := redisClient.SetNX(fmt.Sprintf("totp:used:%d:%d", userID, step), 1, ttl).Result()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return used
+}
+
+// oidcSaveLogin -- remembers an OIDC login in progress under its state parameter
+func oidcSaveLogin(state string, login OIDCLoginState) {
+	loginJSON, err := json.Marshal(login)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = redisClient.Set(fmt.Sprintf("oidc:state:%s", state), loginJSON, oidcLoginLifetime).Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// oidcTakeLogin -- returns and forgets the OIDC login stored under state, so
+// each state can only complete one login
+func oidcTakeLogin(state string) (OIDCLoginState, bool) {
+	login := OIDCLoginState{}
+
+	value, ok := redisTake(fmt.Sprintf("oidc:state:%s", state))
+	if !ok {
+		return login, false
+	}
+
+	if err := json.Unmarshal([]byte(value), &login); err != nil {
+		log.Fatal(err)
+	}
+	return login, true
+}
+
+// redisTake -- gets and deletes key in one transaction, so only one caller
+// ever sees the value
+func redisTake(key string) (string, bool) {
+	var get *redis.StringCmd
+	_, err := redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.Get(key)
+		pipe.Del(key)
+		return nil
+	})
+	if err == redis.Nil {
+		return "", false
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	return get.Val(), true
+}
+
+// loginThrottleFail -- counts a failed login for the scope's key, returns the
+// failures within the window
+func loginThrottleFail(scope string, key string, window time.Duration) int {
+	failKey := loginThrottleKey("failures", scope, key)
+
+	failures, err := redisClient.Incr(failKey).Result()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if failures == 1 {
+		if err := redisClient.Expire(failKey, window).Err(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return int(failures)
+}
+
+// loginThrottleBlock -- refuses logins for the scope's key for d
+func loginThrottleBlock(scope string, key string, d time.Duration) {
+	log.Warnf("[LOGIN] Blocking %s %s for %s", scope, key, d)
+	err := redisClient.Set(loginThrottleKey("blocked", scope, key), 1, d).Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loginThrottleBlocked -- how long logins for the scope's key are still refused
+func loginThrottleBlocked(scope string, key string) time.Duration {
+	ttl, err := redisClient.PTTL(loginThrottleKey("blocked", scope, key)).Result()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// negative when the key doesn't exist or has no expiry
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+func loginThrottleReset(scope string, key string) {
+	err := redisClient.Del(loginThrottleKey("failures", scope, key), loginThrottleKey("blocked", scope, key)).Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// registrationSaveConfirmation -- remembers which user an emailed confirmation
+// token (by its hash) activates
+func registrationSaveConfirmation(tokenHash string, userID int, ttl time.Duration) {
+	err := redisClient.Set(fmt.Sprintf("registration:confirm:%s", tokenHash), userID, ttl).Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// registrationDiscardConfirmation -- forgets a confirmation token that was
+// never delivered
+func registrationDiscardConfirmation(tokenHash string) {
+	err := redisClient.Del(fmt.Sprintf("registration:confirm:%s", tokenHash)).Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// registrationTakeConfirmation -- returns and forgets the user a confirmation
+// token activates
+func registrationTakeConfirmation(tokenHash string) (int, bool) {
+	value, ok := redisTake(fmt.Sprintf("registration:confirm:%s", tokenHash))
+	if !ok {
+		return 0, false
+	}
+
+	userID, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return userID, true
+}
+
+// passwordResetSave -- remembers which user an emailed reset token (by its
+// hash) is for. Only the latest token sent to a user is valid.
+func passwordResetSave(tokenHash string, userID int, ttl time.Duration) {
+	_, err := redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(fmt.Sprintf("password:reset:token:%s", tokenHash), userID, ttl)
+		pipe.Set(fmt.Sprintf("password:reset:user:%d", userID), tokenHash, ttl)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// passwordResetLookup -- the user a reset token is for, without using it up
+func passwordResetLookup(tokenHash string) (int, bool) {
+	value, err := redisClient.Get(fmt.Sprintf("password:reset:token:%s", tokenHash)).Result()
+	if err == redis.Nil {
+		return 0, false
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	userID, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return userID, passwordResetIsLatest(tokenHash, userID)
+}
+
+// passwordResetTake -- returns the user a reset token is for and uses it up
+func passwordResetTake(tokenHash string) (int, bool) {
+	value, ok := redisTake(fmt.Sprintf("password:reset:token:%s", tokenHash))
+	if !ok {
+		return 0, false
+	}
+
+	userID, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return userID, passwordResetIsLatest(tokenHash, userID)
+}
+
+func passwordResetIsLatest(tokenHash string, userID int) bool {
+	latest, err := redisClient.Get(fmt.Sprintf("password:reset:user:%d", userID)).Result()
+	if err == redis.Nil {
+		return false
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	return latest == tokenHash
+}
+
+// passwordResetInvalidate -- stops every reset token sent to the user from working
+func passwordResetInvalidate(userID int) {
+	err := redisClient.Del(fmt.Sprintf("password:reset:user:%d", userID)).Err()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// quotaCountAPICall -- counts an API call by the user on day, returns the
+// calls made that day including this one
+func quotaCountAPICall(userID int, day string) int {
+	key := fmt.Sprintf("quota:api:%d:%s", userID, day)
+
+	calls, err := redisClient.Incr(key).Result()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if calls == 1 {
+		// long enough for every timezone's idea of the day to be over
+		if err := redisClient.Expire(key, 48*time.Hour).Err(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return int(calls)
+}
+
+// quotaAPICalls -- the API calls made by the user on day
+func quotaAPICalls(userID int, day string) int {
+	calls, err := redisClient.Get(fmt.Sprintf("quota:api:%d:%s", userID, day)).Int()
+	if err == redis.Nil {
+		return 0
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	return calls
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"time"
+	"unicode/utf8"
+)
+
+// Registration modes, set by [registration] mode
+const (
+	registrationClosed = "closed"
+	registrationOpen   = "open"
+	registrationInvite = "invite"
+)
+
+var (
+	registrationMode = registrationClosed
+	// link sent to confirm an account, the token is appended as ?token=
+	registrationConfirmURL      string
+	registrationConfirmLifetime = 48 * time.Hour
+)
+
+// Errors returned when validating a registration.
+var (
+	ErrInvalidUsername = errors.New("usernames are up to 150 letters, digits and @/./+/-/_ characters")
+	ErrInvalidEmail    = errors.New("invalid email address")
+	ErrUsernameTaken   = errors.New("username is already taken")
+	ErrInvalidInvite   = errors.New("invalid invite code")
+	// the account isn't created, nor the invite code used, without it
+	ErrConfirmationNotSent = errors.New("unable to send the confirmation email")
+)
+
+// usernamePattern -- what django's UnicodeUsernameValidator accepts
+var usernamePattern = regexp.MustCompile(`^[\p{L}\p{N}_.@+-]+$`)
+
+func validateUsername(username string) error {
+	if utf8.RuneCountInString(username) > 150 || !usernamePattern.MatchString(username) {
+		return ErrInvalidUsername
+	}
+	return nil
+}
+
+func validateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return ErrInvalidEmail
+	}
+	return nil
+}
+
+// generateToken -- a random url safe token, only its sha256 is ever stored
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Register -- creates the user as inactive with password encoded by the
+// preferred hasher and emails them the link to confirm their email, which
+// activates them. With an inviteCode it's claimed along with creating the
+// user, so registrations that fail don't use it up. The mail is sent before
+// committing, when it can't be the user isn't created and
+// ErrConfirmationNotSent is returned, so the username and invite aren't held
+// by an account that can never be activated.
+func (u *User) Register(username string, email string, password string, inviteCode string, dbConn *sql.DB) error {
+	existing := User{}
+	existing.LookupFromName(username)
+	if existing.ID != 0 {
+		return ErrUsernameTaken
+	}
+
+	encoded, err := preferredPasswordHasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if inviteCode != "" {
+		claimed, err := claimInviteCode(tx, inviteCode)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return ErrInvalidInvite
+		}
+	}
+
+	query := "INSERT INTO auth_user (password, is_superuser, username, first_name, last_name, email, is_staff, is_active, date_joined) VALUES (?, 0, ?, '', '', ?, 0, 0, ?)"
+
+	result, err := tx.Exec(query, encoded, username, email, time.Now())
+	if err != nil {
+		// registered by someone else since the check above
+		if isDuplicateKeyError(err) {
+			return ErrUsernameTaken
+		}
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if inviteCode != "" {
+		if err := setInviteCodeUser(tx, inviteCode, int(id)); err != nil {
+			return err
+		}
+	}
+
+	created := User{ID: int(id), Name: username}
+	tokenHash, err := created.sendConfirmation(email)
+	if err != nil {
+		fmt.Printf("Unable to send the confirmation email to %s: %v\n", email, err)
+		return ErrConfirmationNotSent
+	}
+	if err := tx.Commit(); err != nil {
+		registrationDiscardConfirmation(tokenHash)
+		return err
+	}
+
+	*u = created
+	return nil
+}
+
+// sendConfirmation -- emails the user a link to activate their account,
+// returns the hash of the token in it
+func (u *User) sendConfirmation(email string) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	tokenHash := hashToken(token)
+	registrationSaveConfirmation(tokenHash, u.ID, registrationConfirmLifetime)
+
+	body := fmt.Sprintf("Hi %s,\n\n"+
+		"Confirm your uberdns account by following this link within %s:\n\n"+
+		"%s?token=%s\n\n"+
+		"If you didn't sign up you can ignore this email.\n",
+		u.Name, registrationConfirmLifetime, registrationConfirmURL, token)
+
+	if err := mailer.Send(email, "Confirm your uberdns account", body); err != nil {
+		registrationDiscardConfirmation(tokenHash)
+		return "", err
+	}
+	return tokenHash, nil
+}
+
+// Activate -- marks the user active so they can log in
+func (u *User) Activate(dbConn *sql.DB) error {
+	query := "UPDATE auth_user SET is_active = 1 WHERE id = ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	if _, err = dq.Exec(u.ID); err != nil {
+		return err
+	}
+	u.Active = true
+	return nil
+}
+
+// InviteCode -- lets someone register while registration is invite only
+type InviteCode struct {
+	ID          int        `json:"id"`
+	Code        string     `json:"code,omitempty"` // only set when the code is created
+	CreatedByID int        `json:"created_by_id"`
+	CreatedOn   time.Time  `json:"created_on"`
+	ExpiresOn   *time.Time `json:"expires_on"`
+}
+
+// Save -- generates the code and stores its hash
+func (i *InviteCode) Save(dbConn *sql.DB) error {
+	code, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	i.CreatedOn = time.Now()
+
+	query := "INSERT INTO api_invite_code (code_hash, created_by_id, created_on, expires_on) VALUES (?, ?, ?, ?)"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	result, err := dq.Exec(hashToken(code), i.CreatedByID, i.CreatedOn, i.ExpiresOn)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	i.ID = int(id)
+	i.Code = code
+	return nil
+}
+
+// claimInviteCode -- marks code used, returns false when it doesn't exist, has
+// expired or was already used. Claiming in one UPDATE makes it single use.
+func claimInviteCode(db execer, code string) (bool, error) {
+	query := "UPDATE api_invite_code SET used_on = ? WHERE code_hash = ? AND used_on IS NULL AND (expires_on IS NULL OR expires_on > ?)"
+
+	now := time.Now()
+	result, err := db.Exec(query, now, hashToken(code), now)
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return claimed == 1, nil
+}
+
+// setInviteCodeUser -- records who registered with a claimed code
+func setInviteCodeUser(db execer, code string, userID int) error {
+	query := "UPDATE api_invite_code SET used_by_id = ? WHERE code_hash = ?"
+	_, err := db.Exec(query, userID, hashToken(code))
+	return err
+}
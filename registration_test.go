@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestValidateUsername(t *testing.T) {
+	valid := []string{"jane", "jane.doe+dns@example.com", "Zoë_99", strings.Repeat("a", 150)}
+	for _, username := range valid {
+		if err := validateUsername(username); err != nil {
+			t.Errorf("%q should be valid: %v", username, err)
+		}
+	}
+
+	invalid := []string{"", "jane doe", "jane/doe", "<script>", strings.Repeat("a", 151)}
+	for _, username := range invalid {
+		if err := validateUsername(username); err != ErrInvalidUsername {
+			t.Errorf("%q should be invalid", username)
+		}
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	if err := validateEmail("jane@example.com"); err != nil {
+		t.Errorf("plain address should be valid: %v", err)
+	}
+
+	for _, email := range []string{"", "jane", "Jane <jane@example.com>", "jane@example.com\r\nBcc: everyone@example.com"} {
+		if err := validateEmail(email); err != ErrInvalidEmail {
+			t.Errorf("%q should be invalid", email)
+		}
+	}
+}
+
+func TestBuildMailMessage(t *testing.T) {
+	msg := string(buildMailMessage("uberdns <noreply@lsof.top>", "jane@example.com\r\nBcc: everyone@example.com", "Confirm your account", "line one\nline two\n", time.Date(2019, 11, 1, 12, 0, 0, 0, time.UTC)))
+
+	headers := strings.SplitN(msg, "\r\n\r\n", 2)[0]
+	if strings.Contains(headers, "\r\nBcc:") {
+		t.Errorf("header injection through the recipient: %q", headers)
+	}
+	if !strings.HasSuffix(msg, "\r\n\r\nline one\r\nline two\r\n") {
+		t.Errorf("body should use CRLF line endings: %q", msg)
+	}
+}
+
+func expectNoUser(mock sqlmock.Sqlmock, username string) {
+	mock.ExpectPrepare("FROM auth_user WHERE username = ?").ExpectQuery().WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "is_superuser", "is_staff", "is_active"}))
+}
+
+func TestUser_RegisterWithInvite(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+	_, resetRedis := mockRedis(t)
+	defer resetRedis()
+
+	previous := mailer
+	sent := &MemoryMailer{}
+	mailer = sent
+	defer func() { mailer = previous }()
+
+	expectNoUser(mock, "jane")
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE api_invite_code SET used_on").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO auth_user").WillReturnResult(sqlmock.NewResult(5, 1))
+	mock.ExpectExec("UPDATE api_invite_code SET used_by_id").WithArgs(5, hashToken("invite")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	user := User{}
+	if err := user.Register("jane", "jane@example.com", "Correct-horse-9", "invite", &dbConn); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 5 || user.Active {
+		t.Errorf("got %+v wanted inactive user 5", user)
+	}
+	if msgs := sent.Sent(); len(msgs) != 1 || msgs[0].To != "jane@example.com" {
+		t.Errorf("got %+v wanted a confirmation email to jane@example.com", msgs)
+	}
+}
+
+func TestUser_RegisterMailFails(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+	server, resetRedis := mockRedis(t)
+	defer resetRedis()
+
+	previous := mailer
+	mailer = noMailer{}
+	defer func() { mailer = previous }()
+
+	// nothing is committed, so the username and invite code stay free
+	expectNoUser(mock, "jane")
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE api_invite_code SET used_on").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO auth_user").WillReturnResult(sqlmock.NewResult(5, 1))
+	mock.ExpectExec("UPDATE api_invite_code SET used_by_id").WithArgs(5, hashToken("invite")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	user := User{}
+	if err := user.Register("jane", "jane@example.com", "Correct-horse-9", "invite", &dbConn); err != ErrConfirmationNotSent {
+		t.Errorf("got %v wanted %v", err, ErrConfirmationNotSent)
+	}
+	if user.ID != 0 {
+		t.Errorf("got %+v wanted no user", user)
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("undelivered confirmation tokens kept: %v", keys)
+	}
+}
+
+func TestUser_RegisterKeepsInviteOnFailure(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+
+	// the username was taken between the check and the insert, the claimed
+	// invite code is rolled back with it
+	expectNoUser(mock, "jane")
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE api_invite_code SET used_on").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO auth_user").WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	mock.ExpectRollback()
+
+	user := User{}
+	if err := user.Register("jane", "jane@example.com", "Correct-horse-9", "invite", &dbConn); err != ErrUsernameTaken {
+		t.Errorf("got %v wanted %v", err, ErrUsernameTaken)
+	}
+
+	// an invalid code doesn't create the user
+	expectNoUser(mock, "john")
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE api_invite_code SET used_on").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	if err := user.Register("john", "john@example.com", "Correct-horse-9", "used", &dbConn); err != ErrInvalidInvite {
+		t.Errorf("got %v wanted %v", err, ErrInvalidInvite)
+	}
+}
+
+func TestNewMailer_NoHost(t *testing.T) {
+	m, err := newMailer("", 587, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Send("jane@example.com", "subject", "body"); err != ErrMailNotConfigured {
+		t.Errorf("got %v wanted mail to be refused rather than dropped", err)
+	}
+}
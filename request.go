@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
@@ -10,6 +11,12 @@ import (
 type requestRecord struct {
 	Name      string
 	IPAddress string
+	TeamID    int // on create, hands the record to a team the user is in
+}
+
+// requestFQDN -- a received api request naming a record by its FQDN
+type requestFQDN struct {
+	FQDN string
 }
 
 func (ri *RequestCounter) Inc() {
@@ -63,42 +70,112 @@ func RequestHasBearerToken(r *http.Request) bool {
 	return false
 }
 
+// getJWTFromRequest -- returns the raw JWT presented as the token cookie or as
+// a bearer token, cookie first
+func getJWTFromRequest(r *http.Request) string {
+	for _, c := range r.Cookies() {
+		if "token" == c.Name {
+			return c.Value
+		}
+	}
+
+	if parts := strings.Split(r.Header.Get("Authorization"), "Bearer"); len(parts) > 1 {
+		return strings.Trim(parts[1], " ")
+	}
+
+	return ""
+}
+
+// getUserFromRequest -- the user making the request, empty when there is none.
+// Behind requestMiddleware this is the user of the access token it checked, so
+// nothing is left that could fail. Elsewhere a token whose revocation couldn't
+// be checked is refused, views without the middleware should use
+// userFromRequest to answer that with a 503.
 func getUserFromRequest(r *http.Request) User {
+	user, err := userFromRequest(r)
+	if err != nil {
+		fmt.Printf("Unable to check the request's token: %v\n", err)
+		return User{}
+	}
+	return user
+}
+
+// userFromRequest -- the user making the request, the error is set when the
+// token's revocation couldn't be checked
+func userFromRequest(r *http.Request) (User, error) {
 	var user User
 	if RequestHasAPIKey(r) {
 		accessToken := getAPIKey(r)
-		user.LookupFromAPIKey(accessToken)
+		apiKey := user.LookupFromAPIKey(accessToken)
+		if allowed, _ := apiKey.Allows(r); !allowed {
+			// outside of the key's scopes, act as if nobody is logged in
+			user = User{}
+		}
 	}
 
-	if RequestHasBearerToken(r) {
-		for _, c := range r.Cookies() {
-			if "token" == c.Name {
-				var jwtToken = JWTToken{}
-				jwtToken.LookupFromString(c.Value)
-				if jwtToken.IsValid() {
-					user.ID = jwtToken.UserID
-					user.LookupFromID()
-					break
-				}
+	if jwtToken, ok := r.Context().Value(verifiedTokenKey).(JWTToken); ok {
+		user = userFromJWT(jwtToken)
+	} else if RequestHasBearerToken(r) {
+		for _, tokenStr := range requestJWTs(r) {
+			var jwtToken = JWTToken{}
+			jwtToken.LookupFromString(tokenStr)
+			valid, err := jwtToken.IsValid()
+			if err != nil {
+				return User{}, err
+			}
+			if valid && jwtToken.TokenType == "access" {
+				user = userFromJWT(jwtToken)
+				break
 			}
 		}
+	} else {
+		return user, nil
+	}
 
-		for k := range r.Header {
-			if k == "Authorization" {
-				bearerToken := strings.Split(r.Header.Get(k), "Bearer")[1]
-				bearerToken = strings.Trim(bearerToken, " ")
-				var jwtToken = JWTToken{}
-				jwtToken.LookupFromString(bearerToken)
-				if jwtToken.IsValid() {
-					user.ID = jwtToken.UserID
-					user.LookupFromID()
-					break
-				}
+	// tokens of disabled users are revoked, this covers the window until then
+	if !user.Active {
+		user = User{}
+	}
+
+	return user, nil
+}
+
+// requestJWTs -- the token cookies and bearer token presented, in the order
+// they are tried
+func requestJWTs(r *http.Request) []string {
+	var tokens []string
+	for _, c := range r.Cookies() {
+		if "token" == c.Name {
+			tokens = append(tokens, c.Value)
+		}
+	}
+
+	for k := range r.Header {
+		if k == "Authorization" {
+			if parts := strings.Split(r.Header.Get(k), "Bearer"); len(parts) > 1 {
+				tokens = append(tokens, strings.Trim(parts[1], " "))
 			}
 		}
 	}
+	return tokens
+}
 
-	return user
+type contextKey int
+
+// verifiedTokenKey -- holds the access token requestMiddleware checked
+const verifiedTokenKey contextKey = iota
+
+// withVerifiedToken -- passes the checked access token on to the view, so
+// getUserFromRequest doesn't have to check it again
+func withVerifiedToken(r *http.Request, jwtToken JWTToken) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), verifiedTokenKey, jwtToken))
+}
+
+// writeServiceUnavailable -- answers requests that can't be checked because
+// redis is unreachable, refusing them rather than letting them through
+func writeServiceUnavailable(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("503 - Service Unavailable"))
 }
 
 func requestMiddleware(next http.HandlerFunc) http.HandlerFunc {
@@ -132,15 +209,28 @@ func requestMiddleware(next http.HandlerFunc) http.HandlerFunc {
 				// Check whether presented token is valid
 				jwtToken := JWTToken{}
 				jwtToken.LookupFromString(c.Value)
-				if !jwtToken.IsValid() {
+				valid, err := jwtToken.IsValid()
+				if err != nil {
+					fmt.Printf("Unable to check token revocation: %v\n", err)
+					writeServiceUnavailable(w)
+					return
+				}
+				if !valid || jwtToken.TokenType != "access" {
 					unauthorizedRequestCounter.Inc()
 					w.WriteHeader(http.StatusUnauthorized)
 					//w.WriteHeader(http.StatusUnauthorized)
 					return
 				}
+				if !checkAPICallQuota(w, jwtToken.ActingUserID()) {
+					return
+				}
+				if jwtToken.ActAs != 0 && !allowImpersonatedRequest(w, jwtToken, r) {
+					return
+				}
 				// Increment authorized request counter
 				requestCounter.Inc()
-				next.ServeHTTP(w, r)
+				next.ServeHTTP(w, withVerifiedToken(r, jwtToken))
+				return
 			}
 		}
 
@@ -157,14 +247,26 @@ func requestMiddleware(next http.HandlerFunc) http.HandlerFunc {
 				}
 				jwtToken := JWTToken{}
 				jwtToken.LookupFromString(bearerToken)
-				if !jwtToken.IsValid() {
+				valid, err := jwtToken.IsValid()
+				if err != nil {
+					fmt.Printf("Unable to check token revocation: %v\n", err)
+					writeServiceUnavailable(w)
+					return
+				}
+				if !valid || jwtToken.TokenType != "access" {
 					unauthorizedRequestCounter.Inc()
 					w.WriteHeader(http.StatusUnauthorized)
 					return
 				}
 				// Hey its a valid jwt token!
+				if !checkAPICallQuota(w, jwtToken.ActingUserID()) {
+					return
+				}
+				if jwtToken.ActAs != 0 && !allowImpersonatedRequest(w, jwtToken, r) {
+					return
+				}
 				requestCounter.Inc()
-				next.ServeHTTP(w, r)
+				next.ServeHTTP(w, withVerifiedToken(r, jwtToken))
 				return
 			}
 		}
@@ -185,5 +287,27 @@ func requestMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			unauthorizedRequestCounter.Inc()
 			return
 		}
+
+		user := User{}
+		apiKey := user.LookupFromAPIKey(getAPIKey(r))
+		allowed, err := apiKey.Allows(r)
+		if err != nil {
+			unauthorizedRequestCounter.Inc()
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+		if (User{}) == user || !allowed {
+			unauthorizedRequestCounter.Inc()
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		if !checkAPICallQuota(w, user.ID) {
+			return
+		}
+		requestCounter.Inc()
+		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ScryptHasher implements django's ScryptPasswordHasher, encoded as
+// "scrypt$<work factor>$<salt>$<block size>$<parallelism>$<base64 hash>".
+type ScryptHasher struct {
+	// Defines the CPU/memory cost, must be a power of 2.
+	WorkFactor  int
+	BlockSize   int
+	Parallelism int
+	// Defines the length of the hash in bytes.
+	Size int
+}
+
+// Verify if a plain-text password matches the encoded digest.
+func (h *ScryptHasher) Verify(password string, encoded string) (bool, error) {
+	s := strings.Split(encoded, "$")
+	if len(s) != 6 {
+		return false, ErrHashComponentMismatch
+	}
+
+	if s[0] != "scrypt" {
+		return false, ErrAlgorithmMismatch
+	}
+
+	workFactor, err := strconv.Atoi(s[1])
+	if err != nil {
+		return false, ErrHashComponentUnreadable
+	}
+	blockSize, err := strconv.Atoi(s[3])
+	if err != nil {
+		return false, ErrHashComponentUnreadable
+	}
+	parallelism, err := strconv.Atoi(s[4])
+	if err != nil {
+		return false, ErrHashComponentUnreadable
+	}
+	expected, err := base64.StdEncoding.DecodeString(s[5])
+	if err != nil {
+		return false, ErrHashComponentUnreadable
+	}
+
+	hash, err := scrypt.Key([]byte(password), []byte(s[2]), workFactor, blockSize, parallelism, len(expected))
+	if err != nil {
+		return false, ErrHashComponentUnreadable
+	}
+
+	return subtle.ConstantTimeCompare(hash, expected) == 1, nil
+}
+
+// Hash encodes a plain-text password with a fresh salt.
+func (h *ScryptHasher) Hash(password string) (string, error) {
+	salt, err := generateSalt()
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := scrypt.Key([]byte(password), []byte(salt), h.WorkFactor, h.BlockSize, h.Parallelism, h.Size)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("scrypt$%d$%s$%d$%d$%s", h.WorkFactor, salt, h.BlockSize, h.Parallelism,
+		base64.StdEncoding.EncodeToString(hash)), nil
+}
+
+// MustUpdate if encoded was made by another algorithm, with different costs or
+// with a short salt.
+func (h *ScryptHasher) MustUpdate(encoded string) bool {
+	s := strings.Split(encoded, "$")
+	if len(s) != 6 || s[0] != "scrypt" {
+		return true
+	}
+	return s[1] != strconv.Itoa(h.WorkFactor) || s[3] != strconv.Itoa(h.BlockSize) ||
+		s[4] != strconv.Itoa(h.Parallelism) || len(s[2]) < saltLength
+}
+
+// NewScryptHasher secures password hashing using scrypt with django's default
+// parameters.
+func NewScryptHasher() *ScryptHasher {
+	return &ScryptHasher{
+		WorkFactor:  1 << 14,
+		BlockSize:   8,
+		Parallelism: 1,
+		Size:        64,
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// Session -- a login, the refresh tokens issued for it share Family. It's used
+// whenever its refresh token is exchanged, so LastUsedOn is up to an access
+// token lifetime behind.
+type Session struct {
+	ID         int       `json:"id"`
+	Family     string    `json:"-"`
+	UserID     int       `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedOn  time.Time `json:"created_on"`
+	LastUsedOn time.Time `json:"last_used_on"`
+	ExpiresOn  time.Time `json:"expires_on"`
+	Current    bool      `json:"current"` // whether the request was made from this session
+}
+
+const sessionColumns = "id, family, user_id, user_agent, ip_address, created_on, last_used_on, expires_on"
+
+func (s *Session) scan(row interface{ Scan(...interface{}) error }) error {
+	return row.Scan(&s.ID, &s.Family, &s.UserID, &s.UserAgent, &s.IPAddress, &s.CreatedOn, &s.LastUsedOn, &s.ExpiresOn)
+}
+
+// truncateUserAgent -- user agents are stored up to 512 characters
+func truncateUserAgent(userAgent string) string {
+	if utf8.RuneCountInString(userAgent) <= 512 {
+		return userAgent
+	}
+	return string([]rune(userAgent)[:512])
+}
+
+// saveSession -- records the login the tokens were issued for, or that it was
+// used again when they were refreshed
+func saveSession(r *http.Request, jwtTokens JWTTokens, dbConn *sql.DB) error {
+	now := time.Now()
+
+	query := "INSERT INTO api_session (family, user_id, user_agent, ip_address, created_on, last_used_on, expires_on) VALUES (?, ?, ?, ?, ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE user_agent = VALUES(user_agent), ip_address = VALUES(ip_address), last_used_on = VALUES(last_used_on), expires_on = VALUES(expires_on)"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	_, err = dq.Exec(jwtTokens.Family, jwtTokens.RefreshToken.UserID, truncateUserAgent(r.UserAgent()), clientIP(r), now, now, time.Unix(jwtTokens.RefreshToken.ExpiresAt, 0))
+	return err
+}
+
+// IsRevoked -- whether the session was logged out, revoked after its refresh
+// token was reused, or its user was logged out everywhere since it was last used
+func (s *Session) IsRevoked() (bool, error) {
+	if revoked, err := jwtFamilyIsRevoked(s.Family); revoked || err != nil {
+		return revoked, err
+	}
+
+	revokedBefore, err := jwtUserRevokedBefore(s.UserID)
+	if err != nil {
+		return false, err
+	}
+	return unixMilli(s.LastUsedOn) <= revokedBefore, nil
+}
+
+// listUserSessions -- the user's sessions that can still be refreshed, most
+// recently used first
+func listUserSessions(userID int, dbConn *sql.DB) ([]Session, error) {
+	sessions := []Session{}
+
+	query := "SELECT " + sessionColumns + " FROM api_session WHERE user_id = ? AND revoked_on IS NULL AND expires_on > ? ORDER BY last_used_on DESC"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer dq.Close()
+
+	rows, err := dq.Query(userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		session := Session{}
+		if err := session.scan(rows); err != nil {
+			return nil, err
+		}
+		revoked, err := session.IsRevoked()
+		if err != nil {
+			return nil, err
+		}
+		if !revoked {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, rows.Err()
+}
+
+// LookupFromID -- fills in the user's session with id, ID stays 0 when they
+// have none
+func (s *Session) LookupFromID(id int, userID int, dbConn *sql.DB) error {
+	query := "SELECT " + sessionColumns + " FROM api_session WHERE id = ? AND user_id = ? AND revoked_on IS NULL"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	if err := s.scan(dq.QueryRow(id, userID)); err != nil {
+		if err == sql.ErrNoRows {
+			*s = Session{}
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Revoke -- logs the session out, its access and refresh tokens stop working
+func (s *Session) Revoke(dbConn *sql.DB) error {
+	jwtRevokeFamily(s.Family)
+	return revokeSessionFamily(s.Family, dbConn)
+}
+
+// revokeUserSessions -- marks every session of a user whose tokens were all
+// revoked as revoked
+func revokeUserSessions(userID int, dbConn *sql.DB) error {
+	query := "UPDATE api_session SET revoked_on = ? WHERE user_id = ? AND revoked_on IS NULL"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	_, err = dq.Exec(time.Now(), userID)
+	return err
+}
+
+// revokeSessionFamily -- marks the session of a revoked token family as revoked
+func revokeSessionFamily(family string, dbConn *sql.DB) error {
+	query := "UPDATE api_session SET revoked_on = ? WHERE family = ? AND revoked_on IS NULL"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	_, err = dq.Exec(time.Now(), family)
+	return err
+}
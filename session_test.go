@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestTruncateUserAgent(t *testing.T) {
+	if got := truncateUserAgent("curl/7.68.0"); got != "curl/7.68.0" {
+		t.Errorf("got %q wanted curl/7.68.0", got)
+	}
+
+	// multi byte characters mustn't be cut in half
+	got := truncateUserAgent(strings.Repeat("é", 600))
+	if utf8.RuneCountInString(got) != 512 || !utf8.ValidString(got) {
+		t.Errorf("got %d characters, valid utf8 %v, wanted 512 valid", utf8.RuneCountInString(got), utf8.ValidString(got))
+	}
+}
+
+func TestSession_JSONHidesFamily(t *testing.T) {
+	sessionJSON, err := json.Marshal(Session{ID: 1, Family: "6f1c2a5e-secret-family", UserID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(sessionJSON), "6f1c2a5e") || strings.Contains(string(sessionJSON), "user_id") {
+		t.Errorf("session exposes its family or user: %s", sessionJSON)
+	}
+}
+
+func sessionRows(sessions ...Session) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "family", "user_id", "user_agent", "ip_address", "created_on", "last_used_on", "expires_on"})
+	for _, s := range sessions {
+		rows.AddRow(s.ID, s.Family, s.UserID, s.UserAgent, s.IPAddress, s.CreatedOn, s.LastUsedOn, s.ExpiresOn)
+	}
+	return rows
+}
+
+func TestListUserSessions(t *testing.T) {
+	mock, done := mockDB(t)
+	defer done()
+	_, reset := mockRedis(t)
+	defer reset()
+
+	jwtRevokeUser(3)
+	revokedAt := time.Unix(0, revokedBefore(t, 3)*int64(time.Millisecond))
+	jwtRevokeFamily("logged-out")
+
+	expiresOn := time.Now().Add(refreshTokenLifetime)
+	active := Session{ID: 1, Family: "active", UserID: 3, LastUsedOn: revokedAt.Add(time.Millisecond), ExpiresOn: expiresOn}
+	loggedOut := Session{ID: 2, Family: "logged-out", UserID: 3, LastUsedOn: revokedAt.Add(time.Millisecond), ExpiresOn: expiresOn}
+	atRevocation := Session{ID: 3, Family: "stale", UserID: 3, LastUsedOn: revokedAt, ExpiresOn: expiresOn}
+
+	// revoked and expired sessions are left out by the query itself
+	mock.ExpectPrepare(`WHERE user_id = \? AND revoked_on IS NULL AND expires_on > \?`).ExpectQuery().
+		WithArgs(3, sqlmock.AnyArg()).
+		WillReturnRows(sessionRows(active, loggedOut, atRevocation))
+
+	sessions, err := listUserSessions(3, &dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != active.ID {
+		t.Errorf("got %+v wanted only session %d", sessions, active.ID)
+	}
+}
+
+func TestSession_Revoke(t *testing.T) {
+	mock, done := mockDB(t)
+	defer done()
+	_, reset := mockRedis(t)
+	defer reset()
+	defer useTestKeyring(t)()
+
+	tokens := JWTTokens{}
+	tokens.New(3)
+	other := JWTTokens{}
+	other.New(3)
+
+	mock.ExpectPrepare("UPDATE api_session SET revoked_on").ExpectExec().
+		WithArgs(sqlmock.AnyArg(), tokens.Family).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	session := Session{ID: 1, Family: tokens.Family, UserID: 3}
+	if err := session.Revoke(&dbConn); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isRevoked(t, tokens.AccessToken) || !isRevoked(t, tokens.RefreshToken) {
+		t.Error("the revoked session's tokens should be revoked")
+	}
+	if isRevoked(t, other.AccessToken) || isRevoked(t, other.RefreshToken) {
+		t.Error("revoking a session shouldn't revoke the user's other sessions")
+	}
+}
+
+func TestRevokeSessionView_OtherUsersSession(t *testing.T) {
+	mock, done := mockDB(t)
+	defer done()
+	_, reset := mockRedis(t)
+	defer reset()
+	defer useTestKeyring(t)()
+
+	tokens := JWTTokens{}
+	tokens.New(3)
+
+	expectUser(mock, 3, 0, 0, true)
+	// session 9 belongs to someone else, so it isn't found for user 3
+	mock.ExpectPrepare(`FROM api_session WHERE id = \? AND user_id = \?`).ExpectQuery().
+		WithArgs(9, 3).
+		WillReturnRows(sessionRows())
+
+	r := httptest.NewRequest("DELETE", "/user/session/revoke", strings.NewReader(`{"ID": 9}`))
+	r.Header.Set("Authorization", "Bearer "+tokens.AccessToken.String())
+	w := httptest.NewRecorder()
+	revokeSessionView(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d wanted %d", w.Code, http.StatusNotFound)
+	}
+}
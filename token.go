@@ -1,86 +1,95 @@
 package main
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"fmt"
-	"log"
 	"time"
 )
 
+// Token -- struct for storing information regarding a key in django's
+// authtoken_token table. These are stored in plaintext, so a hashed copy is
+// kept in api_key the first time they are used. The row is left for django,
+// emptying authtoken_token retires every legacy key (see the README).
 type Token struct {
 	Key       string
 	CreatedOn time.Time
 	UserID    int64
 }
 
-// Re-write this as one large exists and valid check
+// LookupFromKey -- finds the authtoken_token row matching key. Rows are found
+// by prefix and compared in constant time, Key is left empty when there is none.
+func (t *Token) LookupFromKey(key string) error {
+	token, err := findToken(key, &dbConn)
+	if err != nil {
+		return err
+	}
+	*t = token
+	return nil
+}
+
+func findToken(key string, dbConn *sql.DB) (Token, error) {
+	// a shorter prefix would match, and have to compare against, many more rows
+	if len(key) < apiKeyPrefixLength {
+		return Token{}, nil
+	}
 
-func tokenExists(dbConn *sql.DB, user User) bool {
-	var ret int
-	query := "SELECT COUNT(*) FROM authtoken_token WHERE user_id = ?"
-	err := dbConn.QueryRow(query, user.ID).Scan(&ret)
+	query := "SELECT `key`, created, user_id FROM authtoken_token WHERE `key` LIKE CONCAT(?, '%')"
 
+	dq, err := dbConn.Prepare(query)
 	if err != nil {
-		log.Fatal(err)
+		return Token{}, err
 	}
 
-	if ret > 0 {
-		return true
-	}
-	return false
-}
+	defer dq.Close()
 
-func tokenIsValid(dbConn *sql.DB, token Token) bool {
-	var retToken Token
-	query := "SELECT key, created, user_id FROM authtoken_token WHERE key = ?"
-	err := dbConn.QueryRow(query, token.Key).Scan(&retToken.Key, &retToken.CreatedOn, &retToken.UserID)
+	rows, err := dq.Query(escapeLike(apiKeyPrefix(key)))
 	if err != nil {
-		log.Fatal(err)
+		return Token{}, err
 	}
+	defer rows.Close()
 
-	hourPast := time.Now().AddDate(0, -1, 0)
+	for rows.Next() {
+		candidate := Token{}
+		if err := rows.Scan(&candidate.Key, &candidate.CreatedOn, &candidate.UserID); err != nil {
+			return Token{}, err
+		}
 
-	if retToken.CreatedOn.Before(hourPast) {
-		fmt.Printf("Token %s expired", token.Key)
-		return false
+		if subtle.ConstantTimeCompare([]byte(key), []byte(candidate.Key)) == 1 {
+			return candidate, nil
+		}
 	}
-	return true
 
+	return Token{}, rows.Err()
 }
 
-func tokenInvalidate(dbConn *sql.DB, token Token) error {
-	query := "DELETE FROM authtoken_token WHERE key = ?"
+// Migrate -- stores a hashed copy of the key in api_key, marked legacy so it
+// stops working once django rotates the key. Concurrent first uses store it once.
+func (t *Token) Migrate(dbConn *sql.DB) (APIKey, error) {
+	query := "INSERT INTO api_key (user_id, name, prefix, key_hash, legacy, created_on) VALUES (?, 'legacy', ?, ?, 1, ?) ON DUPLICATE KEY UPDATE id = id"
 	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return APIKey{}, err
+	}
 
 	defer dq.Close()
 
-	_, err = dq.Exec(token.Key)
-	if err != nil {
-		log.Fatal(err)
+	if _, err = dq.Exec(t.UserID, apiKeyPrefix(t.Key), hashAPIKey(t.Key), t.CreatedOn); err != nil {
+		return APIKey{}, err
 	}
-	return nil
-}
-
-func getTokenForUser(dbConn *sql.DB, user User) (string, error) {
-	var token string
-	if tokenExists(dbConn, user) {
-		query := "SELECT `key` FROM authtoken_token WHERE user_id = ?"
-		err := dbConn.QueryRow(query, user.ID).Scan(&token)
-		if err != nil {
-			log.Fatal(err)
-		}
 
-		return token, nil
+	apiKey := APIKey{}
+	if err := apiKey.LookupFromKey(t.Key); err != nil {
+		return apiKey, err
 	}
-	token = "randomstringofcharacters123123123"
-	query := "INSERT INTO authtoken_token (`key`, created, user_id) VALUES (?, ?, ?)"
-	dq, err := dbConn.Prepare(query)
 
-	defer dq.Close()
+	fmt.Printf("Copied authtoken_token key for user %d into api_key\n", t.UserID)
+	return apiKey, nil
+}
 
-	_, err = dq.Exec(token, time.Now(), user.ID)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return token, nil
+// tokenExists -- whether key is still in authtoken_token, legacy keys stop
+// working once django rotates or deletes them
+func tokenExists(key string, dbConn *sql.DB) (bool, error) {
+	token, err := findToken(key, dbConn)
+	return token.Key != "", err
 }
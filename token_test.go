@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const legacyKey = "9944b09199c62bcf9418ad846dd0e4bbdfc6ee4b"
+
+func TestToken_LookupFromKey(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+
+	// wildcards in the presented key can't widen the prefix match
+	mock.ExpectPrepare("WHERE `key` LIKE CONCAT").ExpectQuery().WithArgs(`ab\%\_cdef`).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "created", "user_id"}))
+
+	token := Token{}
+	if err := token.LookupFromKey("ab%_cdef0123"); err != nil {
+		t.Fatal(err)
+	}
+	if token.Key != "" {
+		t.Errorf("got key %q wanted none", token.Key)
+	}
+}
+
+func TestToken_LookupFromKeyShortKey(t *testing.T) {
+	_, reset := mockDB(t)
+	defer reset()
+
+	// sqlmock fails on the query, a short prefix would match most of the table
+	for _, key := range []string{"", "9944b09"} {
+		token := Token{}
+		if err := token.LookupFromKey(key); err != nil || token.Key != "" {
+			t.Errorf("%q: got key %q and %v wanted none", key, token.Key, err)
+		}
+	}
+}
+
+func TestTokenExists(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+
+	// keys sharing the prefix are compared, not matched by the query
+	rows := sqlmock.NewRows([]string{"key", "created", "user_id"}).
+		AddRow(apiKeyPrefix(legacyKey)+"0000000000000000000000000000000", time.Now(), 5).
+		AddRow(legacyKey, time.Now(), 3)
+	mock.ExpectPrepare("FROM authtoken_token WHERE `key` LIKE CONCAT").ExpectQuery().WithArgs(apiKeyPrefix(legacyKey)).WillReturnRows(rows)
+
+	exists, err := tokenExists(legacyKey, &dbConn)
+	if err != nil || !exists {
+		t.Errorf("got %v and %v wanted the key to exist", exists, err)
+	}
+}
+
+func TestToken_MigrateKeepsDjangoKey(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+
+	created := time.Now()
+	mock.ExpectPrepare("INSERT INTO api_key .* ON DUPLICATE KEY UPDATE").ExpectExec().
+		WithArgs(3, apiKeyPrefix(legacyKey), hashAPIKey(legacyKey), created).WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectPrepare("FROM api_key WHERE prefix = ?").ExpectQuery().WithArgs(apiKeyPrefix(legacyKey)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "key_hash", "read_only", "domains", "endpoints", "created_on", "last_used_on", "legacy"}).
+			AddRow(4, 3, "legacy", apiKeyPrefix(legacyKey), hashAPIKey(legacyKey), false, "", "", created, nil, true))
+
+	// no DELETE FROM authtoken_token is expected, sqlmock fails on anything else
+	token := Token{Key: legacyKey, CreatedOn: created, UserID: 3}
+	apiKey, err := token.Migrate(&dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey.ID != 4 || !apiKey.Legacy {
+		t.Errorf("got %+v wanted legacy key 4", apiKey)
+	}
+}
+
+func TestUser_LookupFromAPIKeyRotatedLegacyKey(t *testing.T) {
+	mock, reset := mockDB(t)
+	defer reset()
+
+	mock.ExpectPrepare("FROM api_key WHERE prefix = ?").ExpectQuery().WithArgs(apiKeyPrefix(legacyKey)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "key_hash", "read_only", "domains", "endpoints", "created_on", "last_used_on", "legacy"}).
+			AddRow(4, 3, "legacy", apiKeyPrefix(legacyKey), hashAPIKey(legacyKey), false, "", "", time.Now(), nil, true))
+	mock.ExpectPrepare("FROM authtoken_token WHERE `key` LIKE CONCAT").ExpectQuery().WithArgs(apiKeyPrefix(legacyKey)).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "created", "user_id"}))
+	mock.ExpectPrepare("DELETE FROM api_key").ExpectExec().WithArgs(4, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectPrepare("FROM authtoken_token WHERE `key` LIKE").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"key", "created", "user_id"}))
+
+	user := User{}
+	if key := user.LookupFromAPIKey(legacyKey); key.ID != 0 || user.ID != 0 {
+		t.Errorf("key rotated by django still authenticated user %d", user.ID)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238), these are what authenticator apps assume by default
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew -- number of periods either side of now a code is accepted for
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret -- returns a new base32 encoded 160 bit secret
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode -- the HOTP (RFC 4226) code of secret for counter
+func totpCode(secret []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// validateTOTP -- checks code against secret around t and returns the time
+// step it matched, so the caller can refuse to accept the same step twice
+func validateTOTP(secret string, code string, t time.Time) (uint64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	step := uint64(t.Unix() / totpPeriod)
+	for i := -totpSkew; i <= totpSkew; i++ {
+		counter := step + uint64(i)
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter, totpDigits)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpProvisioningURI -- otpauth:// URI authenticator apps can import (usually as a QR code)
+func totpProvisioningURI(secret string, issuer string, username string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	label := url.PathEscape(issuer + ":" + username)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 6238 appendix B (SHA1)
+func TestTOTPCode_RFC6238(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, v := range vectors {
+		if code := totpCode(secret, uint64(v.unix/totpPeriod), 8); code != v.code {
+			t.Errorf("T=%d: got %s wanted %s", v.unix, code, v.code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+
+	// 1111111111 falls in step 37037037, whose 6 digit code is the last 6 of the 8 digit vector
+	if step, ok := validateTOTP(secret, "050471", now); !ok || step != 37037037 {
+		t.Errorf("current code rejected (step %d)", step)
+	}
+
+	if _, ok := validateTOTP(secret, "050471", now.Add(totpPeriod*time.Second)); !ok {
+		t.Error("code from the previous period rejected")
+	}
+
+	if _, ok := validateTOTP(secret, "050471", now.Add(5*totpPeriod*time.Second)); ok {
+		t.Error("stale code accepted")
+	}
+
+	if _, ok := validateTOTP(secret, "000000", now); ok {
+		t.Error("wrong code accepted")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := totpProvisioningURI("JBSWY3DPEHPK3PXP", "uberdns", "alice")
+	if !strings.HasPrefix(uri, "otpauth://totp/uberdns:alice?") || !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") {
+		t.Errorf("unexpected provisioning uri: %s", uri)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// Record transfer statuses
+const (
+	transferPending   = "pending"
+	transferAccepted  = "accepted"
+	transferDeclined  = "declined"
+	transferCancelled = "cancelled"
+)
+
+// ErrTransferResolved -- the transfer was accepted, declined or cancelled already
+var ErrTransferResolved = errors.New("transfer is no longer pending")
+
+// RecordTransfer -- moves records from their owner to another user, or hands
+// them to a team. Records the owner gave away in the meantime aren't moved.
+type RecordTransfer struct {
+	ID           int        `json:"id"`
+	FromUserID   int        `json:"from_user_id"`
+	ToUserID     int        `json:"to_user_id,omitempty"`
+	ToTeamID     int        `json:"to_team_id,omitempty"`
+	CreatedByID  int        `json:"created_by_id"`
+	CreatedOn    time.Time  `json:"created_on"`
+	Status       string     `json:"status"`
+	ResolvedByID int        `json:"resolved_by_id,omitempty"`
+	ResolvedOn   *time.Time `json:"resolved_on"`
+	RecordIDs    []int      `json:"record_ids"`
+}
+
+// TransferSelection -- the records of an owner to transfer, one record by id or
+// any number by domain and/or name
+type TransferSelection struct {
+	OwnerID  int
+	RecordID int
+	DomainID int
+	// matches records whose name contains it
+	Filter string
+}
+
+// query -- selects the ids of the matching records
+func (s TransferSelection) query() (string, []interface{}) {
+	query := "SELECT id FROM dns_record WHERE owner_id = ?"
+	args := []interface{}{s.OwnerID}
+	if s.RecordID != 0 {
+		query += " AND id = ?"
+		args = append(args, s.RecordID)
+	}
+	if s.DomainID != 0 {
+		query += " AND domain_id = ?"
+		args = append(args, s.DomainID)
+	}
+	if s.Filter != "" {
+		query += " AND name LIKE ?"
+		args = append(args, containsPattern(s.Filter))
+	}
+	return query + " ORDER BY id", args
+}
+
+// matchRecords -- the ids of the records selected
+func (s TransferSelection) matchRecords(dbConn *sql.DB) ([]int, error) {
+	var ids []int
+
+	query, args := s.query()
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// auditDetail -- what is stored in the audit log for every step of a transfer
+func (t *RecordTransfer) auditDetail() map[string]interface{} {
+	return map[string]interface{}{
+		"from_user_id": t.FromUserID,
+		"to_user_id":   t.ToUserID,
+		"to_team_id":   t.ToTeamID,
+		"record_ids":   t.RecordIDs,
+	}
+}
+
+// Save -- creates the transfer as pending
+func (t *RecordTransfer) Save(by User, dbConn *sql.DB) error {
+	t.CreatedByID = by.ID
+	t.CreatedOn = time.Now()
+	t.Status = transferPending
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO api_record_transfer (from_user_id, to_user_id, to_team_id, created_by_id, created_on, status) VALUES (?, ?, ?, ?, ?, ?)"
+	res, err := tx.Exec(query, t.FromUserID, nullID(t.ToUserID), nullID(t.ToTeamID), t.CreatedByID, t.CreatedOn, t.Status)
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	t.ID = int(id)
+
+	for _, recordID := range t.RecordIDs {
+		if _, err := tx.Exec("INSERT INTO api_record_transfer_record (transfer_id, record_id) VALUES (?, ?)", t.ID, recordID); err != nil {
+			return err
+		}
+	}
+
+	if err := audit(tx, by, "record.transfer.create", "record_transfer", t.ID, t.auditDetail()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LookupFromID -- fills in the transfer with id, ID stays 0 when there is none
+func (t *RecordTransfer) LookupFromID(id int, dbConn *sql.DB) error {
+	query := "SELECT id, from_user_id, to_user_id, to_team_id, created_by_id, created_on, status, resolved_by_id, resolved_on FROM api_record_transfer WHERE id = ?"
+
+	if err := t.scan(dbConn.QueryRow(query, id)); err != nil {
+		if err == sql.ErrNoRows {
+			*t = RecordTransfer{}
+			return nil
+		}
+		return err
+	}
+	return t.loadRecordIDs(dbConn)
+}
+
+func (t *RecordTransfer) scan(row interface{ Scan(...interface{}) error }) error {
+	var toUserID, toTeamID, resolvedByID sql.NullInt64
+	var resolvedOn sql.NullTime
+	if err := row.Scan(&t.ID, &t.FromUserID, &toUserID, &toTeamID, &t.CreatedByID, &t.CreatedOn, &t.Status, &resolvedByID, &resolvedOn); err != nil {
+		return err
+	}
+	t.ToUserID = int(toUserID.Int64)
+	t.ToTeamID = int(toTeamID.Int64)
+	t.ResolvedByID = int(resolvedByID.Int64)
+	if resolvedOn.Valid {
+		t.ResolvedOn = &resolvedOn.Time
+	}
+	return nil
+}
+
+func (t *RecordTransfer) loadRecordIDs(dbConn *sql.DB) error {
+	t.RecordIDs = []int{}
+
+	rows, err := dbConn.Query("SELECT record_id FROM api_record_transfer_record WHERE transfer_id = ? ORDER BY record_id", t.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var recordID int
+		if err := rows.Scan(&recordID); err != nil {
+			return err
+		}
+		t.RecordIDs = append(t.RecordIDs, recordID)
+	}
+	return rows.Err()
+}
+
+// Accept -- moves the records still owned by FromUserID, returns how many were
+func (t *RecordTransfer) Accept(by User, dbConn *sql.DB) (int, error) {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := t.resolve(tx, transferAccepted, by); err != nil {
+		return 0, err
+	}
+
+	column, recipientID := "owner_id", t.ToUserID
+	if t.ToTeamID != 0 {
+		// the owner stays, the team's members can manage the records too
+		column, recipientID = "team_id", t.ToTeamID
+	}
+
+	query := "UPDATE dns_record SET " + column + " = ? WHERE owner_id = ? AND id IN (SELECT record_id FROM api_record_transfer_record WHERE transfer_id = ?)"
+	res, err := tx.Exec(query, recipientID, t.FromUserID, t.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	moved, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	detail := t.auditDetail()
+	detail["moved"] = moved
+	if err := audit(tx, by, "record.transfer.accept", "record_transfer", t.ID, detail); err != nil {
+		return 0, err
+	}
+	return int(moved), tx.Commit()
+}
+
+// Decline -- the recipient turns the transfer down
+func (t *RecordTransfer) Decline(by User, dbConn *sql.DB) error {
+	return t.finish(transferDeclined, "record.transfer.decline", by, dbConn)
+}
+
+// Cancel -- the owner (or whoever created it) takes the transfer back
+func (t *RecordTransfer) Cancel(by User, dbConn *sql.DB) error {
+	return t.finish(transferCancelled, "record.transfer.cancel", by, dbConn)
+}
+
+func (t *RecordTransfer) finish(status string, action string, by User, dbConn *sql.DB) error {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := t.resolve(tx, status, by); err != nil {
+		return err
+	}
+	if err := audit(tx, by, action, "record_transfer", t.ID, t.auditDetail()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// resolve -- moves the transfer out of pending, only once
+func (t *RecordTransfer) resolve(tx *sql.Tx, status string, by User) error {
+	now := time.Now()
+
+	query := "UPDATE api_record_transfer SET status = ?, resolved_by_id = ?, resolved_on = ? WHERE id = ? AND status = ?"
+	res, err := tx.Exec(query, status, by.ID, now, t.ID, transferPending)
+	if err != nil {
+		return err
+	}
+
+	resolved, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if resolved != 1 {
+		return ErrTransferResolved
+	}
+
+	t.Status = status
+	t.ResolvedByID = by.ID
+	t.ResolvedOn = &now
+	return nil
+}
+
+// IsRecipient -- whether the user can accept or decline the transfer, teams
+// accept through their maintainers
+func (t *RecordTransfer) IsRecipient(user User) bool {
+	if t.ToTeamID != 0 {
+		team := Team{}
+		if err := team.LookupFromID(t.ToTeamID, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+		return team.ID != 0 && teamRoleForUser(user, team) == teamRoleMaintainer
+	}
+	return t.ToUserID != 0 && t.ToUserID == user.ID
+}
+
+// IsSender -- whether the user can cancel the transfer
+func (t *RecordTransfer) IsSender(user User) bool {
+	return user.ID != 0 && (user.ID == t.FromUserID || user.ID == t.CreatedByID)
+}
+
+// listPendingTransfers -- the pending transfers from or to the user, including
+// those to teams they maintain
+func listPendingTransfers(user User, dbConn *sql.DB) ([]RecordTransfer, error) {
+	transfers := []RecordTransfer{}
+
+	query := "SELECT id, from_user_id, to_user_id, to_team_id, created_by_id, created_on, status, resolved_by_id, resolved_on FROM api_record_transfer " +
+		"WHERE status = ? AND (from_user_id = ? OR created_by_id = ? OR to_user_id = ? " +
+		"OR to_team_id IN (SELECT team_id FROM api_team_member WHERE user_id = ? AND role = ?) " +
+		"OR to_team_id IN (SELECT t.id FROM api_team t JOIN api_organization_member m ON m.org_id = t.org_id WHERE m.user_id = ? AND m.role IN (?, ?))) " +
+		"ORDER BY id"
+
+	rows, err := dbConn.Query(query, transferPending, user.ID, user.ID, user.ID, user.ID, teamRoleMaintainer, user.ID, orgRoleOwner, orgRoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		transfer := RecordTransfer{}
+		if err := transfer.scan(rows); err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range transfers {
+		if err := transfers[i].loadRecordIDs(dbConn); err != nil {
+			return nil, err
+		}
+	}
+	return transfers, nil
+}
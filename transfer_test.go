@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestTransferSelection_Query(t *testing.T) {
+	cases := []struct {
+		selection TransferSelection
+		query     string
+		args      []interface{}
+	}{
+		{
+			TransferSelection{OwnerID: 3},
+			"SELECT id FROM dns_record WHERE owner_id = ? ORDER BY id",
+			[]interface{}{3},
+		},
+		{
+			TransferSelection{OwnerID: 3, RecordID: 42, DomainID: 7},
+			"SELECT id FROM dns_record WHERE owner_id = ? AND id = ? AND domain_id = ? ORDER BY id",
+			[]interface{}{3, 42, 7},
+		},
+		{
+			TransferSelection{OwnerID: 3, DomainID: 7, Filter: "web_"},
+			"SELECT id FROM dns_record WHERE owner_id = ? AND domain_id = ? AND name LIKE ? ORDER BY id",
+			[]interface{}{3, 7, `%web\_%`},
+		},
+	}
+
+	for _, c := range cases {
+		query, args := c.selection.query()
+		if query != c.query {
+			t.Errorf("%+v: got query %q wanted %q", c.selection, query, c.query)
+		}
+		if !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%+v: got args %v wanted %v", c.selection, args, c.args)
+		}
+	}
+}
+
+func TestRecordTransfer_IsSender(t *testing.T) {
+	transfer := RecordTransfer{FromUserID: 3, CreatedByID: 1, ToUserID: 5}
+
+	for userID, sender := range map[int]bool{0: false, 1: true, 3: true, 5: false} {
+		if transfer.IsSender(User{ID: userID}) != sender {
+			t.Errorf("user %d: got %v wanted %v", userID, !sender, sender)
+		}
+	}
+}
+
+func TestRecordTransfer_IsRecipient(t *testing.T) {
+	transfer := RecordTransfer{FromUserID: 3, ToUserID: 5}
+
+	if !transfer.IsRecipient(User{ID: 5}) {
+		t.Error("the user transferred to should be the recipient")
+	}
+	if transfer.IsRecipient(User{ID: 3}) {
+		t.Error("the sender shouldn't be the recipient")
+	}
+}
+
+func TestTransferExceedsQuota(t *testing.T) {
+	mock, done := mockDB(t)
+	defer done()
+
+	w := httptest.NewRecorder()
+	if transferExceedsQuota(w, RecordTransfer{ToTeamID: 2, RecordIDs: []int{1, 2, 3}}) {
+		t.Error("transfers to teams don't count against a user quota")
+	}
+
+	expectQuota := func(limit int, count int) {
+		mock.ExpectPrepare("FROM api_user_quota").ExpectQuery().WithArgs(5).
+			WillReturnRows(sqlmock.NewRows([]string{"records_per_user", "api_calls_per_day"}).AddRow(limit, nil))
+		mock.ExpectPrepare("SELECT COUNT").ExpectQuery().WithArgs(5).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+	}
+
+	expectQuota(3, 1)
+	if transferExceedsQuota(w, RecordTransfer{ToUserID: 5, RecordIDs: []int{1, 2}}) {
+		t.Error("a transfer filling the quota should be allowed")
+	}
+
+	expectQuota(3, 2)
+	if !transferExceedsQuota(w, RecordTransfer{ToUserID: 5, RecordIDs: []int{1, 2}}) {
+		t.Error("a transfer going over the quota should be refused")
+	}
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d wanted %d", w.Code, http.StatusForbidden)
+	}
+}
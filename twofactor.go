@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	mfaTokenLifetime  = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var (
+	// requireStaffTwoFactor -- staff and superusers must enroll in 2FA before they get any tokens
+	requireStaffTwoFactor bool
+	// twoFactorIssuer -- name authenticator apps show the account under
+	twoFactorIssuer = "uberdns"
+)
+
+// TwoFactor -- struct for storing information regarding a user's TOTP enrollment
+type TwoFactor struct {
+	UserID    int
+	Secret    string
+	Confirmed bool
+	CreatedOn time.Time
+}
+
+// LookupFromUserID -- UserID is left at 0 when the user never enrolled
+func (tf *TwoFactor) LookupFromUserID(userID int) error {
+	query := "SELECT user_id, secret, confirmed, created_on FROM api_totp WHERE user_id = ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer dq.Close()
+
+	err = dq.QueryRow(userID).Scan(&tf.UserID, &tf.Secret, &tf.Confirmed, &tf.CreatedOn)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Save -- stores a new, unconfirmed, enrollment replacing any previous one
+func (tf *TwoFactor) Save(dbConn *sql.DB) error {
+	query := "REPLACE INTO api_totp (user_id, secret, confirmed, created_on) VALUES (?, ?, 0, ?)"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer dq.Close()
+
+	tf.Confirmed = false
+	tf.CreatedOn = time.Now()
+	_, err = dq.Exec(tf.UserID, tf.Secret, tf.CreatedOn)
+	return err
+}
+
+func (tf *TwoFactor) Confirm(dbConn *sql.DB) error {
+	query := "UPDATE api_totp SET confirmed = 1 WHERE user_id = ?"
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer dq.Close()
+
+	if _, err = dq.Exec(tf.UserID); err != nil {
+		return err
+	}
+	tf.Confirmed = true
+	return nil
+}
+
+// Delete -- removes the enrollment along with its recovery codes
+func (tf *TwoFactor) Delete(dbConn *sql.DB) error {
+	for _, query := range []string{
+		"DELETE FROM api_recovery_code WHERE user_id = ?",
+		"DELETE FROM api_totp WHERE user_id = ?",
+	} {
+		dq, err := dbConn.Prepare(query)
+		if err != nil {
+			return err
+		}
+
+		_, err = dq.Exec(tf.UserID)
+		dq.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifyCode -- checks a TOTP code, each code is only accepted once
+func (tf *TwoFactor) VerifyCode(code string) bool {
+	step, ok := validateTOTP(tf.Secret, code, time.Now())
+	if !ok {
+		return false
+	}
+
+	return totpMarkStepUsed(tf.UserID, step, 2*(totpSkew+1)*totpPeriod*time.Second)
+}
+
+// Verify -- checks a TOTP code or, failing that, uses up a recovery code
+func (tf *TwoFactor) Verify(code string) bool {
+	if tf.VerifyCode(code) {
+		return true
+	}
+
+	used, err := tf.useRecoveryCode(code)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return used
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// GenerateRecoveryCodes -- replaces any existing recovery codes, the codes
+// are only ever returned here
+func (tf *TwoFactor) GenerateRecoveryCodes(dbConn *sql.DB) ([]string, error) {
+	dq, err := dbConn.Prepare("DELETE FROM api_recovery_code WHERE user_id = ?")
+	if err != nil {
+		return nil, err
+	}
+	_, err = dq.Exec(tf.UserID)
+	dq.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	dq, err = dbConn.Prepare("INSERT INTO api_recovery_code (user_id, code_hash) VALUES (?, ?)")
+	if err != nil {
+		return nil, err
+	}
+
+	defer dq.Close()
+
+	var codes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		code = code[:5] + "-" + code[5:]
+
+		if _, err := dq.Exec(tf.UserID, hashRecoveryCode(code)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+func (tf *TwoFactor) useRecoveryCode(code string) (bool, error) {
+	query := "SELECT id, code_hash FROM api_recovery_code WHERE user_id = ? AND used_on IS NULL"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return false, err
+	}
+
+	defer dq.Close()
+
+	rows, err := dq.Query(tf.UserID)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	hash := []byte(hashRecoveryCode(code))
+	matched := 0
+	for rows.Next() {
+		var id int
+		var codeHash string
+		if err := rows.Scan(&id, &codeHash); err != nil {
+			return false, err
+		}
+		if subtle.ConstantTimeCompare(hash, []byte(codeHash)) == 1 {
+			matched = id
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	if matched == 0 {
+		return false, nil
+	}
+
+	// only the request that actually flips used_on gets to use the code
+	res, err := dbConn.Exec("UPDATE api_recovery_code SET used_on = ? WHERE id = ? AND used_on IS NULL", time.Now(), matched)
+	if err != nil {
+		return false, err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated == 1, nil
+}
+
+// newMFAToken -- short lived token standing in for a password checked login
+// until the second factor has been checked. tokenType is "mfa" for users who
+// have to enter a code and "mfa_enroll" for users who have to enroll first.
+func newMFAToken(userID int, tokenType string) JWTToken {
+	token := JWTToken{}
+	token.ExpiresAt = time.Now().Add(mfaTokenLifetime).Unix()
+	token.UserID = userID
+	token.New(tokenType)
+	return token
+}
+
+// lookupMFAToken -- parses an mfa token of tokenType, UserID is 0 when it isn't
+// valid. The error is set when its revocation couldn't be checked.
+func lookupMFAToken(tokenStr string, tokenType string) (JWTToken, error) {
+	token := JWTToken{}
+	token.LookupFromString(tokenStr)
+	valid, err := token.IsValid()
+	if err != nil || !valid || token.TokenType != tokenType {
+		return JWTToken{}, err
+	}
+	return token, nil
+}
+
+// completeLogin -- called once a user's password has been checked, issues
+// tokens unless a second factor is still needed
+func completeLogin(w http.ResponseWriter, r *http.Request, user User) {
+	twoFactor := TwoFactor{}
+	if err := twoFactor.LookupFromUserID(user.ID); err != nil {
+		log.Fatal(err)
+	}
+
+	type mfaChallenge struct {
+		MFARequired           bool   `json:"mfa_required,omitempty"`
+		MFAEnrollmentRequired bool   `json:"mfa_enrollment_required,omitempty"`
+		MFAToken              string `json:"mfa_token"`
+	}
+
+	var challenge mfaChallenge
+	if twoFactor.Confirmed {
+		mfaToken := newMFAToken(user.ID, "mfa")
+		challenge = mfaChallenge{MFARequired: true, MFAToken: mfaToken.String()}
+	} else if requireStaffTwoFactor && (user.Staff || user.Admin) {
+		mfaToken := newMFAToken(user.ID, "mfa_enroll")
+		challenge = mfaChallenge{MFAEnrollmentRequired: true, MFAToken: mfaToken.String()}
+	} else {
+		var jwtTokens = JWTTokens{}
+		jwtTokens.New(user.ID)
+
+		writeJWTTokens(w, r, jwtTokens)
+		return
+	}
+
+	challengeJSON, err := json.Marshal(challenge)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(challengeJSON)
+}
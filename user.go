@@ -8,10 +8,13 @@ import (
 
 // User -- struct for storing information regarding a user performing a query
 type User struct {
-	ID    int
-	Name  string
-	Admin bool
-	Staff bool
+	ID     int
+	Name   string
+	Admin  bool
+	Staff  bool
+	Active bool
+	// the staff member acting as this user, 0 unless impersonating
+	ImpersonatorID int
 }
 
 func (u *User) IsPasswordAuthenticated(password string, dbConn *sql.DB) bool {
@@ -34,34 +37,63 @@ func (u *User) IsPasswordAuthenticated(password string, dbConn *sql.DB) bool {
 		log.Fatal(err)
 	}
 
-	valid, err := NewPBKDF2SHA256Hasher().Verify(password, realPass)
+	valid, err := verifyPassword(password, realPass)
 
 	if err != nil {
-		log.Fatal(err)
+		// a format we can't check, the user can still log in through django
+		fmt.Printf("Unable to verify password for user %d: %v\n", u.ID, err)
+		return false
+	}
+
+	// upgrade the hash while we have the plain-text password, as django does
+	if valid && passwordMustUpdate(realPass) {
+		if err := u.SetPassword(password, dbConn); err != nil {
+			fmt.Printf("Unable to rehash password for user %d: %v\n", u.ID, err)
+		}
 	}
 
 	return valid
 
 }
 
+// SetPassword -- encodes password with the preferred hasher and stores it
+func (u *User) SetPassword(password string, dbConn *sql.DB) error {
+	encoded, err := preferredPasswordHasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	query := "UPDATE auth_user SET password = ? WHERE id = ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	_, err = dq.Exec(encoded, u.ID)
+	return err
+}
+
+// GetRecords -- the records the user owns, and those of the teams they're in
 func (u *User) GetRecords(dbConn *sql.DB) []Record {
 	var records []Record
-	query := "SELECT id, name, ip_address, ttl, created_on FROM dns_record WHERE owner_id = ?"
+	query := "SELECT id, name, ip_address, ttl, created_on, domain_id, owner_id, team_id FROM dns_record WHERE owner_id = ? OR team_id IN (SELECT team_id FROM api_team_member WHERE user_id = ?)"
 
 	dq, err := dbConn.Prepare(query)
 
-	rows, err := dq.Query(u.ID)
+	rows, err := dq.Query(u.ID, u.ID)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer rows.Close()
 	for rows.Next() {
 		record := Record{}
-		if err := rows.Scan(&record.ID, &record.Name, &record.IP, &record.TTL, &record.CreatedOn); err != nil {
+		var teamID sql.NullInt64
+		if err := rows.Scan(&record.ID, &record.Name, &record.IP, &record.TTL, &record.CreatedOn, &record.DomainID, &record.OwnerID, &teamID); err != nil {
 			log.Fatal(err)
 		}
-		// if record lookup successful, tag record as ours for return
-		record.OwnerID = u.ID
+		record.TeamID = int(teamID.Int64)
 		records = append(records, record)
 	}
 
@@ -72,7 +104,7 @@ func (u *User) LookupFromName(username string) {
 	var isAdmin int
 	var isStaff int
 
-	query := "SELECT id, is_superuser, is_staff FROM auth_user WHERE username = ?"
+	query := "SELECT id, is_superuser, is_staff, is_active FROM auth_user WHERE username = ?"
 
 	dq, err := dbConn.Prepare(query)
 
@@ -82,7 +114,7 @@ func (u *User) LookupFromName(username string) {
 
 	defer dq.Close()
 
-	if err = dq.QueryRow(username).Scan(&u.ID, &isAdmin, &isStaff); err != nil {
+	if err = dq.QueryRow(username).Scan(&u.ID, &isAdmin, &isStaff, &u.Active); err != nil {
 		if err == sql.ErrNoRows {
 			return
 		}
@@ -104,74 +136,64 @@ func (u *User) LookupFromName(username string) {
 	return
 }
 
-func (u *User) HasAPIKey(apiKey string, dbConn *sql.DB) bool {
-	query := "SELECT COUNT(*) FROM auth_user INNER JOIN authtoken_token ON auth_user.id = authtoken_token.user_id WHERE authtoken_token.key = ?"
-
-	var count int
-	dq, err := dbConn.Prepare(query)
-
-	if err != nil {
+// LookupFromAPIKey -- finds the user owning apiKey and returns the key so its
+// scopes can be checked, keys in django's authtoken_token are copied into
+// api_key along the way
+func (u *User) LookupFromAPIKey(apiKey string) APIKey {
+	key := APIKey{}
+	if err := key.LookupFromKey(apiKey); err != nil {
 		log.Fatal(err)
 	}
-	defer dq.Close()
 
-	if err := dq.QueryRow(apiKey).Scan(&count); err != nil {
-		if err == sql.ErrNoRows {
-			return false
+	if key.Legacy {
+		exists, err := tokenExists(apiKey, &dbConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !exists {
+			// django rotated or deleted the key, so the copy goes too
+			if _, err := key.Delete(&dbConn); err != nil {
+				log.Fatal(err)
+			}
+			key = APIKey{}
 		}
-		log.Fatal(err)
-	}
-
-	if count == 1 {
-		return true
-	}
-	log.Fatalf("Error: Duplicate API keys detected in database - %s", apiKey)
-	return true
-}
-
-func (u *User) LookupFromAPIKey(apiKey string) {
-	var isAdmin int
-	var isStaff int
-
-	query := "SELECT auth_user.id, auth_user.username, auth_user.is_superuser, auth_user.is_staff FROM auth_user INNER JOIN authtoken_token ON auth_user.id = authtoken_token.user_id WHERE authtoken_token.key = ?"
-
-	dq, err := dbConn.Prepare(query)
-
-	if err != nil {
-		log.Fatal(err)
 	}
 
-	defer dq.Close()
+	if key.ID == 0 {
+		token := Token{}
+		if err := token.LookupFromKey(apiKey); err != nil {
+			log.Fatal(err)
+		}
 
-	err = dq.QueryRow(apiKey).Scan(&u.ID, &u.Name, &isAdmin, &isStaff)
-	if err != nil {
-		if err == sql.ErrNoRows {
+		if token.Key == "" {
 			fmt.Println("No user found by that API Key")
-			return
+			return key
 		}
-		log.Fatal(err)
-	}
 
-	if isAdmin == 1 {
-		u.Admin = true
-	} else {
-		u.Admin = false
+		var err error
+		if key, err = token.Migrate(&dbConn); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	if isStaff == 1 {
-		u.Staff = true
-	} else {
-		u.Staff = false
+	if err := key.Touch(&dbConn); err != nil {
+		log.Fatal(err)
 	}
-
-	return
+	u.ID = key.UserID
+	u.LookupFromID()
+	if !u.Active {
+		// keys of disabled users stop working along with the user
+		*u = User{}
+		return APIKey{}
+	}
+	return key
 }
 
 func (u *User) LookupFromID() {
 	var isAdmin int
 	var isStaff int
 
-	query := "SELECT username, is_superuser, is_staff FROM auth_user WHERE id = ?"
+	query := "SELECT username, is_superuser, is_staff, is_active FROM auth_user WHERE id = ?"
 
 	dq, err := dbConn.Prepare(query)
 
@@ -181,7 +203,7 @@ func (u *User) LookupFromID() {
 
 	defer dq.Close()
 
-	err = dq.QueryRow(u.ID).Scan(&u.Name, &isAdmin, &isStaff)
+	err = dq.QueryRow(u.ID).Scan(&u.Name, &isAdmin, &isStaff, &u.Active)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			fmt.Println("No user found by that API Key")
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// UserDetail -- everything admins get to see about a user
+type UserDetail struct {
+	ID         int        `json:"id"`
+	Username   string     `json:"username"`
+	Email      string     `json:"email"`
+	FirstName  string     `json:"first_name"`
+	LastName   string     `json:"last_name"`
+	Admin      bool       `json:"is_superuser"`
+	Staff      bool       `json:"is_staff"`
+	Active     bool       `json:"is_active"`
+	DateJoined time.Time  `json:"date_joined"`
+	LastLogin  *time.Time `json:"last_login"`
+	Roles      []UserRole `json:"roles,omitempty"`
+}
+
+const userDetailColumns = "id, username, email, first_name, last_name, is_superuser, is_staff, is_active, date_joined, last_login"
+
+func (d *UserDetail) scan(row interface{ Scan(...interface{}) error }) error {
+	var lastLogin sql.NullTime
+	if err := row.Scan(&d.ID, &d.Username, &d.Email, &d.FirstName, &d.LastName, &d.Admin, &d.Staff, &d.Active, &d.DateJoined, &lastLogin); err != nil {
+		return err
+	}
+	if lastLogin.Valid {
+		d.LastLogin = &lastLogin.Time
+	}
+	return nil
+}
+
+// LookupFromID -- fills in the user with id, ID stays 0 when there is none
+func (d *UserDetail) LookupFromID(id int, dbConn *sql.DB) error {
+	query := "SELECT " + userDetailColumns + " FROM auth_user WHERE id = ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	if err := d.scan(dq.QueryRow(id)); err != nil {
+		if err == sql.ErrNoRows {
+			*d = UserDetail{}
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// containsPattern -- a LIKE pattern matching anything containing search, with
+// wildcards in search matching literally
+func containsPattern(search string) string {
+	return "%" + escapeLike(search) + "%"
+}
+
+// escapeLike -- makes LIKE wildcards in s match literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// searchUsers -- users whose username, email or name contains search (every
+// user when empty), ordered by username
+func searchUsers(search string, offset int, limit int, dbConn *sql.DB) ([]UserDetail, error) {
+	users := []UserDetail{}
+
+	pattern := containsPattern(search)
+
+	query := "SELECT " + userDetailColumns + " FROM auth_user WHERE username LIKE ? OR email LIKE ? OR first_name LIKE ? OR last_name LIKE ? ORDER BY username LIMIT ? OFFSET ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer dq.Close()
+
+	rows, err := dq.Query(pattern, pattern, pattern, pattern, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user := UserDetail{}
+		if err := user.scan(rows); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// SetActive -- enables or disables the user, disabled users are logged out
+// everywhere and their API keys stop working
+func (u *User) SetActive(active bool, dbConn *sql.DB) error {
+	query := "UPDATE auth_user SET is_active = ? WHERE id = ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	if _, err = dq.Exec(active, u.ID); err != nil {
+		return err
+	}
+
+	u.Active = active
+	if !active {
+		jwtRevokeUser(u.ID)
+	}
+	return nil
+}
+
+// SetFlags -- sets is_superuser/is_staff
+func (u *User) SetFlags(admin bool, staff bool, dbConn *sql.DB) error {
+	query := "UPDATE auth_user SET is_superuser = ?, is_staff = ? WHERE id = ?"
+
+	dq, err := dbConn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer dq.Close()
+
+	if _, err = dq.Exec(admin, staff, u.ID); err != nil {
+		return err
+	}
+
+	u.Admin = admin
+	u.Staff = staff
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestContainsPattern(t *testing.T) {
+	expected := map[string]string{
+		"":          "%%",
+		"jane":      "%jane%",
+		"100%_real": `%100\%\_real%`,
+		`back\`:     `%back\\%`,
+	}
+
+	for search, want := range expected {
+		if got := containsPattern(search); got != want {
+			t.Errorf("%q: got %q wanted %q", search, got, want)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -29,22 +31,22 @@ func createJWTTokenView(w http.ResponseWriter, r *http.Request) {
 			log.Fatal(err)
 		}
 
-		var user = User{}
-		user.LookupFromName(jwtRequest.Username)
-
-		if (User{}) == user {
-			fmt.Printf("Username %s not found", jwtRequest.Username)
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte("403 - Forbidden"))
+		attempt := newLoginAttempt(r, jwtRequest.Username)
+		if retryAfter := attempt.Blocked(); retryAfter > 0 {
+			writeLoginBlocked(w, retryAfter)
 			return
 		}
 
-		if user.IsPasswordAuthenticated(jwtRequest.Password, &dbConn) {
-			jwtToken := JWTTokens{}
-			jwtToken.New(user.ID)
-			fmt.Println(jwtToken.String())
+		user, ok := authenticateUser(jwtRequest.Username, jwtRequest.Password)
+		if !ok {
+			attempt.Failed()
+			writeLoginFailed(w)
+			return
 		}
 
+		attempt.Succeeded()
+		completeLogin(w, r, user)
+
 	}
 }
 
@@ -69,18 +71,21 @@ func updateRecordView(w http.ResponseWriter, r *http.Request) {
 		if err = record.LookupFromFQDN(reqRecord.Name); err != nil {
 			log.Fatal(err)
 		}
-		if record.IsUserAllowed(user) {
+		if record.ID == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Record Not Found"))
+			return
+		}
+
+		if authorizeRecord(user, PermissionRecordUpdate, record) {
+			previous := record
 			record.IP = reqRecord.IPAddress
-			if err = record.Save(&dbConn); err != nil {
+			if err = record.Update(&dbConn); err != nil {
 				log.Fatal(err)
 			}
 			fmt.Fprintf(w, "Record was updated successfully")
-			if err := record.Purge(recordChannel); err != nil {
-				log.Print("Unable to send purge record message to redis")
-				log.Fatal(err)
-			}
-
-			if err := record.Cache(recordChannel); err != nil {
+			if err := record.CacheUpdate(recordChannel, previous); err != nil {
+				log.Print("Unable to send update record message to redis")
 				log.Fatal(err)
 			}
 		} else {
@@ -115,14 +120,48 @@ func createRecordView(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		recordName := strings.Split(reqRecord.Name, ".")[0]
-		domainName := strings.Join(strings.Split(reqRecord.Name, ".")[1:], ".")
+		recordName, domainName := splitFQDN(reqRecord.Name)
 
 		domain := Domain{}
 		if err := domain.LookupFromFQDN(domainName); err != nil {
 			log.Fatal(err)
 		}
 
+		if !openRecordCreation && !authorize(user, PermissionRecordCreate, domain.ID) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		if reqRecord.TeamID != 0 {
+			team := Team{}
+			if err := team.LookupFromID(reqRecord.TeamID, &dbConn); err != nil {
+				log.Fatal(err)
+			}
+			if team.ID == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("404 - Team not found"))
+				return
+			}
+			if teamRoleForUser(user, team) == "" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("403 - Forbidden"))
+				return
+			}
+		}
+
+		userUsage := QuotaUsage{Limit: user.GetQuotas(&dbConn).RecordsPerUser, Usage: user.CountRecords(&dbConn)}
+		if userUsage.Exceeded() {
+			writeQuotaExceeded(w, http.StatusForbidden, quotaRecordsPerUser, userUsage)
+			return
+		}
+
+		domainUsage := QuotaUsage{Limit: defaultQuotas.RecordsPerDomain, Usage: domain.CountRecords(&dbConn)}
+		if domainUsage.Exceeded() {
+			writeQuotaExceeded(w, http.StatusForbidden, quotaRecordsPerDomain, domainUsage)
+			return
+		}
+
 		record := Record{
 			Name:      recordName,
 			IP:        reqRecord.IPAddress,
@@ -130,6 +169,7 @@ func createRecordView(w http.ResponseWriter, r *http.Request) {
 			CreatedOn: time.Now(),
 			DomainID:  domain.ID,
 			OwnerID:   user.ID,
+			TeamID:    reqRecord.TeamID,
 		}
 
 		if err = record.Save(&dbConn); err != nil {
@@ -143,7 +183,7 @@ func createRecordView(w http.ResponseWriter, r *http.Request) {
 			log.Fatal(err)
 		}
 		fmt.Fprintf(w, "Record was created successfully: %s", reqRecord.Name)
-		if err = record.Cache(recordChannel); err != nil {
+		if err = record.Cache(recordChannel, domain); err != nil {
 			log.Fatal(err)
 		}
 
@@ -182,8 +222,8 @@ func listAllRecordView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// if requesting user is not an admin or staff, forbid access to ALL records
-	if !user.Admin && !user.Staff {
+	// if requesting user may not list everything, forbid access to ALL records
+	if !authorize(user, PermissionRecordListAll, 0) {
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("403 - Forbidden"))
 		return
@@ -219,8 +259,13 @@ func deleteRecordView(w http.ResponseWriter, r *http.Request) {
 		if err = record.LookupFromFQDN(reqRecord.Name); err != nil {
 			log.Fatal(err)
 		}
+		if record.ID == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Record Not Found"))
+			return
+		}
 
-		if record.IsUserAllowed(user) {
+		if authorizeRecord(user, PermissionRecordDelete, record) {
 			if err = record.Delete(&dbConn); err != nil {
 				log.Fatal(err)
 			}
@@ -244,18 +289,14 @@ func purgeCacheView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Only admin + staff can purge the entire cache
-	if !user.Admin && !user.Staff {
+	// Only users allowed to can purge the entire cache
+	if !authorize(user, PermissionCachePurge, 0) {
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("403 - Forbidden"))
 		return
 	}
 
-	type FQDN struct {
-		FQDN string
-	}
-
-	var reqRecord FQDN
+	var reqRecord requestFQDN
 
 	switch r.Method {
 	case "GET":
@@ -279,10 +320,7 @@ func purgeCacheView(w http.ResponseWriter, r *http.Request) {
 func purgeCacheRecordView(w http.ResponseWriter, r *http.Request) {
 	user := getUserFromRequest(r)
 
-	type FQDN struct {
-		FQDN string
-	}
-	var reqRecord FQDN
+	var reqRecord requestFQDN
 
 	switch r.Method {
 	case "GET":
@@ -302,7 +340,7 @@ func purgeCacheRecordView(w http.ResponseWriter, r *http.Request) {
 			log.Fatal(err)
 		}
 
-		if record.IsUserAllowed(user) {
+		if authorizeRecord(user, PermissionCachePurgeRecord, record) {
 			if err = record.Purge(recordChannel); err != nil {
 				log.Fatal(err)
 			}
@@ -325,8 +363,8 @@ func createDomainView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// if requesting user is not an admin or staff, forbid access
-	if !user.Admin && !user.Staff {
+	// if requesting user may not create domains, forbid access
+	if !authorize(user, PermissionDomainCreate, 0) {
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("403 - Forbidden"))
 		return
@@ -377,8 +415,8 @@ func listDomainView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// if requesting user is not an admin or staff, forbid access
-	if !user.Admin && !user.Staff {
+	// if requesting user may not list domains, forbid access
+	if !authorize(user, PermissionDomainList, 0) {
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("403 - Forbidden"))
 		return
@@ -403,13 +441,6 @@ func deleteDomainView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// if requesting user is not an admin or staff, forbid access
-	if !user.Admin && !user.Staff {
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte("403 - Forbidden"))
-		return
-	}
-
 	type requestDomain struct {
 		Name string
 	}
@@ -433,6 +464,13 @@ func deleteDomainView(w http.ResponseWriter, r *http.Request) {
 			log.Fatal(err)
 		}
 
+		// if requesting user may not delete this domain, forbid access
+		if !authorize(user, PermissionDomainDelete, domain.ID) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
 		if err = domain.Delete(&dbConn); err != nil {
 			log.Fatal(err)
 		}
@@ -463,45 +501,147 @@ func loginView(w http.ResponseWriter, r *http.Request) {
 			log.Fatal(err)
 		}
 
-		var user = User{}
-		user.LookupFromName(credentials.Username)
-		if user.IsPasswordAuthenticated(credentials.Password, &dbConn) {
-			var jwtTokens = JWTTokens{}
-			jwtTokens.New(user.ID)
-
-			http.SetCookie(w, &http.Cookie{
-				Name:       "token",
-				Value:      jwtTokens.AccessToken.String(),
-				Expires:    time.Now().Add(300 * time.Second),
-				RawExpires: time.Now().Add(300 * time.Second).String(),
-				MaxAge:     300,
-			})
-			w.Header().Add("Content-Type", "application/json")
-			w.Header().Add("Access-Control-Allow-Origin", "*")
-			w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-			w.Write([]byte(jwtTokens.String()))
+		attempt := newLoginAttempt(r, credentials.Username)
+		if retryAfter := attempt.Blocked(); retryAfter > 0 {
+			writeLoginBlocked(w, retryAfter)
 			return
-		} else {
+		}
+
+		user, ok := authenticateUser(credentials.Username, credentials.Password)
+		if !ok {
+			attempt.Failed()
+			writeLoginFailed(w)
+			return
+		}
+
+		attempt.Succeeded()
+		completeLogin(w, r, user)
+	}
+}
+
+// writeJWTTokens -- records the session the tokens belong to, sets the access
+// token cookie and writes the token pair as the response
+func writeJWTTokens(w http.ResponseWriter, r *http.Request, jwtTokens JWTTokens) {
+	if err := saveSession(r, jwtTokens, &dbConn); err != nil {
+		log.Fatal(err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:       "token",
+		Value:      jwtTokens.AccessToken.String(),
+		Expires:    time.Now().Add(accessTokenLifetime),
+		RawExpires: time.Now().Add(accessTokenLifetime).String(),
+		MaxAge:     int(accessTokenLifetime.Seconds()),
+	})
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Write([]byte(jwtTokens.String()))
+}
+
+// jwksView -- publishes the public keys JWTs can be verified with
+func jwksView(w http.ResponseWriter, r *http.Request) {
+	jwks, err := jwtKeyring.JWKS()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Write(jwks)
+}
+
+func refreshJWTTokenView(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Add("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		return
+	case "GET":
+		fmt.Println("Should redirect to index")
+	case "POST":
+		var tokenMSG = JWTTokenMessage{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&tokenMSG); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var jwtTokens = JWTTokens{}
+		err := jwtTokens.Refresh(tokenMSG.Refresh)
+		if err != nil && err != ErrRefreshTokenInvalid && err != ErrRefreshTokenRevoked && err != ErrRefreshTokenReused {
+			fmt.Printf("Unable to check token revocation: %v\n", err)
+			writeServiceUnavailable(w)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
 			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("401 - Unauthorized"))
 			return
 		}
+
+		writeJWTTokens(w, r, jwtTokens)
 	}
 }
 
+// clearJWTCookie -- removes the access token cookie from the browser
+func clearJWTCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:    "token",
+		Value:   "",
+		Expires: time.Unix(0, 0),
+		MaxAge:  -1,
+	})
+}
+
 func logoutView(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		fmt.Println("Should redirect to index")
 	case "POST":
-		fmt.Println("nice")
-	}
-	fmt.Println(r.Header)
-	token := Token{
-		Key: "123",
+		jwtToken := JWTToken{}
+		jwtToken.LookupFromString(getJWTFromRequest(r))
+		if jwtToken.Token != nil {
+			// revoke the presented token and end the login it came from,
+			// so its refresh tokens can't be used to get a new one
+			jwtToken.Revoke()
+			if jwtToken.Family != "" {
+				jwtRevokeFamily(jwtToken.Family)
+				if err := revokeSessionFamily(jwtToken.Family, &dbConn); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+
+		clearJWTCookie(w)
+		fmt.Fprintf(w, "Logged out successfully")
 	}
-	err := tokenInvalidate(&dbConn, token)
-	if err != nil {
-		log.Fatal(err)
+}
+
+// logoutAllView -- logs the requesting user out of every session
+func logoutAllView(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		fmt.Println("Should redirect to index")
+	case "POST":
+		user := getUserFromRequest(r)
+
+		if (User{}) == user {
+			// Empty user returned from token lookup - implied user not found
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+		if forbidImpersonation(w, user) {
+			return
+		}
+
+		jwtRevokeUser(user.ID)
+
+		clearJWTCookie(w)
+		fmt.Fprintf(w, "Logged out of all sessions successfully")
 	}
 }
 
@@ -520,14 +660,18 @@ func userProfileView(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		type UserProfile struct {
-			ID      int      `json:"id"`
-			Name    string   `json:"name"`
-			Records []Record `json:"records"`
+			ID             int                   `json:"id"`
+			Name           string                `json:"name"`
+			ImpersonatorID int                   `json:"impersonator_id,omitempty"`
+			Records        []Record              `json:"records"`
+			Quotas         map[string]QuotaUsage `json:"quotas"`
 		}
 		userProfile := UserProfile{}
 		userProfile.ID = user.ID
 		userProfile.Name = user.Name
+		userProfile.ImpersonatorID = user.ImpersonatorID
 		userProfile.Records = user.GetRecords(&dbConn)
+		userProfile.Quotas = user.GetQuotaUsage(&dbConn)
 		recordsJSON, err := json.Marshal(userProfile)
 		if err != nil {
 			log.Fatal(err)
@@ -537,3 +681,2382 @@ func userProfileView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func createAPIKeyView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	type reqAPIKey struct {
+		Name      string
+		ReadOnly  bool
+		Domains   []string
+		Endpoints []string
+	}
+
+	var requestAPIKey reqAPIKey
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+
+		if err := decoder.Decode(&requestAPIKey); err != nil || requestAPIKey.Name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		apiKey := APIKey{
+			Name:      requestAPIKey.Name,
+			ReadOnly:  requestAPIKey.ReadOnly,
+			Domains:   splitScope(strings.Join(requestAPIKey.Domains, ",")),
+			Endpoints: splitScope(strings.Join(requestAPIKey.Endpoints, ",")),
+			UserID:    user.ID,
+		}
+
+		if err := apiKey.Save(&dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		// This is the only time the key itself is ever returned
+		apiKeyJSON, err := json.Marshal(apiKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write([]byte(apiKeyJSON))
+	}
+}
+
+func listAPIKeyView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	apiKeys := user.GetAPIKeys(&dbConn)
+	apiKeysJSON, err := json.Marshal(apiKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write([]byte(apiKeysJSON))
+}
+
+func revokeAPIKeyView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	type reqAPIKey struct {
+		ID int
+	}
+
+	var requestAPIKey reqAPIKey
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "DELETE":
+		decoder := json.NewDecoder(r.Body)
+
+		if err := decoder.Decode(&requestAPIKey); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		apiKey := APIKey{
+			ID:     requestAPIKey.ID,
+			UserID: user.ID,
+		}
+
+		deleted, err := apiKey.Delete(&dbConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if !deleted {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Not Found"))
+			return
+		}
+
+		fmt.Fprintf(w, "API key was revoked successfully")
+	}
+}
+
+func listRoleView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if !authorize(user, PermissionRoleManage, 0) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	roleDefinitions := make(map[string][]Permission)
+	for _, role := range roleNames() {
+		roleDefinitions[role] = roles[role]
+	}
+
+	rolesJSON, err := json.Marshal(roleDefinitions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write([]byte(rolesJSON))
+}
+
+func listUserRoleView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if !authorize(user, PermissionRoleManage, 0) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+
+	roleUser := User{ID: userID}
+	userRolesJSON, err := json.Marshal(roleUser.GetRoles(&dbConn))
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write([]byte(userRolesJSON))
+}
+
+func assignRoleView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if !authorize(user, PermissionRoleManage, 0) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	type reqRole struct {
+		UserID int
+		Role   string
+		Domain string
+	}
+
+	var requestRole reqRole
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		decoder := json.NewDecoder(r.Body)
+
+		if err := decoder.Decode(&requestRole); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		if _, ok := roles[requestRole.Role]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Unknown role"))
+			return
+		}
+
+		userRole := UserRole{
+			UserID: requestRole.UserID,
+			Role:   requestRole.Role,
+		}
+
+		if requestRole.Domain != "" {
+			domain := Domain{}
+			if err := domain.LookupFromFQDN(requestRole.Domain); err != nil {
+				log.Fatal(err)
+			}
+			if domain.ID == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("404 - Domain Not Found"))
+				return
+			}
+			userRole.DomainID = domain.ID
+		}
+
+		// roles can't carry permissions the granter doesn't hold themselves
+		if !canGrantRole(user, userRole.Role, userRole.DomainID) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		if err := userRole.Save(&dbConn); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Unable to assign role"))
+			return
+		}
+
+		userRoleJSON, err := json.Marshal(userRole)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write([]byte(userRoleJSON))
+	}
+}
+
+func revokeRoleView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if !authorize(user, PermissionRoleManage, 0) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	type reqRole struct {
+		ID int
+	}
+
+	var requestRole reqRole
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "DELETE":
+		decoder := json.NewDecoder(r.Body)
+
+		if err := decoder.Decode(&requestRole); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		userRole := UserRole{}
+		if err := userRole.LookupFromID(requestRole.ID, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		if userRole.ID != 0 && !canGrantRole(user, userRole.Role, userRole.DomainID) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		deleted, err := userRole.Delete(&dbConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if !deleted {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Not Found"))
+			return
+		}
+
+		fmt.Fprintf(w, "Role was revoked successfully")
+	}
+}
+
+// loginTwoFactorView -- second login step, exchanges an mfa token and a TOTP
+// (or recovery) code for the usual tokens
+func loginTwoFactorView(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Add("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		return
+	case "GET":
+		fmt.Println("Should redirect to index")
+	case "POST":
+		type twoFactorRequest struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+		var request = twoFactorRequest{}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// codes are guessed against the user the mfa token was issued to
+		attempt := newLoginAttempt(r, "")
+		mfaToken, err := lookupMFAToken(request.MFAToken, "mfa")
+		if err != nil {
+			fmt.Printf("Unable to check token revocation: %v\n", err)
+			writeServiceUnavailable(w)
+			return
+		}
+		if mfaToken.UserID != 0 {
+			user := User{ID: mfaToken.UserID}
+			user.LookupFromID()
+			attempt = newLoginAttempt(r, user.Name)
+		}
+
+		if retryAfter := attempt.Blocked(); retryAfter > 0 {
+			writeLoginBlocked(w, retryAfter)
+			return
+		}
+
+		if mfaToken.UserID == 0 {
+			attempt.Failed()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		twoFactor := TwoFactor{}
+		if err := twoFactor.LookupFromUserID(mfaToken.UserID); err != nil {
+			log.Fatal(err)
+		}
+
+		if !twoFactor.Confirmed || !twoFactor.Verify(request.Code) {
+			attempt.Failed()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		attempt.Succeeded()
+
+		// the mfa token has done its job
+		mfaToken.Revoke()
+
+		var jwtTokens = JWTTokens{}
+		jwtTokens.New(mfaToken.UserID)
+		writeJWTTokens(w, r, jwtTokens)
+	}
+}
+
+// twoFactorUser -- the user managing their 2FA enrollment, either logged in
+// or holding the mfa_enroll token handed out when enrollment is required. The
+// error is set when a token's revocation couldn't be checked.
+func twoFactorUser(r *http.Request, mfaTokenStr string) (User, JWTToken, error) {
+	user, err := userFromRequest(r)
+	if err != nil || (User{}) != user {
+		return user, JWTToken{}, err
+	}
+
+	mfaToken, err := lookupMFAToken(mfaTokenStr, "mfa_enroll")
+	if err != nil {
+		return User{}, JWTToken{}, err
+	}
+	if mfaToken.UserID != 0 {
+		user.ID = mfaToken.UserID
+		user.LookupFromID()
+	}
+	return user, mfaToken, nil
+}
+
+func enrollTwoFactorView(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		type enrollRequest struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		var request = enrollRequest{}
+		// the body is optional for users that are logged in
+		json.NewDecoder(r.Body).Decode(&request)
+
+		user, _, err := twoFactorUser(r, request.MFAToken)
+		if err != nil {
+			fmt.Printf("Unable to check token revocation: %v\n", err)
+			writeServiceUnavailable(w)
+			return
+		}
+		if (User{}) == user {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+		if forbidImpersonation(w, user) {
+			return
+		}
+
+		twoFactor := TwoFactor{}
+		if err := twoFactor.LookupFromUserID(user.ID); err != nil {
+			log.Fatal(err)
+		}
+
+		if twoFactor.Confirmed {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("409 - 2FA is already enabled"))
+			return
+		}
+
+		secret, err := generateTOTPSecret()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		twoFactor = TwoFactor{
+			UserID: user.ID,
+			Secret: secret,
+		}
+		if err := twoFactor.Save(&dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		type enrollResponse struct {
+			Secret          string `json:"secret"`
+			ProvisioningURI string `json:"provisioning_uri"`
+		}
+		responseJSON, err := json.Marshal(enrollResponse{
+			Secret:          secret,
+			ProvisioningURI: totpProvisioningURI(secret, twoFactorIssuer, user.Name),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(responseJSON)
+	}
+}
+
+// confirmTwoFactorView -- enables 2FA once the user proves their authenticator
+// works, returns the recovery codes
+func confirmTwoFactorView(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		type confirmRequest struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+		var request = confirmRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		user, mfaToken, err := twoFactorUser(r, request.MFAToken)
+		if err != nil {
+			fmt.Printf("Unable to check token revocation: %v\n", err)
+			writeServiceUnavailable(w)
+			return
+		}
+		if (User{}) == user {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+		if forbidImpersonation(w, user) {
+			return
+		}
+
+		twoFactor := TwoFactor{}
+		if err := twoFactor.LookupFromUserID(user.ID); err != nil {
+			log.Fatal(err)
+		}
+
+		if twoFactor.UserID == 0 || twoFactor.Confirmed {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - No pending 2FA enrollment"))
+			return
+		}
+
+		// codes are throttled here as they are at /login/2fa
+		attempt := newLoginAttempt(r, user.Name)
+		if retryAfter := attempt.Blocked(); retryAfter > 0 {
+			writeLoginBlocked(w, retryAfter)
+			return
+		}
+
+		if !twoFactor.VerifyCode(request.Code) {
+			attempt.Failed()
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("401 - Invalid code"))
+			return
+		}
+		attempt.Succeeded()
+
+		if err := twoFactor.Confirm(&dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		codes, err := twoFactor.GenerateRecoveryCodes(&dbConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// users enrolling because they had to log in again, now with 2FA
+		if mfaToken.UserID != 0 {
+			mfaToken.Revoke()
+		}
+
+		writeRecoveryCodes(w, codes)
+	}
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	type recoveryCodes struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	codesJSON, err := json.Marshal(recoveryCodes{RecoveryCodes: codes})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(codesJSON)
+}
+
+func disableTwoFactorView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		type disableRequest struct {
+			Code string `json:"code"`
+		}
+		var request = disableRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		if requireStaffTwoFactor && (user.Staff || user.Admin) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - 2FA is required for staff accounts"))
+			return
+		}
+
+		twoFactor := TwoFactor{}
+		if err := twoFactor.LookupFromUserID(user.ID); err != nil {
+			log.Fatal(err)
+		}
+
+		if twoFactor.UserID == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - 2FA is not enabled"))
+			return
+		}
+
+		// codes, recovery codes included, are throttled as they are at /login/2fa
+		attempt := newLoginAttempt(r, user.Name)
+		if retryAfter := attempt.Blocked(); retryAfter > 0 {
+			writeLoginBlocked(w, retryAfter)
+			return
+		}
+
+		if twoFactor.Confirmed && !twoFactor.Verify(request.Code) {
+			attempt.Failed()
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("401 - Invalid code"))
+			return
+		}
+		attempt.Succeeded()
+
+		if err := twoFactor.Delete(&dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(w, "2FA was disabled successfully")
+	}
+}
+
+func regenerateRecoveryCodesView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		type recoveryRequest struct {
+			Code string `json:"code"`
+		}
+		var request = recoveryRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		twoFactor := TwoFactor{}
+		if err := twoFactor.LookupFromUserID(user.ID); err != nil {
+			log.Fatal(err)
+		}
+
+		// codes are throttled here as they are at /login/2fa
+		attempt := newLoginAttempt(r, user.Name)
+		if retryAfter := attempt.Blocked(); retryAfter > 0 {
+			writeLoginBlocked(w, retryAfter)
+			return
+		}
+
+		if !twoFactor.Confirmed || !twoFactor.VerifyCode(request.Code) {
+			attempt.Failed()
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("401 - Invalid code"))
+			return
+		}
+		attempt.Succeeded()
+
+		codes, err := twoFactor.GenerateRecoveryCodes(&dbConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		writeRecoveryCodes(w, codes)
+	}
+}
+
+// oidcLoginView -- sends the user to the identity provider to log in
+func oidcLoginView(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - OIDC login is not enabled"))
+		return
+	}
+
+	state, login, err := oidcProvider.NewLogin()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authURL, err := oidcProvider.AuthCodeURL(state, login)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("502 - Identity provider unavailable"))
+		return
+	}
+
+	oidcSaveLogin(state, login)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallbackView -- the identity provider sends the user back here with an
+// authorization code, which is exchanged for an ID token and then our tokens
+func oidcCallbackView(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - OIDC login is not enabled"))
+		return
+	}
+
+	query := r.URL.Query()
+	if idpError := query.Get("error"); idpError != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "401 - Login failed: %s", idpError)
+		return
+	}
+
+	login, ok := oidcTakeLogin(query.Get("state"))
+	if !ok || query.Get("code") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Unknown or expired login"))
+		return
+	}
+
+	idToken, err := oidcProvider.Exchange(query.Get("code"), login)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401 - Login failed"))
+		return
+	}
+
+	claims, err := oidcProvider.VerifyIDToken(idToken, login.Nonce)
+	if err != nil {
+		log.Printf("[OIDC] Rejected ID token: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401 - Login failed"))
+		return
+	}
+
+	var user = User{}
+	if err := user.LookupFromOIDC(oidcProvider, claims, &dbConn); err == ErrOIDCConflict {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409 - This login conflicts with an existing account"))
+		return
+	} else if err != nil {
+		log.Printf("[OIDC] Unable to look up the user: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Internal Server Error"))
+		return
+	}
+
+	if user.ID == 0 || !user.Active {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - No active account for this user"))
+		return
+	}
+
+	completeLogin(w, r, user)
+}
+
+// registerView -- creates an inactive account and emails a confirmation link
+func registerView(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Add("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		return
+	case "GET":
+		fmt.Println("Should redirect to index")
+	case "POST":
+		if registrationMode != registrationOpen && registrationMode != registrationInvite {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Registration is closed"))
+			return
+		}
+
+		type registration struct {
+			Username   string `json:"username"`
+			Email      string `json:"email"`
+			Password   string `json:"password"`
+			InviteCode string `json:"invite_code"`
+		}
+		var request = registration{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		if err := validateUsername(request.Username); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "400 - %v", err)
+			return
+		}
+		if err := validateEmail(request.Email); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "400 - %v", err)
+			return
+		}
+		if err := passwordPolicy.Validate(request.Password, request.Username); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "400 - %v", err)
+			return
+		}
+
+		// only claimed once the user is created
+		inviteCode := ""
+		if registrationMode == registrationInvite {
+			if inviteCode = request.InviteCode; inviteCode == "" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("403 - Invalid invite code"))
+				return
+			}
+		}
+
+		var user = User{}
+		if err := user.Register(request.Username, request.Email, request.Password, inviteCode, &dbConn); err == ErrUsernameTaken {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "409 - %v", err)
+			return
+		} else if err == ErrInvalidInvite {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Invalid invite code"))
+			return
+		} else if err == ErrConfirmationNotSent {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, "502 - %v, try registering again later", err)
+			return
+		} else if err != nil {
+			log.Fatal(err)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Account created, follow the link emailed to %s to activate it", request.Email)
+	}
+}
+
+// confirmRegistrationView -- activates the account the emailed token belongs to
+func confirmRegistrationView(w http.ResponseWriter, r *http.Request) {
+	userID, ok := registrationTakeConfirmation(hashToken(r.URL.Query().Get("token")))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Invalid or expired confirmation link"))
+		return
+	}
+
+	user := User{ID: userID}
+	if err := user.Activate(&dbConn); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintf(w, "Account activated, you can now log in")
+}
+
+func createInviteCodeView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if !authorize(user, PermissionUserInvite, 0) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		type inviteRequest struct {
+			// how long the code can be used for, e.g. "72h", empty never expires
+			ExpiresIn string `json:"expires_in"`
+		}
+		var request = inviteRequest{}
+		// the body is optional
+		json.NewDecoder(r.Body).Decode(&request)
+
+		inviteCode := InviteCode{CreatedByID: user.ID}
+		if request.ExpiresIn != "" {
+			expiresIn, err := time.ParseDuration(request.ExpiresIn)
+			if err != nil || expiresIn <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("400 - Invalid expires_in"))
+				return
+			}
+			expiresOn := time.Now().Add(expiresIn)
+			inviteCode.ExpiresOn = &expiresOn
+		}
+
+		if err := inviteCode.Save(&dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		// This is the only time the code itself is ever returned
+		inviteCodeJSON, err := json.Marshal(inviteCode)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(inviteCodeJSON)
+	}
+}
+
+// changePasswordView -- sets a new password after checking the current one,
+// every token issued to the user is revoked so they have to log in again
+func changePasswordView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		type passwordChange struct {
+			OldPassword string `json:"old_password"`
+			NewPassword string `json:"new_password"`
+		}
+		var request = passwordChange{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		// the current password can be guessed here as well as at /login
+		attempt := newLoginAttempt(r, user.Name)
+		if retryAfter := attempt.Blocked(); retryAfter > 0 {
+			writeLoginBlocked(w, retryAfter)
+			return
+		}
+
+		if !user.IsPasswordAuthenticated(request.OldPassword, &dbConn) {
+			attempt.Failed()
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("401 - Current password is incorrect"))
+			return
+		}
+		attempt.Succeeded()
+
+		if err := passwordPolicy.Validate(request.NewPassword, user.Name); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "400 - %v", err)
+			return
+		}
+
+		if err := user.ChangePassword(request.NewPassword, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		clearJWTCookie(w)
+		fmt.Fprintf(w, "Password changed, log in again with the new password")
+	}
+}
+
+// requestPasswordResetView -- emails a reset link to every active account with
+// the address. The response never says whether there were any, nor takes
+// longer when there were. Requests are throttled like logins, by IP and email.
+func requestPasswordResetView(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Add("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		return
+	case "GET":
+		fmt.Println("Should redirect to index")
+	case "POST":
+		type resetRequest struct {
+			Email string `json:"email"`
+		}
+		var request = resetRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		if validateEmail(request.Email) == nil {
+			// every request mails the address, count them all
+			attempt := newPasswordResetAttempt(r, request.Email)
+			if retryAfter := attempt.Blocked(); retryAfter > 0 {
+				writeLoginBlocked(w, retryAfter)
+				return
+			}
+			attempt.Failed()
+
+			users, err := lookupUsersFromEmail(request.Email, &dbConn)
+			if err != nil {
+				fmt.Printf("Unable to look up users by email: %v\n", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("500 - Internal Server Error"))
+				return
+			}
+
+			for _, user := range users {
+				if err := user.SendPasswordReset(request.Email); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+
+		fmt.Fprintf(w, "If an account uses %s a password reset link has been sent to it", request.Email)
+	}
+}
+
+// resetPasswordView -- sets a new password using the emailed reset token
+func resetPasswordView(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Add("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		return
+	case "GET":
+		fmt.Println("Should redirect to index")
+	case "POST":
+		type passwordReset struct {
+			Token       string `json:"token"`
+			NewPassword string `json:"new_password"`
+		}
+		var request = passwordReset{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		tokenHash := hashToken(request.Token)
+
+		// check the password first so a rejected one doesn't use the token up
+		userID, ok := passwordResetLookup(tokenHash)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Invalid or expired reset token"))
+			return
+		}
+
+		user := User{ID: userID}
+		user.LookupFromID()
+
+		if err := passwordPolicy.Validate(request.NewPassword, user.Name); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "400 - %v", err)
+			return
+		}
+
+		if userID, ok = passwordResetTake(tokenHash); !ok || userID != user.ID || !user.Active {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Invalid or expired reset token"))
+			return
+		}
+
+		if err := user.ChangePassword(request.NewPassword, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(w, "Password changed, you can now log in with the new password")
+	}
+}
+
+// pageFromQuery -- reads ?offset=<n>&limit=<n>, writing the error response
+// when they're invalid. limit defaults to 50 and is at most 500.
+func pageFromQuery(w http.ResponseWriter, query url.Values) (int, int, bool) {
+	offset, limit := 0, 50
+	if query.Get("offset") != "" {
+		var err error
+		if offset, err = strconv.Atoi(query.Get("offset")); err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return 0, 0, false
+		}
+	}
+	if query.Get("limit") != "" {
+		var err error
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 1 || limit > 500 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - limit must be between 1 and 500"))
+			return 0, 0, false
+		}
+	}
+	return offset, limit, true
+}
+
+// listUserView -- ?search=<text>&offset=<n>&limit=<n>, search matches the
+// username, email and name
+func listUserView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if !authorize(user, PermissionUserManage, 0) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	query := r.URL.Query()
+	offset, limit, ok := pageFromQuery(w, query)
+	if !ok {
+		return
+	}
+
+	users, err := searchUsers(query.Get("search"), offset, limit, &dbConn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	usersJSON, err := json.Marshal(users)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(usersJSON)
+}
+
+// viewUserView -- ?id=<user id>
+func viewUserView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if !authorize(user, PermissionUserManage, 0) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	userID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+
+	userDetail := UserDetail{}
+	if err := userDetail.LookupFromID(userID, &dbConn); err != nil {
+		log.Fatal(err)
+	}
+	if userDetail.ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - User not found"))
+		return
+	}
+
+	detailUser := User{ID: userDetail.ID}
+	userDetail.Roles = detailUser.GetRoles(&dbConn)
+
+	userDetailJSON, err := json.Marshal(userDetail)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(userDetailJSON)
+}
+
+// managedUserFromRequest -- reads {"ID": <user id>} plus anything else into v
+// and looks the user up, writing the error response when that fails
+func managedUserFromRequest(w http.ResponseWriter, r *http.Request, id *int, v interface{}) (User, bool) {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil || *id == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return User{}, false
+	}
+
+	managedUser := User{ID: *id}
+	managedUser.LookupFromID()
+	if managedUser.Name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - User not found"))
+		return User{}, false
+	}
+	return managedUser, true
+}
+
+func disableUserView(w http.ResponseWriter, r *http.Request) {
+	setUserActiveView(w, r, false)
+}
+
+func enableUserView(w http.ResponseWriter, r *http.Request) {
+	setUserActiveView(w, r, true)
+}
+
+func setUserActiveView(w http.ResponseWriter, r *http.Request, active bool) {
+	user := getUserFromRequest(r)
+
+	if !authorize(user, PermissionUserManage, 0) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		var request struct {
+			ID int
+		}
+		managedUser, ok := managedUserFromRequest(w, r, &request.ID, &request)
+		if !ok {
+			return
+		}
+
+		if managedUser.ID == user.ID {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - You can't disable or enable yourself"))
+			return
+		}
+		if managedUser.Admin && !user.Admin {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Only superusers can manage superusers"))
+			return
+		}
+
+		if err := managedUser.SetActive(active, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		if active {
+			fmt.Fprintf(w, "User %s was enabled", managedUser.Name)
+		} else {
+			fmt.Fprintf(w, "User %s was disabled", managedUser.Name)
+		}
+	}
+}
+
+// setUserFlagsView -- {"ID": <user id>, "Admin": <bool>, "Staff": <bool>},
+// flags left out are unchanged. Superusers only, the flags decide who holds
+// every permission and who can be impersonated.
+func setUserFlagsView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user || !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		var request struct {
+			ID    int
+			Admin *bool
+			Staff *bool
+		}
+		managedUser, ok := managedUserFromRequest(w, r, &request.ID, &request)
+		if !ok {
+			return
+		}
+
+		if managedUser.ID == user.ID {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - You can't change your own flags"))
+			return
+		}
+
+		admin, staff := managedUser.Admin, managedUser.Staff
+		if request.Admin != nil {
+			admin = *request.Admin
+		}
+		if request.Staff != nil {
+			staff = *request.Staff
+		}
+
+		if err := managedUser.SetFlags(admin, staff, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		userDetail := UserDetail{}
+		if err := userDetail.LookupFromID(managedUser.ID, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+		userDetailJSON, err := json.Marshal(userDetail)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(userDetailJSON)
+	}
+}
+
+// impersonateUserView -- {"ID": <user id>}, returns a short lived access token
+// to use the API as the user. Everything done with it is audited.
+func impersonateUserView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if !authorize(user, PermissionUserImpersonate, 0) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		var request struct {
+			ID int
+		}
+		managedUser, ok := managedUserFromRequest(w, r, &request.ID, &request)
+		if !ok {
+			return
+		}
+
+		if managedUser.ID == user.ID {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - You can't impersonate yourself"))
+			return
+		}
+		if managedUser.Admin && !user.Admin {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Only superusers can impersonate superusers"))
+			return
+		}
+		if !managedUser.Active {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Disabled users can't be impersonated"))
+			return
+		}
+
+		token := newImpersonationToken(user, managedUser)
+		detail := map[string]interface{}{"jti": token.JTI, "expires_at": token.ExpiresAt}
+		if err := audit(&dbConn, user, "impersonation.start", "user", managedUser.ID, detail); err != nil {
+			log.Fatal(err)
+		}
+
+		tokenJSON, err := json.Marshal(struct {
+			Access    string `json:"access"`
+			ExpiresAt int64  `json:"expires_at"`
+		}{token.String(), token.ExpiresAt})
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(tokenJSON)
+	}
+}
+
+// setUserQuotaView -- {"ID": <user id>, "records_per_user": <n>, "api_calls_per_day": <n>},
+// limits left out or null use the default and 0 is unlimited
+func setUserQuotaView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if !authorize(user, PermissionUserManage, 0) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		var request struct {
+			ID int
+			QuotaOverride
+		}
+		managedUser, ok := managedUserFromRequest(w, r, &request.ID, &request)
+		if !ok {
+			return
+		}
+
+		if (request.RecordsPerUser != nil && *request.RecordsPerUser < 0) || (request.APICallsPerDay != nil && *request.APICallsPerDay < 0) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Quotas can't be negative"))
+			return
+		}
+
+		override := request.QuotaOverride
+		override.UserID = managedUser.ID
+		if err := override.Save(&dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		quotaUsageJSON, err := json.Marshal(managedUser.GetQuotaUsage(&dbConn))
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(quotaUsageJSON)
+	}
+}
+
+// setDomainTeamView -- {"Name": "<domain>", "TeamID": <id>}, a TeamID of 0
+// takes the domain away from its team
+func setDomainTeamView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		var request struct {
+			Name   string
+			TeamID int
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		domain := Domain{}
+		if err := domain.LookupFromFQDN(request.Name); err != nil {
+			log.Fatal(err)
+		}
+		if domain.ID == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Domain Not Found"))
+			return
+		}
+
+		if !authorize(user, PermissionDomainTeam, domain.ID) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		if request.TeamID != 0 {
+			if _, ok := teamFromID(w, request.TeamID); !ok {
+				return
+			}
+		}
+
+		if err := domain.SetTeam(request.TeamID, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		domainJSON, err := json.Marshal(domain)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(domainJSON)
+	}
+}
+
+// organizationFromID -- looks the organization up, writing a 404 when there is none
+func organizationFromID(w http.ResponseWriter, id int) (Organization, bool) {
+	org := Organization{}
+	if err := org.LookupFromID(id, &dbConn); err != nil {
+		log.Fatal(err)
+	}
+	if org.ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - Organization not found"))
+		return Organization{}, false
+	}
+	return org, true
+}
+
+// teamFromID -- looks the team up, writing a 404 when there is none
+func teamFromID(w http.ResponseWriter, id int) (Team, bool) {
+	team := Team{}
+	if err := team.LookupFromID(id, &dbConn); err != nil {
+		log.Fatal(err)
+	}
+	if team.ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - Team not found"))
+		return Team{}, false
+	}
+	return team, true
+}
+
+// createOrganizationView -- {"Name": "<name>"}, the requesting user becomes its owner
+func createOrganizationView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		var request struct {
+			Name string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !validGroupName(request.Name) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		org := Organization{Name: strings.TrimSpace(request.Name)}
+		if err := org.Save(&dbConn); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Unable to create organization, the name may be taken"))
+			return
+		}
+		if err := org.SetMember(user.ID, orgRoleOwner, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+		org.Role = orgRoleOwner
+
+		orgJSON, err := json.Marshal(org)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(orgJSON)
+	}
+}
+
+// listOrganizationView -- the organizations the requesting user is a member of
+func listOrganizationView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	orgs, err := listUserOrganizations(user.ID, &dbConn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	orgsJSON, err := json.Marshal(orgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(orgsJSON)
+}
+
+// viewOrganizationView -- ?id=<organization id>, with its members and teams
+func viewOrganizationView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	orgID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+
+	org, ok := organizationFromID(w, orgID)
+	if !ok {
+		return
+	}
+
+	if org.Role = orgRoleForUser(user, org); org.Role == "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	if org.Members, err = org.GetMembers(&dbConn); err != nil {
+		log.Fatal(err)
+	}
+	if org.Teams, err = org.GetTeams(&dbConn); err != nil {
+		log.Fatal(err)
+	}
+
+	orgJSON, err := json.Marshal(org)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(orgJSON)
+}
+
+// deleteOrganizationView -- {"ID": <organization id>}, owners only. Records and
+// domains of its teams go back to being owned by their owner alone.
+func deleteOrganizationView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "DELETE":
+		var request struct {
+			ID int
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		org, ok := organizationFromID(w, request.ID)
+		if !ok {
+			return
+		}
+
+		if orgRoleForUser(user, org) != orgRoleOwner {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		if err := org.Delete(&dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(w, "Organization %s was deleted", org.Name)
+	}
+}
+
+// setOrganizationMemberView -- {"OrgID": <id>, "UserID": <id>, "Role": "owner|admin|member"},
+// adds the user or changes their role
+func setOrganizationMemberView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		var request struct {
+			OrgID  int
+			UserID int
+			Role   string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !validOrgRole(request.Role) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		org, ok := organizationFromID(w, request.OrgID)
+		if !ok {
+			return
+		}
+
+		currentRole := org.MemberRole(request.UserID, &dbConn)
+		if !orgRoleCanSet(orgRoleForUser(user, org), currentRole, request.Role) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		member := User{ID: request.UserID}
+		member.LookupFromID()
+		if member.Name == "" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - User not found"))
+			return
+		}
+
+		if currentRole == orgRoleOwner && request.Role != orgRoleOwner && org.CountOwners(&dbConn) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Organizations need at least one owner"))
+			return
+		}
+
+		if err := org.SetMember(member.ID, request.Role, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		members, err := org.GetMembers(&dbConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		membersJSON, err := json.Marshal(members)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(membersJSON)
+	}
+}
+
+// removeOrganizationMemberView -- {"OrgID": <id>, "UserID": <id>}, removes the
+// user from the organization and its teams. Members can always leave.
+func removeOrganizationMemberView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "DELETE":
+		var request struct {
+			OrgID  int
+			UserID int
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		org, ok := organizationFromID(w, request.OrgID)
+		if !ok {
+			return
+		}
+
+		currentRole := org.MemberRole(request.UserID, &dbConn)
+		leaving := user.ID != 0 && user.ID == request.UserID
+		if !leaving && !orgRoleCanSet(orgRoleForUser(user, org), currentRole, "") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		if currentRole == orgRoleOwner && org.CountOwners(&dbConn) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Organizations need at least one owner"))
+			return
+		}
+
+		removed, err := org.RemoveMember(request.UserID, &dbConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !removed {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Not Found"))
+			return
+		}
+
+		fmt.Fprintf(w, "Member was removed successfully")
+	}
+}
+
+// createTeamView -- {"OrgID": <id>, "Name": "<name>"}, organization owners and admins only
+func createTeamView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		var request struct {
+			OrgID int
+			Name  string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !validGroupName(request.Name) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		org, ok := organizationFromID(w, request.OrgID)
+		if !ok {
+			return
+		}
+
+		if !orgRoleManages(orgRoleForUser(user, org)) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		team := Team{OrgID: org.ID, Name: strings.TrimSpace(request.Name)}
+		if err := team.Save(&dbConn); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Unable to create team, the name may be taken"))
+			return
+		}
+
+		teamJSON, err := json.Marshal(team)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(teamJSON)
+	}
+}
+
+// viewTeamView -- ?id=<team id>, with its members, for members of its organization
+func viewTeamView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	teamID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+
+	team, ok := teamFromID(w, teamID)
+	if !ok {
+		return
+	}
+
+	if orgRoleForUser(user, Organization{ID: team.OrgID}) == "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	if team.Members, err = team.GetMembers(&dbConn); err != nil {
+		log.Fatal(err)
+	}
+
+	teamJSON, err := json.Marshal(team)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(teamJSON)
+}
+
+// deleteTeamView -- {"ID": <team id>}, its records and domains go back to
+// being owned by their owner alone
+func deleteTeamView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "DELETE":
+		var request struct {
+			ID int
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		team, ok := teamFromID(w, request.ID)
+		if !ok {
+			return
+		}
+
+		if !orgRoleManages(orgRoleForUser(user, Organization{ID: team.OrgID})) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		if err := team.Delete(&dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(w, "Team %s was deleted", team.Name)
+	}
+}
+
+// setTeamMemberView -- {"TeamID": <id>, "UserID": <id>, "Role": "maintainer|member"},
+// adds a member of the team's organization or changes their role
+func setTeamMemberView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		var request struct {
+			TeamID int
+			UserID int
+			Role   string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !validTeamRole(request.Role) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		team, ok := teamFromID(w, request.TeamID)
+		if !ok {
+			return
+		}
+
+		if teamRoleForUser(user, team) != teamRoleMaintainer {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		org := Organization{ID: team.OrgID}
+		if org.MemberRole(request.UserID, &dbConn) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Only members of the organization can join its teams"))
+			return
+		}
+
+		if err := team.SetMember(request.UserID, request.Role, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		members, err := team.GetMembers(&dbConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		membersJSON, err := json.Marshal(members)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(membersJSON)
+	}
+}
+
+// removeTeamMemberView -- {"TeamID": <id>, "UserID": <id>}, members can always leave
+func removeTeamMemberView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "DELETE":
+		var request struct {
+			TeamID int
+			UserID int
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		team, ok := teamFromID(w, request.TeamID)
+		if !ok {
+			return
+		}
+
+		leaving := user.ID != 0 && user.ID == request.UserID
+		if !leaving && teamRoleForUser(user, team) != teamRoleMaintainer {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		removed, err := team.RemoveMember(request.UserID, &dbConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !removed {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Not Found"))
+			return
+		}
+
+		fmt.Fprintf(w, "Member was removed successfully")
+	}
+}
+
+// createRecordTransferView -- {"Record": "<fqdn>"} or {"Domain": "<domain>", "Filter": "<text>"}
+// or {"All": true}, with {"FromUserID": <id>, "ToUserID": <id>} or {"ToTeamID": <id>}.
+// FromUserID defaults to the record's owner or the requesting user.
+// Transferring anyone else's records takes record.transfer, which also skips
+// the recipient accepting.
+func createRecordTransferView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		var request struct {
+			Record     string
+			Domain     string
+			Filter     string
+			All        bool
+			FromUserID int
+			ToUserID   int
+			ToTeamID   int
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || (request.ToUserID == 0) == (request.ToTeamID == 0) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+		if request.Record == "" && request.Domain == "" && request.Filter == "" && !request.All {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Choose a record, a domain, a filter or all records"))
+			return
+		}
+
+		selection := TransferSelection{OwnerID: request.FromUserID, Filter: request.Filter}
+		if selection.OwnerID == 0 {
+			selection.OwnerID = user.ID
+		}
+
+		if request.Record != "" {
+			record := Record{}
+			if err := record.LookupFromFQDN(request.Record); err != nil {
+				log.Fatal(err)
+			}
+			if record.ID == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("404 - Record Not Found"))
+				return
+			}
+			selection = TransferSelection{OwnerID: request.FromUserID, RecordID: record.ID, DomainID: record.DomainID}
+			if selection.OwnerID == 0 {
+				selection.OwnerID = record.OwnerID
+			}
+		} else if request.Domain != "" {
+			domain := Domain{}
+			if err := domain.LookupFromFQDN(request.Domain); err != nil {
+				log.Fatal(err)
+			}
+			if domain.ID == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("404 - Domain Not Found"))
+				return
+			}
+			selection.DomainID = domain.ID
+		}
+
+		if selection.OwnerID != user.ID && !authorize(user, PermissionRecordTransfer, selection.DomainID) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		if request.ToUserID != 0 {
+			recipient := User{ID: request.ToUserID}
+			recipient.LookupFromID()
+			if recipient.Name == "" || !recipient.Active {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("404 - User not found"))
+				return
+			}
+			if recipient.ID == selection.OwnerID {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("400 - The records already belong to that user"))
+				return
+			}
+		} else if _, ok := teamFromID(w, request.ToTeamID); !ok {
+			return
+		}
+
+		recordIDs, err := selection.matchRecords(&dbConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(recordIDs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - No matching records"))
+			return
+		}
+
+		transfer := RecordTransfer{
+			FromUserID: selection.OwnerID,
+			ToUserID:   request.ToUserID,
+			ToTeamID:   request.ToTeamID,
+			RecordIDs:  recordIDs,
+		}
+
+		// only a global grant skips the recipient accepting, a domain scoped
+		// one could otherwise push records onto any user
+		autoAccept := authorize(user, PermissionRecordTransfer, 0)
+		if autoAccept && transferExceedsQuota(w, transfer) {
+			return
+		}
+
+		if err := transfer.Save(user, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		if autoAccept {
+			if _, err := transfer.Accept(user, &dbConn); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		transferJSON, err := json.Marshal(transfer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(transferJSON)
+	}
+}
+
+// listRecordTransferView -- the pending transfers from or to the requesting user
+func listRecordTransferView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	transfers, err := listPendingTransfers(user, &dbConn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	transfersJSON, err := json.Marshal(transfers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(transfersJSON)
+}
+
+// transferFromRequest -- reads {"ID": <transfer id>} and looks the transfer up,
+// writing the error response when that fails
+func transferFromRequest(w http.ResponseWriter, r *http.Request) (RecordTransfer, bool) {
+	var request struct {
+		ID int
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return RecordTransfer{}, false
+	}
+
+	transfer := RecordTransfer{}
+	if err := transfer.LookupFromID(request.ID, &dbConn); err != nil {
+		log.Fatal(err)
+	}
+	if transfer.ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - Transfer not found"))
+		return RecordTransfer{}, false
+	}
+	return transfer, true
+}
+
+// transferExceedsQuota -- whether accepting transfer would take its recipient
+// over their record quota, writing the error response when it does
+func transferExceedsQuota(w http.ResponseWriter, transfer RecordTransfer) bool {
+	if transfer.ToUserID == 0 {
+		return false
+	}
+
+	recipient := User{ID: transfer.ToUserID}
+	usage := QuotaUsage{Limit: recipient.GetQuotas(&dbConn).RecordsPerUser, Usage: recipient.CountRecords(&dbConn)}
+	if usage.Limit > 0 && usage.Usage+len(transfer.RecordIDs) > usage.Limit {
+		writeQuotaExceeded(w, http.StatusForbidden, quotaRecordsPerUser, usage)
+		return true
+	}
+	return false
+}
+
+// acceptRecordTransferView -- {"ID": <transfer id>}, for the recipient (a
+// maintainer for teams)
+func acceptRecordTransferView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		transfer, ok := transferFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if !transfer.IsRecipient(user) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+
+		if transferExceedsQuota(w, transfer) {
+			return
+		}
+
+		moved, err := transfer.Accept(user, &dbConn)
+		if err == ErrTransferResolved {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("409 - Transfer is no longer pending"))
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(w, "Transfer was accepted, %d records were moved", moved)
+	}
+}
+
+// declineRecordTransferView -- {"ID": <transfer id>}, declines the transfer
+// for the recipient or cancels it for the sender
+func declineRecordTransferView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "POST":
+		transfer, ok := transferFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		var err error
+		switch {
+		case transfer.IsRecipient(user):
+			err = transfer.Decline(user, &dbConn)
+		case transfer.IsSender(user):
+			err = transfer.Cancel(user, &dbConn)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Forbidden"))
+			return
+		}
+		if err == ErrTransferResolved {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("409 - Transfer is no longer pending"))
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(w, "Transfer was %s", transfer.Status)
+	}
+}
+
+// listAuditView -- ?actor_id=<id>&impersonator_id=<id>&action=<action>&object_type=<type>&object_id=<id>&offset=<n>&limit=<n>,
+// newest first
+func listAuditView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if !authorize(user, PermissionAuditView, 0) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	query := r.URL.Query()
+	offset, limit, ok := pageFromQuery(w, query)
+	if !ok {
+		return
+	}
+
+	filter := AuditFilter{Action: query.Get("action"), ObjectType: query.Get("object_type")}
+	for param, id := range map[string]*int{"actor_id": &filter.ActorID, "impersonator_id": &filter.ImpersonatorID, "object_id": &filter.ObjectID} {
+		if query.Get(param) == "" {
+			continue
+		}
+		var err error
+		if *id, err = strconv.Atoi(query.Get(param)); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+	}
+
+	entries, err := listAuditEntries(filter, offset, limit, &dbConn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	entriesJSON, err := json.Marshal(entries)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(entriesJSON)
+}
+
+// listSessionView -- the requesting user's logins that haven't expired or been
+// revoked, with the one the request was made from marked current
+func listSessionView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+
+	sessions, err := listUserSessions(user.ID, &dbConn)
+	if err != nil {
+		fmt.Printf("Unable to list sessions: %v\n", err)
+		writeServiceUnavailable(w)
+		return
+	}
+
+	jwtToken := JWTToken{}
+	jwtToken.LookupFromString(getJWTFromRequest(r))
+	for i := range sessions {
+		sessions[i].Current = jwtToken.Family != "" && sessions[i].Family == jwtToken.Family
+	}
+
+	sessionsJSON, err := json.Marshal(sessions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(sessionsJSON)
+}
+
+// revokeSessionView -- {"ID": <session id>}, logs one of the requesting user's
+// sessions out, its tokens stop working straight away
+func revokeSessionView(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+
+	if (User{}) == user {
+		// Empty user returned from token lookup - implied user not found
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return
+	}
+	if forbidImpersonation(w, user) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		fmt.Println("should redirect to index on GET request")
+	case "DELETE":
+		var request struct {
+			ID int
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400 - Bad Request"))
+			return
+		}
+
+		session := Session{}
+		if err := session.LookupFromID(request.ID, user.ID, &dbConn); err != nil {
+			log.Fatal(err)
+		}
+		if session.ID == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Session not found"))
+			return
+		}
+
+		if err := session.Revoke(&dbConn); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(w, "Session was revoked successfully")
+	}
+}